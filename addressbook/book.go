@@ -0,0 +1,111 @@
+package addressbook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+type (
+	// Book represents a local address book of resolved recipients,
+	// persisted as a JSON file
+	Book struct {
+		mu      sync.RWMutex
+		path    string
+		entries map[string]Entry
+	}
+
+	// Entry represents a recipient resolved for a token
+	Entry struct {
+		Recipient string            `json:"recipient"`
+		TokenID   hezCommon.TokenID `json:"tokenId"`
+		Type      hezCommon.TxType  `json:"type"`
+		ToIdx     hezCommon.Idx     `json:"toIdx,omitempty"`
+		ToEthAddr string            `json:"toHezEthereumAddress,omitempty"`
+		ToBJJ     string            `json:"toBjj,omitempty"`
+		UpdatedAt time.Time         `json:"updatedAt"`
+	}
+)
+
+// Load loads the address book from the file path. A missing file
+// returns an empty address book. An empty path keeps the book in memory
+func Load(path string) (*Book, error) {
+	b := &Book{path: path, entries: make(map[string]Entry)}
+	if path == "" {
+		return b, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, errors.E("cannot read the address book", err, errors.Params{"path": path})
+	}
+	entries := make([]Entry, 0)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.E("invalid address book file", err, errors.Params{"path": path})
+	}
+	for _, e := range entries {
+		b.entries[key(e.Recipient, e.TokenID)] = e
+	}
+	return b, nil
+}
+
+// Get returns the entry of the recipient for the token
+func (b *Book) Get(recipient string, tokenID hezCommon.TokenID) (Entry, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	e, ok := b.entries[key(recipient, tokenID)]
+	return e, ok
+}
+
+// Set adds or replaces an entry and saves the address book
+func (b *Book) Set(e Entry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[key(e.Recipient, e.TokenID)] = e
+	return b.save()
+}
+
+// Entries returns all address book entries
+func (b *Book) Entries() []Entry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	entries := make([]Entry, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// save writes the address book into a temporary file and renames it,
+// so a crash never leaves a partial file
+func (b *Book) save() error {
+	if b.path == "" {
+		return nil
+	}
+	entries := make([]Entry, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.E("cannot write the address book", err, errors.Params{"path": tmp})
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// key returns the entry key for the recipient and token
+func key(recipient string, tokenID hezCommon.TokenID) string {
+	return recipient + "/" + strconv.Itoa(int(tokenID))
+}
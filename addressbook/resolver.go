@@ -0,0 +1,165 @@
+package addressbook
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/hermez"
+	"github.com/hermeznetwork/hermez-integration/transaction"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+type (
+	// Resolver represents the recipient resolver, it selects the cheapest
+	// tx type to reach a recipient and caches it into the address book
+	Resolver struct {
+		client *client.Client
+		book   *Book
+		// ttl is the cache duration of recipients without account,
+		// resolved accounts idx never change and never expire
+		ttl time.Duration
+	}
+)
+
+// NewResolver creates a new recipient resolver. The ttl is the cache
+// duration of recipients without an account for the token
+func NewResolver(c *client.Client, book *Book, ttl time.Duration) *Resolver {
+	return &Resolver{client: c, book: book, ttl: ttl}
+}
+
+// Resolve resolves the recipient (hez eth address, hez BJJ address or
+// account index) for the token. If the recipient already has an account
+// for the token, a transfer to the account idx is selected, otherwise a
+// transfer to the eth address (requires the account creation
+// authorization) or to the BJJ address
+func (r *Resolver) Resolve(recipient string, token hezCommon.Token) (Entry, error) {
+	parsed, err := hermez.ParseRecipient(recipient)
+	if err != nil {
+		return Entry{}, err
+	}
+	normalized := normalize(parsed, token)
+	if e, ok := r.book.Get(normalized, token.TokenID); ok &&
+		(e.Type == hezCommon.TxTypeTransfer || time.Since(e.UpdatedAt) < r.ttl) {
+		return e, nil
+	}
+
+	e := Entry{
+		Recipient: normalized,
+		TokenID:   token.TokenID,
+		UpdatedAt: time.Now(),
+	}
+	switch parsed.Type {
+	case hezCommon.TxTypeTransfer:
+		if parsed.TokenSymbol != "" && parsed.TokenSymbol != token.Symbol {
+			return Entry{}, errors.E("recipient token mismatch",
+				errors.Params{"symbol": parsed.TokenSymbol, "token": token.Symbol})
+		}
+		ac, err := r.client.GetAccountByIdx(parsed.Idx, token.Symbol)
+		if err != nil {
+			return Entry{}, err
+		}
+		if ac.Token.TokenID != token.TokenID {
+			return Entry{}, errors.E("recipient account token mismatch",
+				errors.Params{"idx": parsed.Idx, "token_id": ac.Token.TokenID})
+		}
+		e.Type = hezCommon.TxTypeTransfer
+		e.ToIdx = parsed.Idx
+	case hezCommon.TxTypeTransferToEthAddr:
+		e.ToEthAddr = parsed.EthAddr
+		idx, ok, err := r.accountIdx(nil, &parsed.EthAddr, token.TokenID)
+		if err != nil {
+			return Entry{}, err
+		}
+		if ok {
+			e.Type = hezCommon.TxTypeTransfer
+			e.ToIdx = idx
+			break
+		}
+		if _, err := r.client.AccountAuth(parsed.EthAddr); err != nil {
+			return Entry{}, errors.E("recipient without account and account creation authorization",
+				err, errors.Params{"recipient": parsed.EthAddr})
+		}
+		e.Type = hezCommon.TxTypeTransferToEthAddr
+	case hezCommon.TxTypeTransferToBJJ:
+		e.ToBJJ = parsed.BJJ
+		idx, ok, err := r.accountIdx(&parsed.BJJ, nil, token.TokenID)
+		if err != nil {
+			return Entry{}, err
+		}
+		if ok {
+			e.Type = hezCommon.TxTypeTransfer
+			e.ToIdx = idx
+			break
+		}
+		e.Type = hezCommon.TxTypeTransferToBJJ
+	}
+
+	if err := r.book.Set(e); err != nil {
+		logger.Error(errors.E("cannot save the address book", err))
+	}
+	logger.Info("Recipient resolved", logger.Params{
+		"recipient": e.Recipient,
+		"token":     token.Symbol,
+		"type":      e.Type,
+		"idx":       e.ToIdx,
+	})
+	return e, nil
+}
+
+// Transfer resolves the recipient and create and send the transfer with
+// the selected tx type
+func (r *Resolver) Transfer(ctx context.Context, bjj *hermez.Wallet, chainID uint16, fromIdx hezCommon.Idx,
+	recipient string, amount *big.Int, fee hezCommon.FeeSelector, token hezCommon.Token,
+	nonce hezCommon.Nonce) (string, error) {
+
+	e, err := r.Resolve(recipient, token)
+	if err != nil {
+		return "", err
+	}
+	switch e.Type {
+	case hezCommon.TxTypeTransfer:
+		return transaction.Transfer(ctx, bjj, r.client, chainID, fromIdx, e.ToIdx, amount, fee, token, nonce)
+	case hezCommon.TxTypeTransferToEthAddr:
+		return transaction.TransferToEthAddress(ctx, bjj, r.client, chainID, fromIdx, e.ToEthAddr, amount, fee, token, nonce)
+	case hezCommon.TxTypeTransferToBJJ:
+		return transaction.TransferToBjj(ctx, bjj, r.client, chainID, fromIdx, e.ToBJJ, amount, fee, token, nonce)
+	default:
+		return "", errors.E("tx type not supported", errors.Params{"type": e.Type})
+	}
+}
+
+// accountIdx returns the account idx of the address for the token. It
+// returns false only if the node confirms the address has no account for
+// the token, the node errors are returned so the fallback tx type is not
+// cached for a recipient with an account
+func (r *Resolver) accountIdx(bjjAddress, hezEthAddress *string, tokenID hezCommon.TokenID) (hezCommon.Idx, bool, error) {
+	ac, err := r.client.GetAccount(bjjAddress, hezEthAddress, tokenID)
+	if client.IsNotRegistered(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.E("cannot get the recipient account", err)
+	}
+	account, err := ac.Accounts.GetFirstAccount(tokenID)
+	if err != nil {
+		// accounts of other tokens only
+		return 0, false, nil
+	}
+	return hezCommon.Idx(account.Idx), true, nil
+}
+
+// normalize returns the canonical recipient string used as cache key
+func normalize(r hermez.Recipient, token hezCommon.Token) string {
+	switch r.Type {
+	case hezCommon.TxTypeTransferToEthAddr:
+		return r.EthAddr
+	case hezCommon.TxTypeTransferToBJJ:
+		return r.BJJ
+	default:
+		return "hez:" + token.Symbol + ":" + r.Idx.String()
+	}
+}
@@ -0,0 +1,844 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed" // embed the OpenAPI spec
+	"encoding/json"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-integration/approval"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/hermez"
+	"github.com/hermeznetwork/hermez-integration/policy"
+	"github.com/hermeznetwork/hermez-integration/tokens"
+	"github.com/hermeznetwork/hermez-integration/track"
+	"github.com/hermeznetwork/hermez-integration/transaction"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// TxStatePending represents a tx into the pool
+	TxStatePending = "pending"
+	// TxStateForged represents a tx forged into a batch
+	TxStateForged = "forged"
+	// TxStateInvalid represents a tx rejected by the pool
+	TxStateInvalid = "invalid"
+
+	// apiKeyHeader is the API key header, the Authorization bearer token
+	// is also accepted
+	apiKeyHeader = "X-API-Key"
+	// apiProposer is the proposer of the withdrawal proposals
+	apiProposer = "api"
+	// defaultDepositsLimit is the default number of deposits listed
+	defaultDepositsLimit = 100
+	// maxDepositsLimit is the maximum number of deposits listed
+	maxDepositsLimit = 1000
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+type (
+	// Server represents the exchange wallet HTTP JSON service. The user
+	// deposit addresses are derived from the mnemonic and the withdrawals
+	// are sent from the hot wallet
+	Server struct {
+		client    *client.Client
+		feed      *track.Feed
+		cfg       Config
+		apiKeys   [][sha256.Size]byte
+		operators []operator
+
+		walletsMu sync.Mutex
+		wallets   map[int]*hermez.Wallet
+
+		// sendMu serializes the withdrawals, sent keeps the tx ids by
+		// nonce of the hot wallet accounts txs not forged yet
+		sendMu sync.Mutex
+		sent   map[hezCommon.Idx]map[hezCommon.Nonce]string
+	}
+
+	// Config represents the server configuration
+	Config struct {
+		ChainID        uint16
+		RollupContract ethCommon.Address
+		// Mnemonic is the mnemonic of the user deposit wallets
+		Mnemonic string
+		// HotWallet is the wallet sending the withdrawals
+		HotWallet *hermez.Wallet
+		// Fee is the default withdrawal fee selector
+		Fee hezCommon.FeeSelector
+		// APIKeys are the keys allowed to call the API
+		APIKeys []string
+		// Watch is the deposit tracker watch-list, the derived addresses
+		// are added to it. Optional
+		Watch *track.WatchList
+		// Tokens is the token registry resolving the withdrawal tokens.
+		// Optional, the node tokens are read by symbol without it
+		Tokens *tokens.Registry
+		// Policy is the withdrawal policy engine, its approval queue is
+		// served to the operators. Optional
+		Policy *policy.Engine
+		// Approvals is the M-of-N approval store, the withdrawals above
+		// its limits create a proposal executed by the operators once
+		// approved. Optional
+		Approvals *approval.Store
+		// Operators are the API keys by operator name allowed to decide
+		// the policy approvals and to manage the proposals, the operator
+		// name is recorded with the decision. Required with a policy or
+		// an approval store
+		Operators map[string]string
+	}
+
+	// proposalSender sends the proposal txs from the hot wallet, sharing
+	// the withdrawals nonces
+	proposalSender struct {
+		s *Server
+	}
+
+	// operator represents an operator API key
+	operator struct {
+		name string
+		key  [sha256.Size]byte
+	}
+
+	// Address represents a user deposit address
+	Address struct {
+		Index         int    `json:"index"`
+		HezEthAddress string `json:"hezEthereumAddress"`
+		HezBjjAddress string `json:"hezBjjAddress"`
+	}
+
+	// Balance represents a rollup account balance
+	Balance struct {
+		AccountIndex string            `json:"accountIndex"`
+		TokenID      hezCommon.TokenID `json:"tokenId"`
+		TokenSymbol  string            `json:"tokenSymbol"`
+		Balance      string            `json:"balance"`
+		Nonce        hezCommon.Nonce   `json:"nonce"`
+	}
+
+	// Balances represents the balances of a user deposit address
+	Balances struct {
+		Address
+		Balances []Balance `json:"balances"`
+	}
+
+	// WithdrawalRequest represents a withdrawal to be sent from the hot
+	// wallet
+	WithdrawalRequest struct {
+		// Recipient can be a hez eth address, a hez BJJ address or an idx.
+		// It must be empty for exits
+		Recipient string `json:"recipient"`
+		// Token is the token symbol, or the token id or ERC20 address
+		// with a token registry
+		Token string `json:"token"`
+		// Amount in the token base unit
+		Amount string `json:"amount"`
+		// Fee is the fee selector, the server default if not defined
+		Fee *hezCommon.FeeSelector `json:"fee,omitempty"`
+		// Exit sends the amount to the exit tree
+		Exit bool `json:"exit"`
+	}
+
+	// Withdrawal represents a withdrawal sent to the pool, or a proposal
+	// waiting for the approvals of a withdrawal above the approval limits
+	Withdrawal struct {
+		TxID       string           `json:"txId,omitempty"`
+		Type       hezCommon.TxType `json:"type"`
+		Nonce      hezCommon.Nonce  `json:"nonce"`
+		ProposalID string           `json:"proposalId,omitempty"`
+	}
+
+	// ProposalDecision represents an approver signature of a proposal
+	// approval or rejection message
+	ProposalDecision struct {
+		Signature string `json:"signature"`
+	}
+
+	// TxStatus represents a tx status
+	TxStatus struct {
+		TxID      string                  `json:"txId"`
+		State     string                  `json:"state"`
+		PoolState hezCommon.PoolL2TxState `json:"poolState,omitempty"`
+		BatchNum  hezCommon.BatchNum      `json:"batchNum,omitempty"`
+	}
+
+	// Deposits represents a deposits page, the cursor must be sent to
+	// fetch the next page
+	Deposits struct {
+		Deposits []track.Deposit `json:"deposits"`
+		Cursor   uint64          `json:"cursor"`
+	}
+
+	// RequestError represents an invalid request error
+	RequestError struct {
+		err error
+	}
+
+	// NodeError represents a node lookup error, the request is not sent
+	// since the node state is unknown
+	NodeError struct {
+		err error
+	}
+
+	// errorResponse represents an error response
+	errorResponse struct {
+		Error string `json:"error"`
+	}
+)
+
+// New creates a new API server
+func New(c *client.Client, feed *track.Feed, cfg Config) (*Server, error) {
+	if len(cfg.APIKeys) == 0 {
+		return nil, errors.E("API keys not defined")
+	}
+	if cfg.Mnemonic == "" || cfg.HotWallet == nil {
+		return nil, errors.E("mnemonic and hot wallet must be defined")
+	}
+	s := &Server{
+		client:  c,
+		feed:    feed,
+		cfg:     cfg,
+		wallets: make(map[int]*hermez.Wallet),
+		sent:    make(map[hezCommon.Idx]map[hezCommon.Nonce]string),
+	}
+	for _, key := range cfg.APIKeys {
+		if key == "" {
+			return nil, errors.E("empty API key")
+		}
+		s.apiKeys = append(s.apiKeys, sha256.Sum256([]byte(key)))
+	}
+	if (cfg.Policy != nil || cfg.Approvals != nil) && len(cfg.Operators) == 0 {
+		return nil, errors.E("operators not defined")
+	}
+	for name, key := range cfg.Operators {
+		if name == "" || key == "" {
+			return nil, errors.E("empty operator name or API key")
+		}
+		s.operators = append(s.operators, operator{name: name, key: sha256.Sum256([]byte(key))})
+	}
+	return s, nil
+}
+
+// Routes adds the API endpoints to the mux. The OpenAPI spec is public,
+// the policy approvals and proposals endpoints require an operator API
+// key and all other endpoints require an API key
+func (s *Server) Routes(mux *http.ServeMux) {
+	mux.HandleFunc("/v1/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(openAPISpec)
+	})
+	mux.Handle("/v1/addresses/", s.auth(http.MethodGet, s.handleAddress))
+	mux.Handle("/v1/withdrawals", s.auth(http.MethodPost, s.handleWithdrawal))
+	mux.Handle("/v1/txs/", s.auth(http.MethodGet, s.handleTxStatus))
+	mux.Handle("/v1/deposits", s.auth(http.MethodGet, s.handleDeposits))
+	if s.cfg.Policy != nil {
+		mux.Handle("/v1/policy/approvals", s.operatorAuth(http.MethodGet, s.handlePolicyApprovals))
+		mux.Handle("/v1/policy/approvals/", s.operatorAuth(http.MethodPost, s.handlePolicyDecision))
+	}
+	if s.cfg.Approvals != nil {
+		mux.Handle("/v1/proposals", s.operatorAuth(http.MethodGet, s.handleProposals))
+		mux.Handle("/v1/proposals/", s.operatorAuth(http.MethodPost, s.handleProposalAction))
+	}
+}
+
+// auth checks the method and the API key before call the handler
+func (s *Server) auth(method string, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, errors.E("method not allowed"))
+			return
+		}
+		if !s.ValidKey(requestKey(r)) {
+			writeError(w, http.StatusUnauthorized, errors.E("invalid API key"))
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// operatorAuth checks the method and the operator API key before call the
+// handler with the operator name
+func (s *Server) operatorAuth(method string, handler func(w http.ResponseWriter, r *http.Request, operator string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, errors.E("method not allowed"))
+			return
+		}
+		operator, ok := s.Operator(requestKey(r))
+		if !ok {
+			writeError(w, http.StatusUnauthorized, errors.E("invalid operator API key"))
+			return
+		}
+		handler(w, r, operator)
+	})
+}
+
+// requestKey returns the request API key, from the API key header or the
+// Authorization bearer token
+func requestKey(r *http.Request) string {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return key
+}
+
+// ValidKey checks the API key in constant time
+func (s *Server) ValidKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(key))
+	valid := 0
+	for _, k := range s.apiKeys {
+		valid |= subtle.ConstantTimeCompare(sum[:], k[:])
+	}
+	return valid == 1
+}
+
+// Operator returns the operator name of the operator API key, checking
+// all keys in constant time
+func (s *Server) Operator(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(key))
+	name := ""
+	for _, o := range s.operators {
+		if subtle.ConstantTimeCompare(sum[:], o.key[:]) == 1 {
+			name = o.name
+		}
+	}
+	return name, name != ""
+}
+
+// handleAddress serves the deposit address of the user wallet index
+// (/v1/addresses/{index}) and its balances (/v1/addresses/{index}/balances)
+func (s *Server) handleAddress(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/addresses/"), "/")
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "balances") {
+		writeError(w, http.StatusNotFound, errors.E("not found"))
+		return
+	}
+	index, err := strconv.Atoi(parts[0])
+	if err != nil || index < 0 || index > math.MaxInt32 {
+		writeError(w, http.StatusBadRequest, errors.E("invalid wallet index", errors.Params{"index": parts[0]}))
+		return
+	}
+	// the derived address is added to the deposit tracker watch-list
+	address, err := s.Address(r.Context(), index)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, address)
+		return
+	}
+
+	balances := Balances{Address: address, Balances: make([]Balance, 0)}
+	ac, err := s.client.GetAccounts(&address.HezBjjAddress, nil)
+	if client.IsNotRegistered(err) {
+		// a wallet without deposits has no accounts
+		logger.Info("Account not found", logger.Params{"index": index})
+		writeJSON(w, http.StatusOK, balances)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errors.E("cannot get the balances", err, errors.Params{"index": index}))
+		return
+	}
+	for _, a := range ac.Accounts {
+		balance := "0"
+		if a.Balance != nil {
+			balance = a.Balance.String()
+		}
+		balances.Balances = append(balances.Balances, Balance{
+			AccountIndex: "hez:" + a.Token.Symbol + ":" + strconv.Itoa(int(a.Idx)),
+			TokenID:      a.Token.TokenID,
+			TokenSymbol:  a.Token.Symbol,
+			Balance:      balance,
+			Nonce:        a.Nonce,
+		})
+	}
+	writeJSON(w, http.StatusOK, balances)
+}
+
+// handleWithdrawal signs and sends a withdrawal from the hot wallet
+func (s *Server) handleWithdrawal(w http.ResponseWriter, r *http.Request) {
+	var req WithdrawalRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.E("invalid withdrawal request", err))
+		return
+	}
+	withdrawal, err := s.Withdraw(r.Context(), req)
+	if _, ok := err.(*RequestError); ok {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := err.(*NodeError); ok {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if withdrawal.ProposalID != "" {
+		writeJSON(w, http.StatusAccepted, withdrawal)
+		return
+	}
+	writeJSON(w, http.StatusCreated, withdrawal)
+}
+
+// Withdraw validates, signs and sends a withdrawal from the hot wallet.
+// A withdrawal above the approval limits is not sent, a proposal is
+// created instead and its tx is sent when executed once approved. An
+// invalid request returns a *RequestError and a node lookup error
+// returns a *NodeError
+func (s *Server) Withdraw(ctx context.Context, req WithdrawalRequest) (Withdrawal, error) {
+	amount, ok := new(big.Int).SetString(req.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return Withdrawal{}, &RequestError{errors.E("invalid amount", errors.Params{"amount": req.Amount})}
+	}
+	if req.Exit == (req.Recipient != "") {
+		return Withdrawal{}, &RequestError{errors.E("either a recipient or an exit must be defined")}
+	}
+	var to hermez.Recipient
+	if !req.Exit {
+		var err error
+		if to, err = hermez.ParseRecipient(req.Recipient); err != nil {
+			return Withdrawal{}, &RequestError{err}
+		}
+	}
+	token, err := s.token(req.Token)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	fee := s.cfg.Fee
+	if req.Fee != nil {
+		fee = *req.Fee
+	}
+
+	if s.cfg.Approvals != nil && s.cfg.Approvals.Required(token.TokenID, amount) {
+		return s.propose(req, amount, fee, token)
+	}
+
+	withdrawal, err := s.send(ctx, req.Exit, to, amount, fee, token)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	logger.Info("Withdrawal sent", logger.Params{"tx_id": withdrawal.TxID, "recipient": req.Recipient,
+		"amount": req.Amount, "token": req.Token})
+	return withdrawal, nil
+}
+
+// propose creates the proposal of a withdrawal from the hot wallet
+func (s *Server) propose(req WithdrawalRequest, amount *big.Int, fee hezCommon.FeeSelector,
+	token hezCommon.Token) (Withdrawal, error) {
+	intent := approval.Intent{
+		ChainID:     s.cfg.ChainID,
+		WalletIndex: s.cfg.HotWallet.Index,
+		Recipient:   req.Recipient,
+		TokenID:     token.TokenID,
+		Amount:      amount.String(),
+		Fee:         fee,
+	}
+	if req.Exit {
+		intent.Type = hezCommon.TxTypeExit
+	}
+	p, err := s.cfg.Approvals.Propose(intent, apiProposer)
+	if err != nil {
+		return Withdrawal{}, &RequestError{err}
+	}
+	return Withdrawal{Type: p.Intent.Type, ProposalID: p.ID}, nil
+}
+
+// token looks up the withdrawal token into the token registry, by
+// symbol, token id or ERC20 address, or by symbol into the node tokens
+// without a registry. An unknown token returns a *RequestError
+func (s *Server) token(token string) (hezCommon.Token, error) {
+	if s.cfg.Tokens != nil {
+		t, err := s.cfg.Tokens.Lookup(token)
+		if err != nil {
+			return hezCommon.Token{}, &RequestError{err}
+		}
+		return t, nil
+	}
+	tokens, err := s.client.GetTokens()
+	if err != nil {
+		return hezCommon.Token{}, err
+	}
+	t, err := tokens.Tokens.GetToken(token)
+	if err != nil {
+		return hezCommon.Token{}, &RequestError{err}
+	}
+	return t, nil
+}
+
+// send signs and sends a withdrawal tx from the hot wallet
+func (s *Server) send(ctx context.Context, exit bool, to hermez.Recipient, amount *big.Int,
+	fee hezCommon.FeeSelector, token hezCommon.Token) (Withdrawal, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	hot := s.cfg.HotWallet
+	fromIdx, nonce, err := transaction.GetAccountInfo(s.client, &hot.HezBjjAddress, nil, token.TokenID)
+	if err != nil {
+		return Withdrawal{}, err
+	}
+	if nonce, err = s.nextNonce(fromIdx, nonce); err != nil {
+		return Withdrawal{}, err
+	}
+
+	var (
+		txID   string
+		txType = to.Type
+	)
+	switch {
+	case exit:
+		txType = hezCommon.TxTypeExit
+		txID, err = transaction.Exit(ctx, hot, s.client, s.cfg.ChainID, fromIdx, amount, fee, token, nonce)
+	case to.Type == hezCommon.TxTypeTransfer:
+		txID, err = transaction.Transfer(ctx, hot, s.client, s.cfg.ChainID, fromIdx, to.Idx, amount, fee, token, nonce)
+	case to.Type == hezCommon.TxTypeTransferToEthAddr:
+		txID, err = transaction.TransferToEthAddress(ctx, hot, s.client, s.cfg.ChainID, fromIdx, to.EthAddr, amount, fee, token, nonce)
+	case to.Type == hezCommon.TxTypeTransferToBJJ:
+		txID, err = transaction.TransferToBjj(ctx, hot, s.client, s.cfg.ChainID, fromIdx, to.BJJ, amount, fee, token, nonce)
+	default:
+		err = errors.E("tx type not supported", errors.Params{"type": to.Type})
+	}
+	withdrawal := Withdrawal{TxID: txID, Type: txType, Nonce: nonce}
+	if err != nil {
+		return withdrawal, err
+	}
+	if s.sent[fromIdx] == nil {
+		s.sent[fromIdx] = make(map[hezCommon.Nonce]string)
+	}
+	s.sent[fromIdx][nonce] = txID
+	return withdrawal, nil
+}
+
+// nextNonce returns the next nonce of the hot wallet account from the
+// account nonce. The account nonce doesn't count the txs into the pool,
+// so the nonces of the txs sent still into the pool are skipped. The
+// forged txs are forgotten and the first tx invalid or not found frees
+// its nonce and the next ones. A lookup error returns a *NodeError since
+// the nonce of a tx still into the pool can't be reused. The caller must
+// hold the send lock
+func (s *Server) nextNonce(fromIdx hezCommon.Idx, nonce hezCommon.Nonce) (hezCommon.Nonce, error) {
+	sent := s.sent[fromIdx]
+	next := nonce
+	for {
+		txID, ok := sent[next]
+		if !ok {
+			break
+		}
+		known, err := transaction.KnownTx(s.client, txID)
+		if err != nil {
+			return 0, &NodeError{errors.E("cannot check the pending txs", err,
+				errors.Params{"idx": fromIdx, "nonce": next, "tx_id": txID})}
+		}
+		if !known {
+			break
+		}
+		next++
+	}
+	for n := range sent {
+		if n < nonce || n >= next {
+			delete(sent, n)
+		}
+	}
+	if next != nonce {
+		logger.Info("Pool nonces skipped", logger.Params{"idx": fromIdx, "nonce": nonce, "next": next})
+	}
+	return next, nil
+}
+
+// handleProposals serves the withdrawal proposals, the oldest first
+// (/v1/proposals)
+func (s *Server) handleProposals(w http.ResponseWriter, _ *http.Request, _ string) {
+	writeJSON(w, http.StatusOK, s.cfg.Approvals.Proposals())
+}
+
+// handleProposalAction approves or rejects a proposal with an approver
+// signature (/v1/proposals/{id}/approve or reject) or executes an
+// approved proposal (/v1/proposals/{id}/execute)
+func (s *Server) handleProposalAction(w http.ResponseWriter, r *http.Request, operator string) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/proposals/"), "/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, errors.E("not found"))
+		return
+	}
+	id := parts[0]
+	if _, ok := s.cfg.Approvals.Get(id); !ok {
+		writeError(w, http.StatusNotFound, errors.E("proposal not found", errors.Params{"proposal_id": id}))
+		return
+	}
+	if parts[1] == "execute" {
+		p, err := s.ExecuteProposal(r.Context(), id, operator)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+		return
+	}
+
+	var decision ProposalDecision
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&decision); err != nil {
+		writeError(w, http.StatusBadRequest, errors.E("invalid proposal decision", err))
+		return
+	}
+	var (
+		p   approval.Proposal
+		err error
+	)
+	switch parts[1] {
+	case "approve":
+		p, err = s.cfg.Approvals.Approve(id, decision.Signature)
+	case "reject":
+		p, err = s.cfg.Approvals.Reject(id, decision.Signature)
+	default:
+		writeError(w, http.StatusNotFound, errors.E("not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// ExecuteProposal signs and sends the withdrawal of an approved proposal
+// from the hot wallet. A failed execution can be executed again
+func (s *Server) ExecuteProposal(ctx context.Context, id, executor string) (approval.Proposal, error) {
+	if s.cfg.Approvals == nil {
+		return approval.Proposal{}, &RequestError{errors.E("approvals not enabled")}
+	}
+	return s.cfg.Approvals.Execute(ctx, id, executor, proposalSender{s: s})
+}
+
+// Send signs and sends the proposal intent from the hot wallet
+func (p proposalSender) Send(ctx context.Context, intent approval.Intent) (string, error) {
+	s := p.s
+	if intent.ChainID != s.cfg.ChainID || intent.WalletIndex != s.cfg.HotWallet.Index {
+		return "", errors.E("proposal not sent from the hot wallet", errors.Params{
+			"chain_id": intent.ChainID, "wallet_index": intent.WalletIndex})
+	}
+	amount, ok := new(big.Int).SetString(intent.Amount, 10)
+	if !ok {
+		return "", errors.E("invalid amount", errors.Params{"amount": intent.Amount})
+	}
+	token, err := s.tokenByID(intent.TokenID)
+	if err != nil {
+		return "", err
+	}
+	var to hermez.Recipient
+	exit := intent.Type == hezCommon.TxTypeExit
+	if !exit {
+		if to, err = hermez.ParseRecipient(intent.Recipient); err != nil {
+			return "", err
+		}
+	}
+	withdrawal, err := s.send(ctx, exit, to, amount, intent.Fee, token)
+	return withdrawal.TxID, err
+}
+
+// Known returns if the tx was received by the node and not invalid
+func (p proposalSender) Known(txID string) (bool, error) {
+	return transaction.KnownTx(p.s.client, txID)
+}
+
+// tokenByID looks up the token by id into the token registry, or into
+// the node tokens without a registry
+func (s *Server) tokenByID(tokenID hezCommon.TokenID) (hezCommon.Token, error) {
+	if s.cfg.Tokens != nil {
+		return s.cfg.Tokens.ByID(tokenID)
+	}
+	tokens, err := s.client.GetTokens()
+	if err != nil {
+		return hezCommon.Token{}, err
+	}
+	return tokens.Tokens.GetTokenByID(tokenID)
+}
+
+// handlePolicyApprovals serves the withdrawals waiting for an operator
+// approval (/v1/policy/approvals)
+func (s *Server) handlePolicyApprovals(w http.ResponseWriter, _ *http.Request, _ string) {
+	writeJSON(w, http.StatusOK, s.cfg.Policy.Pending())
+}
+
+// handlePolicyDecision approves or rejects a withdrawal waiting for an
+// operator approval (/v1/policy/approvals/{id}/approve or reject). An
+// approved withdrawal is sent by calling the withdrawal again
+func (s *Server) handlePolicyDecision(w http.ResponseWriter, r *http.Request, operator string) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/policy/approvals/"), "/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		writeError(w, http.StatusNotFound, errors.E("not found"))
+		return
+	}
+	id := parts[0]
+	if _, ok := s.cfg.Policy.Approval(id); !ok {
+		writeError(w, http.StatusNotFound, errors.E("approval not found", errors.Params{"approval_id": id}))
+		return
+	}
+	var err error
+	switch parts[1] {
+	case "approve":
+		err = s.cfg.Policy.Approve(id, operator)
+	case "reject":
+		err = s.cfg.Policy.Reject(id, operator)
+	default:
+		writeError(w, http.StatusNotFound, errors.E("not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	approval, _ := s.cfg.Policy.Approval(id)
+	writeJSON(w, http.StatusOK, approval)
+}
+
+// handleTxStatus serves the tx status (/v1/txs/{txId})
+func (s *Server) handleTxStatus(w http.ResponseWriter, r *http.Request) {
+	txID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/txs/"), "/")
+	if _, err := hezCommon.NewTxIDFromString(txID); err != nil {
+		writeError(w, http.StatusBadRequest, errors.E("invalid tx id", err, errors.Params{"tx_id": txID}))
+		return
+	}
+	poolTx, err := s.client.GetPoolTx(txID)
+	if err == nil && poolTx != nil && poolTx.TxID.String() == txID {
+		status := TxStatus{TxID: txID, State: TxStatePending, PoolState: poolTx.State, BatchNum: poolTx.BatchNum}
+		switch poolTx.State {
+		case hezCommon.PoolL2TxStateForged:
+			status.State = TxStateForged
+		case hezCommon.PoolL2TxStateInvalid:
+			status.State = TxStateInvalid
+		}
+		writeJSON(w, http.StatusOK, status)
+		return
+	}
+	tx, err := s.client.GetTx(txID)
+	if err == nil && tx != nil && tx.TxID.String() == txID {
+		writeJSON(w, http.StatusOK, TxStatus{TxID: txID, State: TxStateForged, BatchNum: tx.BatchNum})
+		return
+	}
+	writeError(w, http.StatusNotFound, errors.E("tx not found", errors.Params{"tx_id": txID}))
+}
+
+// handleDeposits serves the deposits found since the cursor
+// (/v1/deposits?cursor=0&limit=100)
+func (s *Server) handleDeposits(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cursor := uint64(0)
+	if v := query.Get("cursor"); v != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, errors.E("invalid cursor", errors.Params{"cursor": v}))
+			return
+		}
+	}
+	limit := defaultDepositsLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxDepositsLimit {
+			writeError(w, http.StatusBadRequest, errors.E("invalid limit", errors.Params{"limit": v}))
+			return
+		}
+		limit = n
+	}
+
+	deposits := s.feed.DepositsSince(cursor, limit)
+	next := cursor
+	if len(deposits) > 0 {
+		next = deposits[len(deposits)-1].Cursor
+	}
+	writeJSON(w, http.StatusOK, Deposits{Deposits: deposits, Cursor: next})
+}
+
+// Address derives the deposit address of the user wallet index
+func (s *Server) Address(ctx context.Context, index int) (Address, error) {
+	if index < 0 || index > math.MaxInt32 {
+		return Address{}, &RequestError{errors.E("invalid wallet index", errors.Params{"index": index})}
+	}
+	wallet, err := s.wallet(ctx, index)
+	if err != nil {
+		return Address{}, err
+	}
+	if s.cfg.Watch != nil {
+		if err := s.cfg.Watch.Add(wallet.HezEthAddress, wallet.HezBjjAddress); err != nil {
+			return Address{}, err
+		}
+	}
+	return newAddress(index, wallet), nil
+}
+
+// newAddress returns the deposit address of a user wallet
+func newAddress(index int, wallet *hermez.Wallet) Address {
+	return Address{Index: index, HezEthAddress: wallet.HezEthAddress, HezBjjAddress: wallet.HezBjjAddress}
+}
+
+// wallet returns the user wallet of the index, the wallets are derived
+// once and cached
+func (s *Server) wallet(ctx context.Context, index int) (*hermez.Wallet, error) {
+	s.walletsMu.Lock()
+	defer s.walletsMu.Unlock()
+	if w, ok := s.wallets[index]; ok {
+		return w, nil
+	}
+	w, err := hermez.NewBJJ(ctx, s.cfg.Mnemonic, index, s.cfg.ChainID, s.cfg.RollupContract)
+	if err != nil {
+		return nil, err
+	}
+	s.wallets[index] = w
+	return w, nil
+}
+
+// Error returns the request error message
+func (e *RequestError) Error() string {
+	return e.err.Error()
+}
+
+// Error returns the node error message
+func (e *NodeError) Error() string {
+	return e.err.Error()
+}
+
+// writeJSON writes the response as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error(errors.E("cannot write the API response", err))
+	}
+}
+
+// writeError writes an error response. The errors already encoded as
+// JSON, with the error message and meta, are written as they are
+func writeError(w http.ResponseWriter, status int, err error) {
+	msg := err.Error()
+	if json.Valid([]byte(msg)) {
+		writeJSON(w, status, json.RawMessage(msg))
+		return
+	}
+	writeJSON(w, status, errorResponse{Error: msg})
+}
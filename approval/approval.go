@@ -0,0 +1,609 @@
+package approval
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/ethereum/go-ethereum/accounts"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethCrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/hermez"
+	"github.com/hermeznetwork/hermez-integration/policy"
+	"github.com/hermeznetwork/hermez-integration/transaction"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// StatusPending represents a proposal waiting for approvals
+	StatusPending Status = "pending"
+	// StatusApproved represents a proposal with enough approvals, ready
+	// to be signed and sent
+	StatusApproved Status = "approved"
+	// StatusRejected represents a proposal rejected by an approver
+	StatusRejected Status = "rejected"
+	// StatusExecuted represents a proposal signed and sent to the pool
+	StatusExecuted Status = "executed"
+
+	// ActionCreated represents the proposal creation event
+	ActionCreated Action = "created"
+	// ActionApproved represents an approval event
+	ActionApproved Action = "approved"
+	// ActionRejected represents a rejection event
+	ActionRejected Action = "rejected"
+	// ActionExecuted represents the tx sent event
+	ActionExecuted Action = "executed"
+	// ActionFailed represents the tx failed event, the proposal stays
+	// approved to be executed again
+	ActionFailed Action = "failed"
+
+	// approveMsg and rejectMsg prefix the message signed by the approvers
+	approveMsg = "Hermez integration approve proposal:\n"
+	rejectMsg  = "Hermez integration reject proposal:\n"
+)
+
+type (
+	// Store represents the M-of-N approval store of the outgoing txs. A tx
+	// intent is proposed, signed by the approvers with their Ethereum
+	// keys, and only signed and sent once approved. The proposals and
+	// their history are persisted as a JSON file. Set as the transaction
+	// approval gate, the txs above the limits are only signed by executing
+	// a proposal
+	Store struct {
+		mu        sync.Mutex
+		path      string
+		approvers map[ethCommon.Address]bool
+		threshold int
+		limits    map[hezCommon.TokenID]*big.Int
+		proposals map[string]*Proposal
+		// executing are the proposals being executed, true once its tx
+		// passed the approval gate
+		executing map[string]bool
+	}
+
+	// Config represents the approvers set (N), the approvals threshold (M)
+	// and the amounts requiring a proposal
+	Config struct {
+		Approvers []ethCommon.Address
+		Threshold int
+		// Limits are the amounts by token, in the token base unit, above
+		// which an outgoing tx needs an executed proposal. The txs of a
+		// token without limit don't need proposals
+		Limits map[hezCommon.TokenID]*big.Int
+	}
+
+	// Sender represents the wallet signing and sending the proposal txs
+	Sender interface {
+		// Send signs and sends the intent tx, it returns the tx id also on
+		// error once the tx is signed
+		Send(ctx context.Context, intent Intent) (string, error)
+		// Known returns if the tx was received by the node and not
+		// invalid, a lookup error means the tx state is unknown
+		Known(txID string) (bool, error)
+	}
+
+	// Client represents the node client needed to send a proposal
+	Client interface {
+		client.AccountReader
+		client.TxSubmitter
+		client.PoolReader
+		client.BatchReader
+	}
+
+	// WalletSender sends the proposal txs from a wallet account of the
+	// token, reading the nonce from the node
+	WalletSender struct {
+		Wallet *hermez.Wallet
+		Client Client
+		Token  hezCommon.Token
+	}
+
+	// Proposal represents an outgoing tx intent and its approvals
+	Proposal struct {
+		ID        string      `json:"id"`
+		Intent    Intent      `json:"intent"`
+		Status    Status      `json:"status"`
+		Proposer  string      `json:"proposer"`
+		CreatedAt time.Time   `json:"createdAt"`
+		Approvals []Signature `json:"approvals"`
+		TxID      string      `json:"txId,omitempty"`
+		History   []Event     `json:"history"`
+	}
+
+	// Intent represents the outgoing tx to be signed once approved
+	Intent struct {
+		ChainID     uint16           `json:"chainId"`
+		WalletIndex int              `json:"walletIndex"`
+		Type        hezCommon.TxType `json:"type"`
+		// Recipient is the idx, hez eth address or hez BJJ address, empty
+		// for the exits
+		Recipient string                `json:"recipient,omitempty"`
+		TokenID   hezCommon.TokenID     `json:"tokenId"`
+		Amount    string                `json:"amount"`
+		Fee       hezCommon.FeeSelector `json:"fee"`
+	}
+
+	// Signature represents an approver signature of a proposal
+	Signature struct {
+		Approver  ethCommon.Address `json:"approver"`
+		Signature string            `json:"signature"`
+		SignedAt  time.Time         `json:"signedAt"`
+	}
+
+	// Event represents a proposal history event
+	Event struct {
+		Action Action    `json:"action"`
+		Actor  string    `json:"actor"`
+		Time   time.Time `json:"time"`
+		Detail string    `json:"detail,omitempty"`
+	}
+
+	// Status represents the proposal status
+	Status string
+
+	// Action represents a proposal history action
+	Action string
+)
+
+// Open creates the approval store and loads the proposals from the file
+// path. A missing file starts an empty store. An empty path keeps the
+// proposals in memory
+func Open(path string, cfg Config) (*Store, error) {
+	if len(cfg.Approvers) == 0 {
+		return nil, errors.E("approvers not defined")
+	}
+	s := &Store{
+		path:      path,
+		approvers: make(map[ethCommon.Address]bool),
+		threshold: cfg.Threshold,
+		limits:    cfg.Limits,
+		proposals: make(map[string]*Proposal),
+		executing: make(map[string]bool),
+	}
+	for _, a := range cfg.Approvers {
+		s.approvers[a] = true
+	}
+	if cfg.Threshold <= 0 || cfg.Threshold > len(s.approvers) {
+		return nil, errors.E("invalid approvals threshold",
+			errors.Params{"threshold": cfg.Threshold, "approvers": len(s.approvers)})
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.E("cannot read the proposals", err, errors.Params{"path": path})
+	}
+	proposals := make([]*Proposal, 0)
+	if err := json.Unmarshal(data, &proposals); err != nil {
+		return nil, errors.E("invalid proposals file", err, errors.Params{"path": path})
+	}
+	for _, p := range proposals {
+		s.proposals[p.ID] = p
+	}
+	return s, nil
+}
+
+// Propose creates a proposal for the tx intent
+func (s *Store) Propose(intent Intent, proposer string) (Proposal, error) {
+	intent, err := intent.normalize()
+	if err != nil {
+		return Proposal{}, err
+	}
+	now := time.Now().UTC()
+	b, err := json.Marshal(intent)
+	if err != nil {
+		return Proposal{}, err
+	}
+	sum := sha256.Sum256(append(b, []byte(now.Format(time.RFC3339Nano))...))
+	p := &Proposal{
+		ID:        hex.EncodeToString(sum[:8]),
+		Intent:    intent,
+		Status:    StatusPending,
+		Proposer:  proposer,
+		CreatedAt: now,
+		Approvals: make([]Signature, 0),
+		History:   []Event{{Action: ActionCreated, Actor: proposer, Time: now}},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proposals[p.ID] = p
+	if err := s.save(); err != nil {
+		return Proposal{}, err
+	}
+	logger.Info("Proposal created", logger.Params{"proposal_id": p.ID, "proposer": proposer,
+		"recipient": intent.Recipient, "amount": intent.Amount})
+	return *p, nil
+}
+
+// Approve adds an approver signature of the proposal approval message.
+// The proposal is approved once the threshold is reached
+func (s *Store) Approve(id string, signature string) (Proposal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, err := s.pending(id)
+	if err != nil {
+		return Proposal{}, err
+	}
+	approver, err := s.recover(p.ApproveHash(), signature)
+	if err != nil {
+		return Proposal{}, err
+	}
+	for _, a := range p.Approvals {
+		if a.Approver == approver {
+			return Proposal{}, errors.E("proposal already approved by the approver",
+				errors.Params{"proposal_id": id, "approver": approver.String()})
+		}
+	}
+
+	now := time.Now().UTC()
+	p.Approvals = append(p.Approvals, Signature{Approver: approver, Signature: signature, SignedAt: now})
+	p.History = append(p.History, Event{Action: ActionApproved, Actor: approver.String(), Time: now})
+	if len(p.Approvals) >= s.threshold {
+		p.Status = StatusApproved
+	}
+	if err := s.save(); err != nil {
+		return Proposal{}, err
+	}
+	logger.Info("Proposal approved", logger.Params{"proposal_id": id, "approver": approver.String(),
+		"approvals": len(p.Approvals), "threshold": s.threshold})
+	return *p, nil
+}
+
+// Reject rejects the proposal with an approver signature of the proposal
+// rejection message
+func (s *Store) Reject(id string, signature string) (Proposal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, err := s.pending(id)
+	if err != nil {
+		return Proposal{}, err
+	}
+	approver, err := s.recover(p.RejectHash(), signature)
+	if err != nil {
+		return Proposal{}, err
+	}
+	p.Status = StatusRejected
+	p.History = append(p.History, Event{Action: ActionRejected, Actor: approver.String(), Time: time.Now().UTC()})
+	if err := s.save(); err != nil {
+		return Proposal{}, err
+	}
+	logger.Info("Proposal rejected", logger.Params{"proposal_id": id, "approver": approver.String()})
+	return *p, nil
+}
+
+// Execute signs and sends the tx of an approved proposal with the
+// sender, the proposal id is carried into the context to pass the
+// approval gate. The proposal is claimed while executed and the store is
+// not locked while sending. A failed execution keeps the proposal
+// approved to be executed again, the tx of the previous attempt is looked
+// up into the node first so it is not sent twice and is only sent again if
+// the node confirms it is absent or invalid
+func (s *Store) Execute(ctx context.Context, id, executor string, sender Sender) (Proposal, error) {
+	p, err := s.claim(id)
+	if err != nil {
+		return Proposal{}, err
+	}
+	defer s.unclaim(id)
+
+	txID := p.TxID
+	send := txID == ""
+	var sendErr error
+	if !send {
+		known, err := sender.Known(txID)
+		if err != nil {
+			sendErr = errors.E("cannot check the proposal tx", err, errors.Params{"proposal_id": id, "tx_id": txID})
+		}
+		send = err == nil && !known
+	}
+	if send {
+		txID, sendErr = sender.Send(transaction.WithProposal(ctx, id), p.Intent)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.proposals[id]
+	now := time.Now().UTC()
+	if txID != "" {
+		stored.TxID = txID
+	}
+	if sendErr != nil {
+		stored.History = append(stored.History, Event{Action: ActionFailed, Actor: executor, Time: now,
+			Detail: sendErr.Error()})
+	} else {
+		stored.Status = StatusExecuted
+		stored.History = append(stored.History, Event{Action: ActionExecuted, Actor: executor, Time: now, Detail: txID})
+	}
+	if saveErr := s.save(); saveErr != nil {
+		logger.Error(saveErr)
+	}
+	if sendErr != nil {
+		return *stored, sendErr
+	}
+	logger.Info("Proposal executed", logger.Params{"proposal_id": id, "tx_id": txID, "executor": executor})
+	return *stored, nil
+}
+
+// Required returns if the amount of the token needs an executed proposal
+func (s *Store) Required(tokenID hezCommon.TokenID, amount *big.Int) bool {
+	limit, ok := s.limits[tokenID]
+	return ok && limit != nil && amount != nil && amount.Cmp(limit) > 0
+}
+
+// Check checks the proposal is being executed and its intent matches the
+// tx intent, so the tx can be signed. A proposal authorizes one tx per
+// execution
+func (s *Store) Check(id string, intent policy.Intent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checked, ok := s.executing[id]
+	if !ok {
+		return errors.E("proposal not being executed", errors.Params{"proposal_id": id})
+	}
+	if checked {
+		return errors.E("proposal tx already authorized", errors.Params{"proposal_id": id})
+	}
+	if !s.proposals[id].Intent.matches(intent) {
+		return errors.E("tx does not match the proposal", errors.Params{"proposal_id": id,
+			"destination": intent.Destination, "amount": intent.Amount.String()})
+	}
+	s.executing[id] = true
+	return nil
+}
+
+// Get returns a proposal
+func (s *Store) Get(id string) (Proposal, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.proposals[id]
+	if !ok {
+		return Proposal{}, false
+	}
+	return *p, true
+}
+
+// Proposals returns all proposals, the oldest first
+func (s *Store) Proposals() []Proposal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	proposals := make([]Proposal, 0, len(s.proposals))
+	for _, p := range s.proposals {
+		proposals = append(proposals, *p)
+	}
+	sort.Slice(proposals, func(i, j int) bool {
+		return proposals[i].CreatedAt.Before(proposals[j].CreatedAt)
+	})
+	return proposals
+}
+
+// claim verifies the approvals of an approved proposal and marks it as
+// being executed
+func (s *Store) claim(id string) (Proposal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.proposals[id]
+	if !ok {
+		return Proposal{}, errors.E("proposal not found", errors.Params{"proposal_id": id})
+	}
+	if p.Status != StatusApproved {
+		return Proposal{}, errors.E("proposal not approved", errors.Params{"proposal_id": id, "status": p.Status})
+	}
+	if _, ok := s.executing[id]; ok {
+		return Proposal{}, errors.E("proposal already being executed", errors.Params{"proposal_id": id})
+	}
+	// verify the approvals again, the file could be edited
+	approvers := make(map[ethCommon.Address]bool)
+	for _, a := range p.Approvals {
+		approver, err := s.recover(p.ApproveHash(), a.Signature)
+		if err != nil || approver != a.Approver {
+			return Proposal{}, errors.E("invalid proposal approval", err,
+				errors.Params{"proposal_id": id, "approver": a.Approver.String()})
+		}
+		approvers[approver] = true
+	}
+	if len(approvers) < s.threshold {
+		return Proposal{}, errors.E("not enough approvals",
+			errors.Params{"proposal_id": id, "approvals": len(approvers), "threshold": s.threshold})
+	}
+	s.executing[id] = false
+	return *p, nil
+}
+
+// unclaim ends the proposal execution
+func (s *Store) unclaim(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.executing, id)
+}
+
+// pending returns a pending proposal, the caller must hold the lock
+func (s *Store) pending(id string) (*Proposal, error) {
+	p, ok := s.proposals[id]
+	if !ok {
+		return nil, errors.E("proposal not found", errors.Params{"proposal_id": id})
+	}
+	if p.Status != StatusPending {
+		return nil, errors.E("proposal not pending", errors.Params{"proposal_id": id, "status": p.Status})
+	}
+	return p, nil
+}
+
+// recover returns the approver address of the message hash signature
+func (s *Store) recover(hash []byte, signature string) (ethCommon.Address, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil || len(sig) != ethCrypto.SignatureLength {
+		return ethCommon.Address{}, errors.E("invalid signature", err)
+	}
+	// accept the [27, 28] recovery id of the wallets
+	if sig[ethCrypto.RecoveryIDOffset] >= 27 {
+		sig[ethCrypto.RecoveryIDOffset] -= 27
+	}
+	pk, err := ethCrypto.SigToPub(hash, sig)
+	if err != nil {
+		return ethCommon.Address{}, errors.E("invalid signature", err)
+	}
+	approver := ethCrypto.PubkeyToAddress(*pk)
+	if !s.approvers[approver] {
+		return ethCommon.Address{}, errors.E("signer is not an approver", errors.Params{"signer": approver.String()})
+	}
+	return approver, nil
+}
+
+// save writes the proposals into a temporary file and renames it, so a
+// crash never leaves a partial file. The caller must hold the lock
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	proposals := make([]*Proposal, 0, len(s.proposals))
+	for _, p := range s.proposals {
+		proposals = append(proposals, p)
+	}
+	sort.Slice(proposals, func(i, j int) bool {
+		return proposals[i].CreatedAt.Before(proposals[j].CreatedAt)
+	})
+	data, err := json.MarshalIndent(proposals, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.E("cannot write the proposals", err, errors.Params{"path": tmp})
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Message returns the proposal message signed by the approvers, binding
+// the proposal id and the intent
+func (p Proposal) Message() []byte {
+	b, _ := json.Marshal(p.Intent)
+	return []byte("id: " + p.ID + "\nintent: " + string(b))
+}
+
+// ApproveHash returns the EIP-191 hash of the approval message
+func (p Proposal) ApproveHash() []byte {
+	return accounts.TextHash(append([]byte(approveMsg), p.Message()...))
+}
+
+// RejectHash returns the EIP-191 hash of the rejection message
+func (p Proposal) RejectHash() []byte {
+	return accounts.TextHash(append([]byte(rejectMsg), p.Message()...))
+}
+
+// SignApproval signs the proposal approval with an approver key
+func SignApproval(p Proposal, key *ecdsa.PrivateKey) (string, error) {
+	return sign(p.ApproveHash(), key)
+}
+
+// SignRejection signs the proposal rejection with an approver key
+func SignRejection(p Proposal, key *ecdsa.PrivateKey) (string, error) {
+	return sign(p.RejectHash(), key)
+}
+
+// sign signs the hash with the wallets [27, 28] recovery id
+func sign(hash []byte, key *ecdsa.PrivateKey) (string, error) {
+	sig, err := ethCrypto.Sign(hash, key)
+	if err != nil {
+		return "", err
+	}
+	sig[ethCrypto.RecoveryIDOffset] += 27
+	return hexutil.Encode(sig), nil
+}
+
+// Send fetches the wallet account and signs and sends the intent tx. The
+// wallet and the token must match the intent
+func (w WalletSender) Send(ctx context.Context, intent Intent) (string, error) {
+	if w.Wallet.Index != intent.WalletIndex || w.Token.TokenID != intent.TokenID {
+		return "", errors.E("wallet or token mismatch", errors.Params{
+			"wallet_index": w.Wallet.Index, "token_id": w.Token.TokenID})
+	}
+	amount, _ := new(big.Int).SetString(intent.Amount, 10)
+	fromIdx, nonce, err := transaction.GetAccountInfo(w.Client, &w.Wallet.HezBjjAddress, nil, w.Token.TokenID)
+	if err != nil {
+		return "", err
+	}
+	if intent.Type == hezCommon.TxTypeExit {
+		return transaction.Exit(ctx, w.Wallet, w.Client, intent.ChainID, fromIdx, amount, intent.Fee, w.Token, nonce)
+	}
+	to, err := hermez.ParseRecipient(intent.Recipient)
+	if err != nil {
+		return "", err
+	}
+	switch to.Type {
+	case hezCommon.TxTypeTransfer:
+		return transaction.Transfer(ctx, w.Wallet, w.Client, intent.ChainID, fromIdx, to.Idx, amount,
+			intent.Fee, w.Token, nonce)
+	case hezCommon.TxTypeTransferToEthAddr:
+		return transaction.TransferToEthAddress(ctx, w.Wallet, w.Client, intent.ChainID, fromIdx, to.EthAddr, amount,
+			intent.Fee, w.Token, nonce)
+	case hezCommon.TxTypeTransferToBJJ:
+		return transaction.TransferToBjj(ctx, w.Wallet, w.Client, intent.ChainID, fromIdx, to.BJJ, amount,
+			intent.Fee, w.Token, nonce)
+	default:
+		return "", errors.E("tx type not supported", errors.Params{"type": to.Type})
+	}
+}
+
+// Known returns if the tx was received by the node and not invalid
+func (w WalletSender) Known(txID string) (bool, error) {
+	return transaction.KnownTx(w.Client, txID)
+}
+
+// matches returns if the tx intent is the proposal intent
+func (i Intent) matches(intent policy.Intent) bool {
+	if i.WalletIndex != intent.WalletIndex || i.TokenID != intent.TokenID || i.Type != intent.Type ||
+		intent.Amount == nil || i.Amount != intent.Amount.String() {
+		return false
+	}
+	if i.Type == hezCommon.TxTypeExit {
+		return intent.Destination == policy.DestinationExit
+	}
+	dest, err := policy.ParseDestination(i.Recipient)
+	return err == nil && dest == intent.Destination
+}
+
+// normalize checks the intent fields, formats the amount and sets the tx
+// type from the recipient
+func (i Intent) normalize() (Intent, error) {
+	amount, ok := new(big.Int).SetString(i.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return i, errors.E("invalid intent amount", errors.Params{"amount": i.Amount})
+	}
+	i.Amount = amount.String()
+	if i.WalletIndex < 0 {
+		return i, errors.E("invalid wallet index", errors.Params{"wallet_index": i.WalletIndex})
+	}
+	if i.Type == hezCommon.TxTypeExit {
+		if i.Recipient != "" {
+			return i, errors.E("exit intent with recipient", errors.Params{"recipient": i.Recipient})
+		}
+		return i, nil
+	}
+	to, err := hermez.ParseRecipient(i.Recipient)
+	if err != nil {
+		return i, err
+	}
+	if i.Type != "" && i.Type != to.Type {
+		return i, errors.E("intent type mismatch", errors.Params{"type": i.Type,
+			"recipient_type": to.Type, "recipient": i.Recipient})
+	}
+	i.Type = to.Type
+	return i, nil
+}
@@ -0,0 +1,209 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+)
+
+const (
+	// OperationAccountAuth represents an account creation authorization
+	// signature
+	OperationAccountAuth Operation = "account_creation_auth"
+	// OperationL2Tx represents a L2 tx signature
+	OperationL2Tx Operation = "l2_tx"
+
+	// GenesisHash is the previous hash of the first record
+	GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+type (
+	// Log represents an append-only audit log of the signatures. Each
+	// record is chained to the previous one by its hash, so a removed or
+	// edited record breaks the chain
+	Log struct {
+		mu       sync.Mutex
+		file     *os.File
+		operator string
+		seq      uint64
+		lastHash string
+	}
+
+	// Record represents a signing operation
+	Record struct {
+		Seq       uint64    `json:"seq"`
+		Timestamp time.Time `json:"timestamp"`
+		// Operator is the user running the signing process
+		Operator string `json:"operator"`
+		// Signer is the hez address of the signing key
+		Signer     string    `json:"signer"`
+		Operation  Operation `json:"operation"`
+		ChainID    uint16    `json:"chainId"`
+		HashToSign string    `json:"hashToSign"`
+		TxID       string    `json:"txId,omitempty"`
+		TxType     string    `json:"txType,omitempty"`
+		FromIdx    string    `json:"fromIdx,omitempty"`
+		TokenID    *uint32   `json:"tokenId,omitempty"`
+		Amount     string    `json:"amount,omitempty"`
+		Fee        *uint8    `json:"fee,omitempty"`
+		Nonce      *uint64   `json:"nonce,omitempty"`
+		Recipient  string    `json:"recipient,omitempty"`
+		PrevHash   string    `json:"prevHash"`
+		Hash       string    `json:"hash"`
+	}
+
+	// Operation represents the signing operation kind
+	Operation string
+)
+
+// Open opens the audit log file, verifying the existing records chain. An
+// empty operator uses the current OS user
+func Open(path, operator string) (*Log, error) {
+	if path == "" {
+		return nil, errors.E("audit log path not defined")
+	}
+	if operator == "" {
+		operator = currentUser()
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.E("cannot open the audit log", err, errors.Params{"path": path})
+	}
+	last, err := VerifyReader(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.E("audit log verification failed", err, errors.Params{"path": path})
+	}
+	l := &Log{file: f, operator: operator, lastHash: GenesisHash}
+	if last != nil {
+		l.seq = last.Seq
+		l.lastHash = last.Hash
+	}
+	return l, nil
+}
+
+// Close closes the audit log file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Append chains and writes a record, the file is synced before return.
+// The sequence, timestamp, operator and hashes are set by the log
+func (l *Log) Append(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Seq = l.seq + 1
+	r.Timestamp = time.Now().UTC()
+	r.Operator = l.operator
+	r.PrevHash = l.lastHash
+	hash, err := r.ComputeHash()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.E("cannot encode the audit record", err)
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return errors.E("cannot write the audit record", err, errors.Params{"seq": r.Seq})
+	}
+	if err := l.file.Sync(); err != nil {
+		return errors.E("cannot sync the audit log", err, errors.Params{"seq": r.Seq})
+	}
+	l.seq = r.Seq
+	l.lastHash = r.Hash
+	return nil
+}
+
+// ComputeHash returns the SHA-256 of the record encoded without its hash
+func (r Record) ComputeHash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", errors.E("cannot encode the audit record", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify verifies the audit log file chain. It returns the last record, or
+// nil for an empty log
+func Verify(path string) (*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.E("cannot open the audit log", err, errors.Params{"path": path})
+	}
+	defer f.Close()
+	return VerifyReader(f)
+}
+
+// VerifyReader verifies the records chain, detecting sequence gaps,
+// broken links and edited records. It returns the last record, or nil for
+// an empty log
+func VerifyReader(r io.Reader) (*Record, error) {
+	var (
+		last     *Record
+		prevHash = GenesisHash
+		line     = 0
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line++
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return last, errors.E("invalid audit record", err, errors.Params{"line": line})
+		}
+		expectedSeq := uint64(1)
+		if last != nil {
+			expectedSeq = last.Seq + 1
+		}
+		if rec.Seq != expectedSeq {
+			return last, errors.E("audit log gap",
+				errors.Params{"line": line, "seq": rec.Seq, "expected_seq": expectedSeq})
+		}
+		if rec.PrevHash != prevHash {
+			return last, errors.E("audit log chain broken",
+				errors.Params{"line": line, "seq": rec.Seq, "prev_hash": rec.PrevHash, "expected_prev_hash": prevHash})
+		}
+		hash, err := rec.ComputeHash()
+		if err != nil {
+			return last, err
+		}
+		if rec.Hash != hash {
+			return last, errors.E("audit record edited",
+				errors.Params{"line": line, "seq": rec.Seq, "hash": rec.Hash, "expected_hash": hash})
+		}
+		prevHash = rec.Hash
+		last = &rec
+	}
+	if err := scanner.Err(); err != nil {
+		return last, errors.E("cannot read the audit log", err, errors.Params{"line": line})
+	}
+	return last, nil
+}
+
+// currentUser returns the current OS user name
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := strings.TrimSpace(os.Getenv("USER")); name != "" {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Pantani/errors"
+)
+
+// GetCoordinators get all registered coordinators
+func (c *Client) GetCoordinators() (*CoordinatorAPI, error) {
+	var result *CoordinatorAPI
+	return result, c.getWithCache(
+		&result, "v1/coordinators", nil, 5*time.Minute)
+}
+
+// GetSlots get the slots between the min and max slot numbers
+func (c *Client) GetSlots(minSlotNum, maxSlotNum int64) (*SlotAPI, error) {
+	var result *SlotAPI
+	return result, c.get(
+		&result,
+		"v1/slots",
+		url.Values{
+			"minSlotNum": {strconv.FormatInt(minSlotNum, 10)},
+			"maxSlotNum": {strconv.FormatInt(maxSlotNum, 10)},
+			"order":      {"ASC"},
+		},
+	)
+}
+
+// GetSlot get a slot by slot number
+func (c *Client) GetSlot(slotNum int64) (*Slot, error) {
+	var result *Slot
+	return result, c.get(
+		&result,
+		"v1/slots/"+strconv.FormatInt(slotNum, 10),
+		nil,
+	)
+}
+
+// GetBids get all bids from a slot number
+func (c *Client) GetBids(slotNum int64) (*BidAPI, error) {
+	var result *BidAPI
+	return result, c.get(
+		&result,
+		"v1/bids",
+		url.Values{
+			"slotNum": {strconv.FormatInt(slotNum, 10)},
+			"order":   {"ASC"},
+		},
+	)
+}
+
+// GetState get the node and network state
+func (c *Client) GetState() (*StateAPI, error) {
+	var result *StateAPI
+	return result, c.get(&result, "v1/state", nil)
+}
+
+// GetConfig get the node config with the smart contracts constants and
+// addresses
+func (c *Client) GetConfig() (*NodeConfig, error) {
+	var result *NodeConfig
+	return result, c.getWithCache(&result, "v1/config", nil, 1*time.Hour)
+}
+
+// GetForgers get the current and next slot forgers, with the coordinator
+// URL, and explains the forging delay if the current forger didn't forge
+// any batch into the current slot
+func (c *Client) GetForgers() (*Forgers, error) {
+	state, err := c.GetState()
+	if err != nil {
+		return nil, err
+	}
+	network := state.Network
+	forgers := &Forgers{
+		CurrentSlot: network.CurrentSlot,
+		LastBatch:   network.LastBatch,
+	}
+	for i := range network.NextForgers {
+		forger := &network.NextForgers[i]
+		switch {
+		case forger.Period.SlotNum == network.CurrentSlot && forgers.Current == nil:
+			forgers.Current = forger
+		case forger.Period.SlotNum > network.CurrentSlot && forgers.Next == nil:
+			forgers.Next = forger
+		}
+	}
+	if forgers.Current == nil {
+		return nil, errors.E("current forger not found",
+			errors.Params{"slot": network.CurrentSlot})
+	}
+	forgers.Delay = forgingDelay(forgers, state.Node)
+	return forgers, nil
+}
+
+// ActiveCoordinator creates a client for the coordinator forging into the
+// current slot, so the transactions are sent to the active coordinator
+// pool. The client has the retry configuration of the pool
+func (c *Client) ActiveCoordinator() (*Client, *NextForger, error) {
+	forgers, err := c.GetForgers()
+	if err != nil {
+		return nil, nil, err
+	}
+	current := forgers.Current
+	if current.Coordinator.URL == "" {
+		return nil, nil, errors.E("active coordinator without URL",
+			errors.Params{"forger": current.Coordinator.Forger.String()})
+	}
+	forger, err := NewPool([]string{current.Coordinator.URL}, Config{Retry: c.cfg.Retry})
+	if err != nil {
+		return nil, nil, err
+	}
+	return forger, current, nil
+}
+
+// forgingDelay explains why the pool txs can be not forged yet
+func forgingDelay(forgers *Forgers, node NodeInfo) string {
+	current := forgers.Current
+	last := forgers.LastBatch
+	switch {
+	case last == nil:
+		return "no batch forged yet"
+	case last.SlotNum != forgers.CurrentSlot:
+		return "the current slot forger " + current.Coordinator.Forger.String() +
+			" did not forge any batch into slot " + strconv.FormatInt(forgers.CurrentSlot, 10) +
+			" yet, the slot ends at " + current.Period.ToTimestamp.String()
+	case last.ForgerAddr != current.Coordinator.Forger:
+		return "the last batch was forged by " + last.ForgerAddr.String() +
+			" instead of the slot winner " + current.Coordinator.Forger.String()
+	case time.Since(last.Timestamp).Seconds() > node.ForgeDelay && node.ForgeDelay > 0:
+		return "the last batch was forged " + time.Since(last.Timestamp).Truncate(time.Second).String() +
+			" ago, more than the forge delay of " + strconv.FormatFloat(node.ForgeDelay, 'f', 0, 64) + "s"
+	default:
+		return ""
+	}
+}
@@ -1,8 +1,11 @@
 package client
 
 import (
+	"context"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Pantani/errors"
@@ -11,25 +14,88 @@ import (
 	hezCommon "github.com/hermeznetwork/hermez-node/common"
 )
 
+const (
+	// tokensPageSize is the page size of the tokens reads, the maximum
+	// allowed by the node API
+	tokensPageSize = 2049
+	// AccountNotRegistered is the error message of the account reads
+	// without accounts into the network
+	AccountNotRegistered = "account not registered"
+	// TxSentStateUnknown is the error message of the txs sent without
+	// knowing if the pool received them
+	TxSentStateUnknown = "tx sent state unknown"
+)
+
 type (
-	// Client represents the node API client object
+	// Client represents the node API client object. The reads fail over
+	// between the nodes and the writes stick to one node at time
 	// https://docs.hermez.io/#/developers/api
 	Client struct {
-		request request.Request
+		mu     sync.RWMutex
+		nodes  []*node
+		cfg    Config
+		writer int
+		// forger is the client of the current slot forger pool, used
+		// until the slot end
+		forger      *Client
+		forgerUntil time.Time
 	}
 )
 
 // New creates a new node API client
 func New(nodeURL string) *Client {
-	return &Client{
-		request: request.InitClient(nodeURL),
+	c, _ := NewPool([]string{nodeURL}, Config{})
+	return c
+}
+
+// NewPool creates a new node API client for multiple nodes
+func NewPool(nodeURLs []string, cfg Config) (*Client, error) {
+	if len(nodeURLs) == 0 {
+		return nil, errors.E("at least one node url must be defined")
+	}
+	if cfg.Quorum > len(nodeURLs) {
+		return nil, errors.E("quorum bigger than the number of nodes",
+			errors.Params{"quorum": cfg.Quorum, "nodes": len(nodeURLs)})
 	}
+	cfg.Retry = cfg.Retry.withDefaults()
+	nodes := make([]*node, 0, len(nodeURLs))
+	for _, nodeURL := range nodeURLs {
+		nodes = append(nodes, newNode(nodeURL))
+	}
+	return &Client{nodes: nodes, cfg: cfg}, nil
+}
+
+// IsNotRegistered returns true if the error is an account read without
+// accounts into the network. The errors keep only the wrapped messages, so
+// the message is matched
+func IsNotRegistered(err error) bool {
+	return err != nil && strings.Contains(err.Error(), AccountNotRegistered)
+}
+
+// IsSentStateUnknown returns true if the error is a tx send failure that
+// the pool could have received anyway, the tx must not be handled as
+// rejected
+func IsSentStateUnknown(err error) bool {
+	return err != nil && strings.Contains(err.Error(), TxSentStateUnknown)
 }
 
-// GetAccount get an account info based in the hermez-integration address and the token id
+// GetAccount get the accounts of the hermez-integration address for the
+// token id
 func (c *Client) GetAccount(bjjAddress, hezEthAddress *string, tokenID hezCommon.TokenID) (*AccountAPI, error) {
+	return c.addressAccounts(bjjAddress, hezEthAddress, []hezCommon.TokenID{tokenID})
+}
+
+// GetAccounts get the accounts of all tokens of the hermez-integration
+// address
+func (c *Client) GetAccounts(bjjAddress, hezEthAddress *string) (*AccountAPI, error) {
+	return c.addressAccounts(bjjAddress, hezEthAddress, nil)
+}
+
+// addressAccounts get the accounts of the address filtered by the token
+// ids, all tokens without token ids
+func (c *Client) addressAccounts(bjjAddress, hezEthAddress *string, tokenIDs []hezCommon.TokenID) (*AccountAPI, error) {
 	values := url.Values{}
-	params := logger.Params{"token_id": tokenID}
+	params := logger.Params{"token_ids": tokenIDs}
 	if bjjAddress == nil && hezEthAddress == nil {
 		return nil, errors.E("bjjAddress or hezEthAddress must be defined")
 	}
@@ -41,15 +107,21 @@ func (c *Client) GetAccount(bjjAddress, hezEthAddress *string, tokenID hezCommon
 		values["hezEthAddress"] = []string{*hezEthAddress}
 		params["eth_address"] = *hezEthAddress
 	}
+	if len(tokenIDs) > 0 {
+		ids := make([]string, 0, len(tokenIDs))
+		for _, tokenID := range tokenIDs {
+			ids = append(ids, strconv.Itoa(int(tokenID)))
+		}
+		values["tokenIds"] = []string{strings.Join(ids, ",")}
+	}
 
-	var result *AccountAPI
-	err := c.request.Get(&result, "v1/accounts", values)
+	result, err := c.getAccounts(values)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(result.Accounts) == 0 {
-		return nil, errors.E("account not registered", params)
+	if result == nil || len(result.Accounts) == 0 {
+		return nil, errors.E(AccountNotRegistered, params)
 	}
 
 	params["accounts"] = len(result.Accounts)
@@ -57,10 +129,24 @@ func (c *Client) GetAccount(bjjAddress, hezEthAddress *string, tokenID hezCommon
 	return result, nil
 }
 
+// GetAccountByIdx get an account info based in the account index and the token symbol
+func (c *Client) GetAccountByIdx(idx hezCommon.Idx, tokenSymbol string) (*Account, error) {
+	var result *Account
+	err := c.get(&result, "v1/accounts/"+idxToHez(idx, tokenSymbol), nil)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil || hezCommon.Idx(result.Idx) != idx {
+		return nil, errors.E(AccountNotRegistered,
+			errors.Params{"idx": idx, "token": tokenSymbol})
+	}
+	return result, nil
+}
+
 // GetBatchTxs get all transactions history from a batch number
 func (c *Client) GetBatchTxs(batchNum hezCommon.BatchNum) (*TxAPI, error) {
 	var result *TxAPI
-	return result, c.request.GetWithCache(
+	return result, c.getWithCache(
 		&result,
 		"v1/transactions-history",
 		url.Values{
@@ -73,8 +159,14 @@ func (c *Client) GetBatchTxs(batchNum hezCommon.BatchNum) (*TxAPI, error) {
 
 // GetTx get a transaction by tx ID
 func (c *Client) GetTx(txID string) (*TxHistory, error) {
+	return c.getTx(context.Background(), txID)
+}
+
+// getTx get a transaction by tx ID into the context
+func (c *Client) getTx(ctx context.Context, txID string) (*TxHistory, error) {
 	var result *TxHistory
-	return result, c.request.Get(
+	return result, c.getContext(
+		ctx,
 		&result,
 		"v1/transactions-history/"+txID,
 		nil,
@@ -83,18 +175,48 @@ func (c *Client) GetTx(txID string) (*TxHistory, error) {
 
 // GetPoolTx get a pool transaction by tx ID
 func (c *Client) GetPoolTx(txID string) (*TxHistory, error) {
+	return c.getPoolTx(context.Background(), txID)
+}
+
+// getPoolTx get a pool transaction by tx ID into the context
+func (c *Client) getPoolTx(ctx context.Context, txID string) (*TxHistory, error) {
 	var result *TxHistory
-	return result, c.request.Get(
+	return result, c.getContext(
+		ctx,
 		&result,
 		"v1/transactions-pool/"+txID,
 		nil,
 	)
 }
 
-// GetLastBatch get last Hermez rollup batch
+// GetLastBatch get last Hermez rollup batch. If the quorum is defined,
+// the batch is read from the most updated node of the quorum
 func (c *Client) GetLastBatch() (*Batch, error) {
+	if c.cfg.Quorum > 0 {
+		value, err := c.quorum(func(r *request.Request) (hezCommon.BatchNum, interface{}, error) {
+			batch, err := lastBatch(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			return batch.BatchNum, batch, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return value.(*Batch), nil
+	}
+
+	var result *Batch
+	return result, c.failover(c.readOrder(), c.cfg.Retry.MaxAttempts, func(r *request.Request) (err error) {
+		result, err = lastBatch(r)
+		return err
+	})
+}
+
+// lastBatch get the last batch from a node
+func lastBatch(r *request.Request) (*Batch, error) {
 	var result *BatchAPI
-	err := c.request.Get(
+	err := r.Get(
 		&result,
 		"v1/batches",
 		url.Values{
@@ -105,33 +227,183 @@ func (c *Client) GetLastBatch() (*Batch, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(result.Batches) == 0 {
+	if result == nil || len(result.Batches) == 0 {
 		return nil, errors.E("batch not found")
 	}
 
 	return &result.Batches[0], nil
 }
 
-// SendTransaction send L2 transaction to the coordinator pool
-func (c *Client) SendTransaction(tx hezCommon.PoolL2Tx, token hezCommon.Token) (string, error) {
-	var result interface{}
-	body := NewTxRequest(tx, token)
-	err := c.request.Post(&result, "v1/transactions-pool", body)
+// GetBatch get a forged batch by number
+func (c *Client) GetBatch(batchNum hezCommon.BatchNum) (*Batch, error) {
+	var result *Batch
+	err := c.get(&result, "v1/batches/"+strconv.Itoa(int(batchNum)), nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	hash, ok := result.(string)
-	if !ok {
-		return "", errors.E("invalid tx result",
-			errors.Params{"result": result})
+	if result == nil || result.BatchNum != batchNum {
+		return nil, errors.E("batch not found", errors.Params{"batch": batchNum})
 	}
-	return hash, err
+	return result, nil
+}
+
+// GetExit get the exit of an account into a batch, with the exit tree
+// merkle proof
+func (c *Client) GetExit(batchNum hezCommon.BatchNum, idx hezCommon.Idx, tokenSymbol string) (*Exit, error) {
+	var result *Exit
+	err := c.get(&result, "v1/exits/"+strconv.Itoa(int(batchNum))+"/"+idxToHez(idx, tokenSymbol), nil)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil || hezCommon.Idx(result.Idx) != idx {
+		return nil, errors.E("exit not found", errors.Params{"batch": batchNum, "idx": idx})
+	}
+	return result, nil
+}
+
+// GetLastEthBlock get the last Ethereum block number known by the node
+func (c *Client) GetLastEthBlock() (int64, error) {
+	state, err := c.GetState()
+	if err != nil {
+		return 0, err
+	}
+	return state.Network.LastEthBlock, nil
+}
+
+// getAccounts get the accounts. If the quorum is defined, the accounts
+// are read from the most updated node of the quorum, using the node last
+// batch to compare the nodes
+func (c *Client) getAccounts(values url.Values) (*AccountAPI, error) {
+	if c.cfg.Quorum > 0 {
+		value, err := c.quorum(func(r *request.Request) (hezCommon.BatchNum, interface{}, error) {
+			batch, err := lastBatch(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			var result *AccountAPI
+			if err := r.Get(&result, "v1/accounts", values); err != nil {
+				return 0, nil, err
+			}
+			return batch.BatchNum, result, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return value.(*AccountAPI), nil
+	}
+
+	var result *AccountAPI
+	return result, c.get(&result, "v1/accounts", values)
+}
+
+// SendTransaction send L2 transaction to the coordinator pool, the pool of
+// the current slot forger if SendToForger is set
+func (c *Client) SendTransaction(ctx context.Context, tx hezCommon.PoolL2Tx, token hezCommon.Token) (string, error) {
+	return c.sendClient().sendTx(ctx, NewTxRequest(tx, token))
+}
+
+// SendAtomicTransaction send L2 transaction linked to another transaction
+// to the coordinator pool. The rqToken is the token of the requested tx
+func (c *Client) SendAtomicTransaction(ctx context.Context, tx hezCommon.PoolL2Tx,
+	token, rqToken hezCommon.Token) (string, error) {
+	return c.sendClient().sendTx(ctx, NewAtomicTxRequest(tx, token, rqToken))
+}
+
+// sendClient returns the client sending the transactions. With
+// SendToForger, it is the client of the current slot forger, fetched again
+// after the slot end. It falls back to the node pool if the forger is
+// unknown
+func (c *Client) sendClient() *Client {
+	if !c.cfg.SendToForger {
+		return c
+	}
+	c.mu.RLock()
+	forger, until := c.forger, c.forgerUntil
+	c.mu.RUnlock()
+	if forger != nil && time.Now().Before(until) {
+		return forger
+	}
+	forger, current, err := c.ActiveCoordinator()
+	if err != nil {
+		logger.Warn("Cannot route the tx to the forger", logger.Params{"error": err.Error()})
+		return c
+	}
+	c.mu.Lock()
+	c.forger = forger
+	c.forgerUntil = current.Period.ToTimestamp
+	c.mu.Unlock()
+	logger.Info("Route the txs to the forger", logger.Params{
+		"slot":            current.Period.SlotNum,
+		"coordinator_url": current.Coordinator.URL,
+		"until":           current.Period.ToTimestamp,
+	})
+	return forger
+}
+
+// sendTx send the transaction request to the coordinator pool. The pool
+// could accept the tx even if the request failed, so the tx is sent again
+// only if it's confirmed absent from the pool and the history
+func (c *Client) sendTx(ctx context.Context, body *Tx) (string, error) {
+	var err error
+	for i := 0; i < c.cfg.Retry.MaxAttempts; i++ {
+		var result interface{}
+		err = c.post(ctx, &result, "v1/transactions-pool", body)
+		if err == nil {
+			hash, ok := result.(string)
+			if !ok {
+				return "", errors.E("invalid tx result",
+					errors.Params{"result": result})
+			}
+			return hash, nil
+		}
+		if body.TxID == (hezCommon.TxID{}) {
+			return "", err
+		}
+		txID := body.TxID.String()
+		known, lookupErr := c.isKnownTx(ctx, txID)
+		if lookupErr != nil {
+			return "", errors.E(TxSentStateUnknown, err,
+				errors.Params{"tx_id": txID, "lookup_error": lookupErr.Error()})
+		}
+		if known {
+			logger.Info("Tx accepted despite the request failure", logger.Params{"tx_id": txID})
+			return txID, nil
+		}
+		if i == c.cfg.Retry.MaxAttempts-1 {
+			break
+		}
+		delay := c.cfg.Retry.backoff(i, &attempt{})
+		logger.Warn("Tx confirmed absent, sending again", logger.Params{
+			"tx_id":   txID,
+			"attempt": i + 1,
+			"delay":   delay.String(),
+			"error":   err.Error(),
+		})
+		time.Sleep(delay)
+	}
+	return "", err
+}
+
+// isKnownTx checks if the tx is into the pool or already forged
+func (c *Client) isKnownTx(ctx context.Context, txID string) (bool, error) {
+	poolTx, err := c.getPoolTx(ctx, txID)
+	if err != nil {
+		return false, err
+	}
+	if poolTx != nil && poolTx.TxID.String() == txID {
+		return true, nil
+	}
+	tx, err := c.getTx(ctx, txID)
+	if err != nil {
+		return false, err
+	}
+	return tx != nil && tx.TxID.String() == txID, nil
 }
 
 // AccountCreationAuth create an account authentication into the node.
 func (c *Client) AccountCreationAuth(ethAddr, bjj, signature string) error {
 	var result CreateAccountAuthAPI
-	err := c.request.Post(&result, "v1/account-creation-authorization", AccountAuth{
+	err := c.post(context.Background(), &result, "v1/account-creation-authorization", AccountAuth{
 		EthAddr:   ethAddr,
 		Bjj:       bjj,
 		Signature: signature,
@@ -149,7 +421,7 @@ func (c *Client) AccountCreationAuth(ethAddr, bjj, signature string) error {
 // AccountAuth get the account authentication from the node.
 func (c *Client) AccountAuth(ethAddr string) (*AccountAuthAPI, error) {
 	var result *AccountAuthAPI
-	err := c.request.GetWithCache(&result, "v1/account-creation-authorization/"+ethAddr, nil, 1*time.Hour)
+	err := c.getWithCache(&result, "v1/account-creation-authorization/"+ethAddr, nil, 1*time.Hour)
 	if err != nil {
 		return nil, err
 	}
@@ -163,6 +435,18 @@ func (c *Client) AccountAuth(ethAddr string) (*AccountAuthAPI, error) {
 // GetTokens get all supported tokens
 func (c *Client) GetTokens() (*TokenAPI, error) {
 	var result *TokenAPI
-	return result, c.request.GetWithCache(
+	return result, c.getWithCache(
 		&result, "v1/tokens", nil, 20*time.Minute)
 }
+
+// GetTokensFrom get a page of the supported tokens, in registration
+// order, starting from the item id. The page is not cached, so the new
+// token registrations are returned
+func (c *Client) GetTokensFrom(fromItem uint64) (*TokenPageAPI, error) {
+	var result *TokenPageAPI
+	return result, c.get(&result, "v1/tokens", url.Values{
+		"fromItem": {strconv.FormatUint(fromItem, 10)},
+		"order":    {"ASC"},
+		"limit":    {strconv.Itoa(tokensPageSize)},
+	})
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+// Client must implement all data source interfaces
+var (
+	_ AccountReader = (*Client)(nil)
+	_ TxSubmitter   = (*Client)(nil)
+	_ BatchReader   = (*Client)(nil)
+	_ PoolReader    = (*Client)(nil)
+	_ BlockReader   = (*Client)(nil)
+	_ TokenReader   = (*Client)(nil)
+	_ TxReader      = (*Client)(nil)
+)
+
+type (
+	// AccountReader reads the rollup accounts of an address, of a token or
+	// of all tokens
+	AccountReader interface {
+		GetAccount(bjjAddress, hezEthAddress *string, tokenID hezCommon.TokenID) (*AccountAPI, error)
+		GetAccounts(bjjAddress, hezEthAddress *string) (*AccountAPI, error)
+	}
+
+	// TxSubmitter sends the signed L2 transactions to the coordinator pool
+	TxSubmitter interface {
+		SendTransaction(ctx context.Context, tx hezCommon.PoolL2Tx, token hezCommon.Token) (string, error)
+		SendAtomicTransaction(ctx context.Context, tx hezCommon.PoolL2Tx, token, rqToken hezCommon.Token) (string, error)
+	}
+
+	// BatchReader reads the forged batches and transactions
+	BatchReader interface {
+		GetLastBatch() (*Batch, error)
+		GetBatchTxs(batchNum hezCommon.BatchNum) (*TxAPI, error)
+		GetTx(txID string) (*TxHistory, error)
+	}
+
+	// BlockReader reads the forged batches L1 blocks, to check the batches
+	// confirmations
+	BlockReader interface {
+		GetBatch(batchNum hezCommon.BatchNum) (*Batch, error)
+		GetLastEthBlock() (int64, error)
+	}
+
+	// TokenReader reads the supported tokens in registration order
+	TokenReader interface {
+		GetTokensFrom(fromItem uint64) (*TokenPageAPI, error)
+	}
+
+	// PoolReader reads the transactions from the coordinator pool
+	PoolReader interface {
+		GetPoolTx(txID string) (*TxHistory, error)
+	}
+
+	// TxReader reads a transaction from the coordinator pool and from the
+	// history, to check if a sent transaction was received
+	TxReader interface {
+		PoolReader
+		GetTx(txID string) (*TxHistory, error)
+	}
+)
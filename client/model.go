@@ -11,7 +11,7 @@ import (
 	ethCommon "github.com/ethereum/go-ethereum/common"
 	"github.com/hermeznetwork/hermez-node/api/apitypes"
 	hezCommon "github.com/hermeznetwork/hermez-node/common"
-	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-merkletree"
 )
 
 type (
@@ -50,17 +50,17 @@ type (
 		TxID             hezCommon.TxID          `json:"id"`
 		BatchNum         hezCommon.BatchNum      `json:"batchNum"`
 		L1orL2           string                  `json:"L1orL2"`
-		L1Info           interface{}             `json:"L1Info"`
+		L1Info           *L1Info                 `json:"L1Info"`
 		L2Info           interface{}             `json:"L2Info"`
 		Nonce            hezCommon.Nonce         `json:"nonce"`
-		RequestAmount    apitypes.BigIntStr      `json:"requestAmount"`
-		RequestFee       hezCommon.FeeSelector   `json:"requestFee"`
-		RequestFromIdx   StrHezIdx               `json:"requestFromAccountIndex"`
-		RequestNonce     hezCommon.Nonce         `json:"requestNonce"`
-		RequestToIdx     hezCommon.Idx           `json:"requestToAccountIndex"`
-		RequestToBJJ     babyjub.PublicKeyComp   `json:"requestToBJJ"`
-		RequestToEthAddr ethCommon.Address       `json:"requestToHezEthereumAddress"`
-		RequestTokenID   hezCommon.TokenID       `json:"requestTokenId"`
+		RequestAmount    *apitypes.BigIntStr     `json:"requestAmount"`
+		RequestFee       *hezCommon.FeeSelector  `json:"requestFee"`
+		RequestFromIdx   *StrHezIdx              `json:"requestFromAccountIndex"`
+		RequestNonce     *hezCommon.Nonce        `json:"requestNonce"`
+		RequestToIdx     *StrHezIdx              `json:"requestToAccountIndex"`
+		RequestToBJJ     *apitypes.HezBJJ        `json:"requestToBJJ"`
+		RequestToEthAddr *apitypes.HezEthAddr    `json:"requestToHezEthereumAddress"`
+		RequestTokenID   *hezCommon.TokenID      `json:"requestTokenId"`
 		Signature        string                  `json:"signature"`
 		State            hezCommon.PoolL2TxState `json:"state"`
 		Timestamp        time.Time               `json:"timestamp"`
@@ -71,6 +71,28 @@ type (
 		Type             hezCommon.TxType        `json:"type"`
 	}
 
+	// L1Info is a representation of the L1 tx fields of a tx history.
+	L1Info struct {
+		ToForgeL1TxsNum      *int64             `json:"toForgeL1TransactionsNum"`
+		UserOrigin           bool               `json:"userOrigin"`
+		DepositAmount        apitypes.BigIntStr `json:"depositAmount"`
+		AmountSuccess        bool               `json:"amountSuccess"`
+		DepositAmountSuccess bool               `json:"depositAmountSuccess"`
+		EthBlockNum          int64              `json:"ethereumBlockNum"`
+	}
+
+	// Exit is a representation of an exit API object.
+	Exit struct {
+		ItemID      uint64                          `json:"itemId"`
+		BatchNum    hezCommon.BatchNum              `json:"batchNum"`
+		Idx         StrHezIdx                       `json:"accountIndex"`
+		BJJ         *apitypes.HezBJJ                `json:"bjj"`
+		EthAddr     *apitypes.HezEthAddr            `json:"hezEthereumAddress"`
+		MerkleProof *merkletree.CircomVerifierProof `json:"merkleProof"`
+		Balance     apitypes.BigIntStr              `json:"balance"`
+		Token       hezCommon.Token                 `json:"token"`
+	}
+
 	// TxAPI is a representation of a tx history API response.
 	TxAPI struct {
 		Txs          []TxHistory `json:"transactions"`
@@ -89,6 +111,13 @@ type (
 		PendingItems uint64 `json:"pendingItems"`
 	}
 
+	// TokenPageAPI is a representation of a page of the tokens API
+	// response, keeping the tokens item ids.
+	TokenPageAPI struct {
+		Tokens       []Token `json:"tokens"`
+		PendingItems uint64  `json:"pendingItems"`
+	}
+
 	// Tokens is a representation of a list of tokens.
 	Tokens []hezCommon.Token
 
@@ -131,6 +160,15 @@ type (
 		Fee       uint64         `json:"fee"`
 		Nonce     uint64         `json:"nonce"`
 		Signature string         `json:"signature"`
+		// Request fields, only used by atomic transactions
+		RqFromIdx   string  `json:"requestFromAccountIndex,omitempty"`
+		RqToIdx     string  `json:"requestToAccountIndex,omitempty"`
+		RqToEthAddr string  `json:"requestToHezEthereumAddress,omitempty"`
+		RqToBJJ     string  `json:"requestToBjj,omitempty"`
+		RqTokenID   *uint32 `json:"requestTokenId,omitempty"`
+		RqAmount    string  `json:"requestAmount,omitempty"`
+		RqFee       *uint64 `json:"requestFee,omitempty"`
+		RqNonce     *uint64 `json:"requestNonce,omitempty"`
 	}
 
 	// AccountAuth is a representation of a account authentication API request.
@@ -154,6 +192,114 @@ type (
 		Message   string                `json:"Message"`
 	}
 
+	// Coordinator is a representation of a coordinator API object.
+	Coordinator struct {
+		ItemID      uint64            `json:"itemId"`
+		Bidder      ethCommon.Address `json:"bidderAddr"`
+		Forger      ethCommon.Address `json:"forgerAddr"`
+		EthBlockNum int64             `json:"ethereumBlock"`
+		URL         string            `json:"URL"`
+	}
+
+	// CoordinatorAPI is a representation of a coordinators API response.
+	CoordinatorAPI struct {
+		Coordinators []Coordinator `json:"coordinators"`
+		PendingItems uint64        `json:"pendingItems"`
+	}
+
+	// Bid is a representation of a bid API object.
+	Bid struct {
+		ItemID      uint64             `json:"itemId"`
+		SlotNum     int64              `json:"slotNum"`
+		BidValue    apitypes.BigIntStr `json:"bidValue"`
+		EthBlockNum int64              `json:"ethereumBlockNum"`
+		Bidder      ethCommon.Address  `json:"bidderAddr"`
+		Forger      ethCommon.Address  `json:"forgerAddr"`
+		URL         string             `json:"URL"`
+		Timestamp   time.Time          `json:"timestamp"`
+	}
+
+	// BidAPI is a representation of a bids API response.
+	BidAPI struct {
+		Bids         []Bid  `json:"bids"`
+		PendingItems uint64 `json:"pendingItems"`
+	}
+
+	// Slot is a representation of a slot API object.
+	Slot struct {
+		ItemID      uint64 `json:"itemId"`
+		SlotNum     int64  `json:"slotNum"`
+		FirstBlock  int64  `json:"firstBlock"`
+		LastBlock   int64  `json:"lastBlock"`
+		OpenAuction bool   `json:"openAuction"`
+		WinnerBid   *Bid   `json:"bestBid"`
+	}
+
+	// SlotAPI is a representation of a slots API response.
+	SlotAPI struct {
+		Slots        []Slot `json:"slots"`
+		PendingItems uint64 `json:"pendingItems"`
+	}
+
+	// Period is a representation of a slot period.
+	Period struct {
+		SlotNum       int64     `json:"slotNum"`
+		FromBlock     int64     `json:"fromBlock"`
+		ToBlock       int64     `json:"toBlock"`
+		FromTimestamp time.Time `json:"fromTimestamp"`
+		ToTimestamp   time.Time `json:"toTimestamp"`
+	}
+
+	// NextForger is a representation of the coordinator that can forge
+	// into a slot period.
+	NextForger struct {
+		Coordinator Coordinator `json:"coordinator"`
+		Period      Period      `json:"period"`
+	}
+
+	// Network is a representation of the network state.
+	Network struct {
+		LastEthBlock  int64        `json:"lastEthereumBlock"`
+		LastSyncBlock int64        `json:"lastSynchedBlock"`
+		LastBatch     *Batch       `json:"lastBatch"`
+		CurrentSlot   int64        `json:"currentSlot"`
+		NextForgers   []NextForger `json:"nextForgers"`
+		PendingL1Txs  int          `json:"pendingL1Transactions"`
+	}
+
+	// NodeInfo is a representation of the node public info.
+	NodeInfo struct {
+		ForgeDelay float64 `json:"forgeDelay"`
+		PoolLoad   int64   `json:"poolLoad"`
+	}
+
+	// StateAPI is a representation of a state API response.
+	StateAPI struct {
+		Node    NodeInfo `json:"node"`
+		Network Network  `json:"network"`
+	}
+
+	// NodeConfig is a representation of a config API response.
+	NodeConfig struct {
+		Rollup   RollupConfig                `json:"hermez"`
+		WDelayer hezCommon.WDelayerConstants `json:"withdrawalDelayer"`
+	}
+
+	// RollupConfig is a representation of the rollup contract config.
+	RollupConfig struct {
+		PublicConstants hezCommon.RollupConstants `json:"publicConstants"`
+	}
+
+	// Forgers is a representation of the current and next forgers.
+	Forgers struct {
+		CurrentSlot int64       `json:"currentSlot"`
+		Current     *NextForger `json:"current"`
+		Next        *NextForger `json:"next"`
+		LastBatch   *Batch      `json:"lastBatch"`
+		// Delay explains why the pool txs are not being forged
+		Delay string `json:"delay,omitempty"`
+	}
+
 	// Accounts is a representation of a account list.
 	Accounts []Account
 
@@ -218,3 +364,14 @@ func (ts *Tokens) GetToken(symbol string) (hezCommon.Token, error) {
 	return hezCommon.Token{}, errors.E("token not supported",
 		errors.Params{"symbol": symbol})
 }
+
+// GetTokenByID get a token by id
+func (ts *Tokens) GetTokenByID(tokenID hezCommon.TokenID) (hezCommon.Token, error) {
+	for _, t := range *ts {
+		if t.TokenID == tokenID {
+			return t, nil
+		}
+	}
+	return hezCommon.Token{}, errors.E("token not supported",
+		errors.Params{"token_id": tokenID})
+}
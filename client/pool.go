@@ -0,0 +1,386 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/Pantani/request"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+type (
+	// Config represents the node pool configuration
+	Config struct {
+		// Quorum is the minimum number of updated nodes that must answer
+		// the quorum reads (GetLastBatch and GetAccount). Zero disables
+		// the quorum mode
+		Quorum int
+		// MaxBatchLag is the maximum number of batches a node can lag
+		// behind the most updated node before its responses are rejected
+		MaxBatchLag hezCommon.BatchNum
+		// Retry is the retry and circuit breaker configuration
+		Retry RetryConfig
+		// SendToForger routes the transactions to the pool of the
+		// coordinator forging into the current slot, with the same retry
+		// configuration. The write node is used if the forger is unknown.
+		// The reads are still served by the configured nodes
+		SendToForger bool
+	}
+
+	// NodeStatus represents the health status of a node
+	NodeStatus struct {
+		URL       string             `json:"url"`
+		Healthy   bool               `json:"healthy"`
+		LastBatch hezCommon.BatchNum `json:"lastBatch"`
+		LastCheck time.Time          `json:"lastCheck"`
+		LastError string             `json:"lastError,omitempty"`
+		// CircuitOpen is true while the node is skipped after consecutive
+		// failures
+		CircuitOpen bool `json:"circuitOpen"`
+	}
+
+	// node represents a node API endpoint
+	node struct {
+		request   request.Request
+		status    NodeStatus
+		failures  int
+		openUntil time.Time
+		// flaggedUntil keeps the node unhealthy after serving
+		// inconsistent data, even if the requests succeed
+		flaggedUntil time.Time
+	}
+
+	// quorumResult represents a node response for a quorum read
+	quorumResult struct {
+		node     *node
+		url      string
+		batchNum hezCommon.BatchNum
+		value    interface{}
+	}
+)
+
+// newNode creates a node endpoint
+func newNode(nodeURL string) *node {
+	r := request.InitClient(nodeURL)
+	r.HTTPClient = newHTTPClient()
+	return &node{
+		request: r,
+		status:  NodeStatus{URL: nodeURL, Healthy: true},
+	}
+}
+
+// Nodes returns the health status of all nodes
+func (c *Client) Nodes() []NodeStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := time.Now()
+	nodes := make([]NodeStatus, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		status := n.status
+		status.CircuitOpen = now.Before(n.openUntil)
+		nodes = append(nodes, status)
+	}
+	return nodes
+}
+
+// NodeClients returns a single node client for each node of the pool,
+// keyed by the node URL, to read the same data from every node
+func (c *Client) NodeClients() map[string]*Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	clients := make(map[string]*Client, len(c.nodes))
+	for _, n := range c.nodes {
+		nodeClient, _ := NewPool([]string{n.status.URL}, Config{Retry: c.cfg.Retry})
+		clients[n.status.URL] = nodeClient
+	}
+	return clients
+}
+
+// FlagNode marks a node serving inconsistent data as unhealthy and opens
+// its circuit breaker, so the reads skip it until the cooldown
+func (c *Client) FlagNode(nodeURL string, reason error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.nodes {
+		if n.status.URL != nodeURL {
+			continue
+		}
+		n.status.Healthy = false
+		n.status.LastError = reason.Error()
+		n.status.LastCheck = time.Now()
+		n.openUntil = n.status.LastCheck.Add(c.cfg.Retry.BreakerCooldown)
+		n.flaggedUntil = n.openUntil
+		logger.Warn("Node flagged", logger.Params{
+			"url":    nodeURL,
+			"until":  n.openUntil,
+			"reason": reason.Error(),
+		})
+		c.changeWriter(n)
+	}
+}
+
+// HealthCheck checks the nodes periodically, marking as unhealthy the
+// nodes unreachable or lagging behind the most updated node. The health
+// check also probes the nodes with the circuit breaker open
+func (c *Client) HealthCheck(interval time.Duration) func() error {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ticker.C:
+				c.checkNodes()
+			}
+		}
+	}
+}
+
+// checkNodes fetches the last batch of all nodes and updates the status
+func (c *Client) checkNodes() {
+	results := c.fetchAll(c.nodes, func(r *request.Request) (hezCommon.BatchNum, interface{}, error) {
+		batch, err := lastBatch(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		return batch.BatchNum, batch, nil
+	})
+	maxBatch := hezCommon.BatchNum(0)
+	for _, r := range results {
+		if r.batchNum > maxBatch {
+			maxBatch = r.batchNum
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, r := range results {
+		r.node.status.LastBatch = r.batchNum
+		if c.cfg.MaxBatchLag > 0 && maxBatch-r.batchNum > c.cfg.MaxBatchLag {
+			r.node.status.Healthy = false
+			r.node.status.LastError = "node lagging behind"
+			logger.Warn("Node lagging behind", logger.Params{
+				"url":        r.node.status.URL,
+				"last_batch": r.batchNum,
+				"max_batch":  maxBatch,
+			})
+		}
+	}
+}
+
+// get sends a GET request, retrying the transient errors and failing over
+// to the next node
+func (c *Client) get(result interface{}, path string, query url.Values) error {
+	return c.getContext(context.Background(), result, path, query)
+}
+
+// getContext sends a GET request into the context, retrying the transient
+// errors and failing over to the next node
+func (c *Client) getContext(ctx context.Context, result interface{}, path string, query url.Values) error {
+	return c.failover(c.readOrder(), c.cfg.Retry.MaxAttempts, func(r *request.Request) error {
+		return r.GetWithContext(ctx, result, path, query)
+	})
+}
+
+// getWithCache sends a cached GET request, retrying the transient errors
+// and failing over to the next node
+func (c *Client) getWithCache(result interface{}, path string, query url.Values, cache time.Duration) error {
+	return c.failover(c.readOrder(), c.cfg.Retry.MaxAttempts, func(r *request.Request) error {
+		return r.GetWithCache(result, path, query, cache)
+	})
+}
+
+// post sends a single POST request to the sticky write node, writes are
+// never retried. If the write node fails, the next healthy node becomes
+// the write node for the next requests
+func (c *Client) post(ctx context.Context, result interface{}, path string, body interface{}) error {
+	return c.failover([]*node{c.writerNode()}, 1, func(r *request.Request) error {
+		return r.PostWithContext(ctx, result, path, body)
+	})
+}
+
+// failover executes the request into the nodes order until one succeeds.
+// The transient errors are retried into the same node with backoff up to
+// the attempts, the nodes with the circuit breaker open are skipped
+func (c *Client) failover(nodes []*node, attempts int, fn func(r *request.Request) error) error {
+	var lastErr error
+	for _, n := range nodes {
+		nodeURL := c.nodeURL(n)
+		if c.circuitOpen(n) {
+			lastErr = errors.E("node circuit breaker open", errors.Params{"url": nodeURL})
+			continue
+		}
+		for i := 0; i < attempts; i++ {
+			a := &attempt{}
+			err := fn(n.newRequest(a))
+			c.setStatus(n, err)
+			if err == nil {
+				return nil
+			}
+			lastErr = err
+			if !a.retryable(err) || i == attempts-1 {
+				logger.Warn("Node request failure", logger.Params{"url": nodeURL, "error": err.Error()})
+				break
+			}
+			delay := c.cfg.Retry.backoff(i, a)
+			logger.Warn("Node request retry", logger.Params{
+				"url":     nodeURL,
+				"status":  a.status,
+				"attempt": i + 1,
+				"delay":   delay.String(),
+				"error":   err.Error(),
+			})
+			time.Sleep(delay)
+		}
+	}
+	return errors.E("all nodes failed", lastErr)
+}
+
+// nodeURL returns the node URL, the status is read under the lock
+func (c *Client) nodeURL(n *node) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return n.status.URL
+}
+
+// circuitOpen returns true if the node circuit breaker is open
+func (c *Client) circuitOpen(n *node) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return time.Now().Before(n.openUntil)
+}
+
+// quorum executes the read into all nodes and returns the value from the
+// most updated node, rejecting the nodes lagging behind more than the
+// MaxBatchLag. It fails if less than Quorum nodes answered
+func (c *Client) quorum(fn func(r *request.Request) (hezCommon.BatchNum, interface{}, error)) (interface{}, error) {
+	results := c.fetchAll(c.readOrder(), fn)
+	var best *quorumResult
+	for i := range results {
+		if best == nil || results[i].batchNum > best.batchNum {
+			best = &results[i]
+		}
+	}
+	if best == nil {
+		return nil, errors.E("no node answered the quorum read")
+	}
+	accepted := 0
+	for _, r := range results {
+		if best.batchNum-r.batchNum <= c.cfg.MaxBatchLag {
+			accepted++
+			continue
+		}
+		logger.Warn("Node response rejected by lag", logger.Params{
+			"url":        r.url,
+			"last_batch": r.batchNum,
+			"max_batch":  best.batchNum,
+		})
+	}
+	if accepted < c.cfg.Quorum {
+		return nil, errors.E("quorum not reached",
+			errors.Params{"accepted": accepted, "quorum": c.cfg.Quorum})
+	}
+	return best.value, nil
+}
+
+// fetchAll executes the read into the nodes concurrently and returns the
+// successful results
+func (c *Client) fetchAll(nodes []*node, fn func(r *request.Request) (hezCommon.BatchNum, interface{}, error)) []quorumResult {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make([]quorumResult, 0, len(nodes))
+	)
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			batchNum, value, err := fn(n.newRequest(&attempt{}))
+			c.setStatus(n, err)
+			if err != nil {
+				return
+			}
+			nodeURL := c.nodeURL(n)
+			mu.Lock()
+			results = append(results, quorumResult{node: n, url: nodeURL, batchNum: batchNum, value: value})
+			mu.Unlock()
+		}(n)
+	}
+	wg.Wait()
+	return results
+}
+
+// readOrder returns the healthy nodes first and the unhealthy nodes last,
+// skipping the nodes with the circuit breaker open
+func (c *Client) readOrder() []*node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := time.Now()
+	healthy := make([]*node, 0, len(c.nodes))
+	unhealthy := make([]*node, 0)
+	for _, n := range c.nodes {
+		if now.Before(n.openUntil) {
+			continue
+		}
+		if n.status.Healthy {
+			healthy = append(healthy, n)
+		} else {
+			unhealthy = append(unhealthy, n)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// writerNode returns the sticky write node
+func (c *Client) writerNode() *node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodes[c.writer]
+}
+
+// setStatus updates the node health and circuit breaker after a request.
+// If the write node fails, the first healthy node becomes the write node
+func (c *Client) setStatus(n *node, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n.status.LastCheck = time.Now()
+	if err == nil && n.status.LastCheck.Before(n.flaggedUntil) {
+		return
+	}
+	if err == nil {
+		n.status.Healthy = true
+		n.status.LastError = ""
+		n.failures = 0
+		n.openUntil = time.Time{}
+		return
+	}
+	n.status.Healthy = false
+	n.status.LastError = err.Error()
+	n.failures++
+	if n.failures >= c.cfg.Retry.BreakerThreshold {
+		n.openUntil = n.status.LastCheck.Add(c.cfg.Retry.BreakerCooldown)
+		logger.Warn("Node circuit breaker open", logger.Params{
+			"url":      n.status.URL,
+			"failures": n.failures,
+			"until":    n.openUntil,
+		})
+	}
+	c.changeWriter(n)
+}
+
+// changeWriter selects the first healthy node as the write node if the
+// node is the write node, the caller must hold the lock
+func (c *Client) changeWriter(n *node) {
+	if c.nodes[c.writer] != n {
+		return
+	}
+	for i, other := range c.nodes {
+		if other.status.Healthy {
+			c.writer = i
+			logger.Info("Write node changed", logger.Params{"url": other.status.URL})
+			return
+		}
+	}
+}
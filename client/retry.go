@@ -0,0 +1,129 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/request"
+)
+
+// DefaultRetryConfig is the retry configuration used for the zero fields
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts:      3,
+	BaseDelay:        500 * time.Millisecond,
+	MaxDelay:         10 * time.Second,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+}
+
+type (
+	// RetryConfig represents the retry and circuit breaker configuration.
+	// Only the idempotent GET requests are retried
+	RetryConfig struct {
+		// MaxAttempts is the number of attempts per node
+		MaxAttempts int
+		// BaseDelay is the backoff delay after the first attempt, doubled
+		// after every attempt
+		BaseDelay time.Duration
+		// MaxDelay is the maximum backoff delay. The Retry-After header
+		// of the 429 responses overrides the backoff delay
+		MaxDelay time.Duration
+		// BreakerThreshold is the number of consecutive failures to open
+		// the node circuit breaker
+		BreakerThreshold int
+		// BreakerCooldown is the time the node is skipped after the
+		// circuit breaker opens. After it, one request is allowed and the
+		// breaker opens again if it fails
+		BreakerCooldown time.Duration
+	}
+
+	// attempt represents the response status of a single node request
+	attempt struct {
+		status     int
+		retryAfter time.Duration
+	}
+)
+
+// withDefaults fills the zero fields with the default configuration
+func (cfg RetryConfig) withDefaults() RetryConfig {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = DefaultRetryConfig.MaxAttempts
+	}
+	if cfg.BaseDelay <= 0 {
+		cfg.BaseDelay = DefaultRetryConfig.BaseDelay
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = DefaultRetryConfig.MaxDelay
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = DefaultRetryConfig.BreakerThreshold
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = DefaultRetryConfig.BreakerCooldown
+	}
+	return cfg
+}
+
+// backoff returns the exponential backoff delay with jitter for the
+// attempt, or the Retry-After delay sent by the node
+func (cfg RetryConfig) backoff(n int, a *attempt) time.Duration {
+	if a.retryAfter > 0 {
+		return a.retryAfter
+	}
+	delay := cfg.BaseDelay << uint(n)
+	if delay <= 0 || delay > cfg.MaxDelay {
+		delay = cfg.MaxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// newRequest returns a copy of the node request recording the response
+// status into the attempt. Rate limit and server errors are handled as
+// request errors
+func (n *node) newRequest(a *attempt) *request.Request {
+	r := n.request
+	r.ErrorHandler = func(res *http.Response, uri string) error {
+		a.status = res.StatusCode
+		if res.StatusCode != http.StatusTooManyRequests && res.StatusCode < http.StatusInternalServerError {
+			return nil
+		}
+		a.retryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		return errors.E("node server error", errors.Params{"status": res.StatusCode})
+	}
+	return &r
+}
+
+// retryable returns true if the request failed by a network error, a rate
+// limit or a server error
+func (a *attempt) retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	return a.status == 0 ||
+		a.status == http.StatusTooManyRequests ||
+		a.status >= http.StatusInternalServerError
+}
+
+// parseRetryAfter parses the Retry-After header in seconds or HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Pantani/request"
+	"github.com/hermeznetwork/hermez-integration/metrics"
+	"github.com/hermeznetwork/hermez-integration/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type (
+	// transport records the latency, errors and trace spans of the node
+	// API requests. The cached responses never reach the transport
+	transport struct {
+		base http.RoundTripper
+	}
+)
+
+// newHTTPClient creates the instrumented HTTP client of the nodes
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout:   request.DefaultClient.Timeout,
+		Transport: transport{base: http.DefaultTransport},
+	}
+}
+
+// RoundTrip executes and records the request. The trace context is
+// propagated to the node
+func (t transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := endpoint(req.URL.Path)
+	ctx, span := tracing.Start(req.Context(), "HTTP "+req.Method+" "+path,
+		attribute.String("http.method", req.Method),
+		attribute.String("http.host", req.URL.Host),
+		attribute.String("http.route", path),
+	)
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	status := 0
+	if err == nil {
+		status = res.StatusCode
+		span.SetAttributes(attribute.Int("http.status_code", status))
+	}
+	metrics.ObserveRequest(req.URL.Host, req.Method, path, status, time.Since(start))
+	tracing.End(span, err)
+	return res, err
+}
+
+// endpoint returns the API endpoint of the path, replacing the resource
+// ids to keep the metrics labels cardinality low.
+// e.g.: /v1/accounts/hez:ETH:256 returns v1/accounts/:id
+func endpoint(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i, p := range parts {
+		if p != "v1" || i+1 >= len(parts) {
+			continue
+		}
+		e := "v1/" + parts[i+1]
+		if i+2 < len(parts) {
+			e += "/:id"
+		}
+		return e
+	}
+	return "unknown"
+}
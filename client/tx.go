@@ -38,6 +38,35 @@ func NewTxRequest(poolTx hezCommon.PoolL2Tx, token hezCommon.Token) *Tx {
 	}
 }
 
+// NewAtomicTxRequest convert L2 atomic tx to API request model, the rqToken
+// is the token of the requested tx
+func NewAtomicTxRequest(poolTx hezCommon.PoolL2Tx, token, rqToken hezCommon.Token) *Tx {
+	tx := NewTxRequest(poolTx, token)
+	if poolTx.RqFromIdx == 0 {
+		return tx
+	}
+	rqTokenID := uint32(poolTx.RqTokenID)
+	rqFee := uint64(poolTx.RqFee)
+	rqNonce := uint64(poolTx.RqNonce)
+	tx.RqFromIdx = idxToHez(poolTx.RqFromIdx, rqToken.Symbol)
+	if poolTx.RqToIdx > 0 {
+		tx.RqToIdx = idxToHez(poolTx.RqToIdx, rqToken.Symbol)
+	}
+	if poolTx.RqToEthAddr != hezCommon.EmptyAddr {
+		tx.RqToEthAddr = ethAddrToHez(poolTx.RqToEthAddr)
+	}
+	if poolTx.RqToBJJ != hezCommon.EmptyBJJComp {
+		tx.RqToBJJ = bjjToString(poolTx.RqToBJJ)
+	}
+	tx.RqTokenID = &rqTokenID
+	if poolTx.RqAmount != nil {
+		tx.RqAmount = poolTx.RqAmount.String()
+	}
+	tx.RqFee = &rqFee
+	tx.RqNonce = &rqNonce
+	return tx
+}
+
 // idxToHez convert idx to hez idx
 func idxToHez(idx hezCommon.Idx, tokenSymbol string) string {
 	return "hez:" + tokenSymbol + ":" + strconv.Itoa(int(idx))
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/audit"
+)
+
+// auditverify verifies the signatures audit log chain, detecting gaps and
+// edited records. Keep the printed last hash out of the host to also
+// detect a truncated log
+func main() {
+	path := flag.String("file", "audit.log", "audit log file path")
+	flag.Parse()
+
+	last, err := audit.Verify(*path)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if last == nil {
+		logger.Info("Audit log empty", logger.Params{"file": *path})
+		return
+	}
+	logger.Info("Audit log verified", logger.Params{
+		"file":      *path,
+		"records":   last.Seq,
+		"last_hash": last.Hash,
+		"last_time": last.Timestamp,
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/verify"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+// stateverify verifies an account or an exit served by the Hermez nodes.
+// With a batch number the exit proof of the account is checked against
+// the batch exit root of every node, otherwise the account state is
+// compared between the nodes
+func main() {
+	nodes := flag.String("nodes", "http://localhost:8086", "comma separated Hermez node URLs")
+	batch := flag.Uint64("batch", 0, "exit batch number, zero to verify the account state")
+	idx := flag.Uint64("idx", 0, "account index")
+	token := flag.String("token", "ETH", "account token symbol")
+	flag.Parse()
+
+	c, err := client.NewPool(strings.Split(*nodes, ","), client.Config{})
+	if err != nil {
+		logger.Fatal(err)
+	}
+	v := verify.New(c)
+	if *batch > 0 {
+		err = v.VerifyExit(hezCommon.BatchNum(*batch), hezCommon.Idx(*idx), *token)
+	} else {
+		err = v.VerifyAccount(verify.Account{Idx: hezCommon.Idx(*idx), TokenSymbol: *token})
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+}
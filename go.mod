@@ -12,12 +12,13 @@ require (
 	github.com/ethereum/go-ethereum v1.10.2
 	github.com/gballet/go-libpcsclite v0.0.0-20191108122812-4678299bea08 // indirect
 	github.com/go-ole/go-ole v1.2.5 // indirect
-	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/uuid v1.2.0 // indirect
 	github.com/hermeznetwork/hermez-node v1.0.0
+	github.com/hermeznetwork/tracerr v0.3.1-0.20210120162744-5da60b576169
 	github.com/iden3/go-iden3-crypto v0.0.6-0.20210308142348-8f85683b2cef
+	github.com/iden3/go-merkletree v0.0.0-20210308143313-8b63ca866189
 	github.com/jackpal/go-nat-pmp v1.0.2 // indirect
-	github.com/jmoiron/sqlx v1.3.1 // indirect
+	github.com/jmoiron/sqlx v1.3.1
 	github.com/karalabe/usb v0.0.0-20191104083709-911d15fe12a9 // indirect
 	github.com/karrick/godirwalk v1.16.1 // indirect
 	github.com/lib/pq v1.10.0 // indirect
@@ -26,6 +27,7 @@ require (
 	github.com/miguelmota/go-ethereum-hdwallet v0.0.1
 	github.com/mitchellh/mapstructure v1.4.1 // indirect
 	github.com/peterh/liner v1.2.1 // indirect
+	github.com/prometheus/client_golang v1.9.0
 	github.com/prometheus/tsdb v0.10.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/rubenv/sql-migrate v0.0.0-20210215143335-f84234893558 // indirect
@@ -33,10 +35,16 @@ require (
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/status-im/keycard-go v0.0.0-20200402102358-957c09536969 // indirect
 	github.com/tklauser/go-sysconf v0.3.5 // indirect
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 	go.uber.org/multierr v1.6.0 // indirect
 	golang.org/x/crypto v0.0.0-20210415154028-4f45737414dc // indirect
 	golang.org/x/net v0.0.0-20210415231046-e915ea6b2b7d // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
-	golang.org/x/sys v0.0.0-20210415045647-66c3f260301c // indirect
 	golang.org/x/term v0.0.0-20210317153231-de623e64d2a6 // indirect
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -0,0 +1,256 @@
+package grpcapi
+
+//go:generate protoc -I pb --go_out=pb --go_opt=paths=source_relative --go-grpc_out=pb --go-grpc_opt=paths=source_relative pb/wallet.proto
+
+import (
+	"context"
+	"net"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/api"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/grpcapi/pb"
+	"github.com/hermeznetwork/hermez-integration/track"
+	"github.com/hermeznetwork/hermez-integration/transaction"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// apiKeyMetadata is the API key metadata key
+	apiKeyMetadata = "x-api-key"
+	// streamBatchSize is the number of events sent by each feed read
+	streamBatchSize = 100
+	// executeProposalMethod is the method requiring an operator key
+	executeProposalMethod = "/hermez.integration.v1.WalletService/ExecuteProposal"
+)
+
+type (
+	// Server represents the gRPC wallet service. The address derivation
+	// and the txs are served by the wallet API server, so the REST and
+	// the gRPC services share the hot wallet nonces
+	Server struct {
+		pb.UnimplementedWalletServiceServer
+		wallet *api.Server
+		client *client.Client
+		feed   *track.Feed
+	}
+)
+
+// New creates a new gRPC wallet service
+func New(wallet *api.Server, c *client.Client, feed *track.Feed) *Server {
+	return &Server{wallet: wallet, client: c, feed: feed}
+}
+
+// Serve serves the gRPC wallet service on the address
+func (s *Server) Serve(addr string) func() error {
+	return func() error {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return errors.E("cannot listen the gRPC address", err, errors.Params{"addr": addr})
+		}
+		srv := grpc.NewServer(
+			grpc.UnaryInterceptor(s.unaryAuth),
+			grpc.StreamInterceptor(s.streamAuth),
+		)
+		pb.RegisterWalletServiceServer(srv, s)
+		logger.Info("gRPC server", logger.Params{"addr": addr})
+		return srv.Serve(lis)
+	}
+}
+
+// DeriveAddress derives the deposit address of a user wallet index
+func (s *Server) DeriveAddress(ctx context.Context, req *pb.DeriveAddressRequest) (*pb.Address, error) {
+	address, err := s.wallet.Address(ctx, int(req.GetIndex()))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.Address{
+		Index:              uint32(address.Index),
+		HezEthereumAddress: address.HezEthAddress,
+		HezBjjAddress:      address.HezBjjAddress,
+	}, nil
+}
+
+// GetAccountInfo returns the account idx and nonce of an address
+func (s *Server) GetAccountInfo(_ context.Context, req *pb.GetAccountInfoRequest) (*pb.AccountInfo, error) {
+	var bjjAddress, hezEthAddress *string
+	if req.GetHezBjjAddress() != "" {
+		bjjAddress = &req.HezBjjAddress
+	}
+	if req.GetHezEthereumAddress() != "" {
+		hezEthAddress = &req.HezEthereumAddress
+	}
+	if bjjAddress == nil && hezEthAddress == nil {
+		return nil, status.Error(codes.InvalidArgument, "hez BJJ address or hez eth address must be defined")
+	}
+	idx, nonce, err := transaction.GetAccountInfo(s.client, bjjAddress, hezEthAddress,
+		hezCommon.TokenID(req.GetTokenId()))
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return &pb.AccountInfo{AccountIndex: uint64(idx), Nonce: uint64(nonce)}, nil
+}
+
+// SendTransaction signs and sends a tx from the hot wallet
+func (s *Server) SendTransaction(ctx context.Context, req *pb.SendTransactionRequest) (*pb.SendTransactionResponse, error) {
+	withdrawal := api.WithdrawalRequest{
+		Recipient: req.GetRecipient(),
+		Token:     req.GetToken(),
+		Amount:    req.GetAmount(),
+		Exit:      req.GetExit(),
+	}
+	if req.Fee != nil {
+		if req.GetFee() > 255 {
+			return nil, status.Error(codes.InvalidArgument, "invalid fee selector")
+		}
+		fee := hezCommon.FeeSelector(req.GetFee())
+		withdrawal.Fee = &fee
+	}
+	sent, err := s.wallet.Withdraw(ctx, withdrawal)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.SendTransactionResponse{
+		TxId:       sent.TxID,
+		Type:       string(sent.Type),
+		Nonce:      uint64(sent.Nonce),
+		ProposalId: sent.ProposalID,
+	}, nil
+}
+
+// ExecuteProposal signs and sends the tx of an approved proposal from the
+// hot wallet, the operator of the key is recorded as the executor
+func (s *Server) ExecuteProposal(ctx context.Context, req *pb.ExecuteProposalRequest) (*pb.ExecuteProposalResponse, error) {
+	operator, err := s.operator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.wallet.ExecuteProposal(ctx, req.GetProposalId(), operator)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.ExecuteProposalResponse{TxId: p.TxID, Status: string(p.Status)}, nil
+}
+
+// StreamEvents streams the deposits and tx status changes after the
+// cursor, waiting for new events until the client cancels the stream
+func (s *Server) StreamEvents(req *pb.StreamEventsRequest, stream pb.WalletService_StreamEventsServer) error {
+	cursor := req.GetCursor()
+	for {
+		// get the wait channel before read, so no event is missed
+		wait := s.feed.Wait()
+		events := s.feed.EventsSince(cursor, streamBatchSize)
+		for _, e := range events {
+			if err := stream.Send(toEvent(e)); err != nil {
+				return err
+			}
+			cursor = e.Cursor
+		}
+		if len(events) == streamBatchSize {
+			continue
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-wait:
+		}
+	}
+}
+
+// unaryAuth checks the API key of the unary calls, the operator calls
+// check the operator key
+func (s *Server) unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if info.FullMethod == executeProposalMethod {
+		if _, err := s.operator(ctx); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamAuth checks the API key of the streaming calls
+func (s *Server) streamAuth(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	if err := s.authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// authorize checks the API key metadata
+func (s *Server) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(apiKeyMetadata)
+	if len(keys) == 0 || !s.wallet.ValidKey(keys[0]) {
+		return status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	return nil
+}
+
+// operator returns the operator of the API key metadata
+func (s *Server) operator(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(apiKeyMetadata)
+	if len(keys) == 0 {
+		return "", status.Error(codes.Unauthenticated, "invalid operator API key")
+	}
+	operator, ok := s.wallet.Operator(keys[0])
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "invalid operator API key")
+	}
+	return operator, nil
+}
+
+// toStatus converts a wallet API error to a gRPC status
+func toStatus(err error) error {
+	if _, ok := err.(*api.RequestError); ok {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, ok := err.(*api.NodeError); ok {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.FailedPrecondition, err.Error())
+}
+
+// toEvent converts a feed event to a protobuf event
+func toEvent(e track.Event) *pb.Event {
+	event := &pb.Event{Cursor: e.Cursor}
+	switch {
+	case e.Deposit != nil:
+		d := e.Deposit
+		event.Event = &pb.Event_Deposit{Deposit: &pb.Deposit{
+			TxId:                   d.TxID,
+			BatchNum:               uint64(d.BatchNum),
+			TokenId:                uint32(d.TokenID),
+			TokenSymbol:            d.TokenSymbol,
+			Amount:                 d.Amount,
+			ToAccountIndex:         uint64(d.ToIdx),
+			ToHezEthereumAddress:   d.ToEthAddr,
+			ToBjj:                  d.ToBJJ,
+			FromHezEthereumAddress: d.FromEthAddr,
+			Timestamp:              d.Timestamp.Unix(),
+			Kind:                   string(d.Kind),
+			LoadAmount:             d.LoadAmount,
+			Status:                 string(d.Status),
+		}}
+	case e.TxStatus != nil:
+		t := e.TxStatus
+		event.Event = &pb.Event_TxStatus{TxStatus: &pb.TxStatus{
+			TxId:      t.TxID,
+			State:     string(t.State),
+			BatchNum:  uint64(t.BatchNum),
+			Timestamp: t.Timestamp.Unix(),
+		}}
+	}
+	return event
+}
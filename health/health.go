@@ -0,0 +1,226 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/client"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// StatusOK represents a passing check
+	StatusOK = "ok"
+	// StatusFail represents a failing check
+	StatusFail = "fail"
+)
+
+type (
+	// Check returns an error if the component is not healthy
+	Check func() error
+
+	// Checker represents the liveness and readiness checks of the
+	// integration daemon
+	Checker struct {
+		mu        sync.RWMutex
+		started   bool
+		liveness  map[string]Check
+		readiness map[string]Check
+		info      map[string]interface{}
+	}
+
+	// Report represents the health endpoints response
+	Report struct {
+		Status string                 `json:"status"`
+		Checks map[string]CheckResult `json:"checks"`
+		Info   map[string]interface{} `json:"info,omitempty"`
+	}
+
+	// CheckResult represents a check result
+	CheckResult struct {
+		Status string `json:"status"`
+		Error  string `json:"error,omitempty"`
+	}
+)
+
+// New creates a new health checker. The readiness fails until Started is
+// called
+func New() *Checker {
+	return &Checker{
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
+		info:      make(map[string]interface{}),
+	}
+}
+
+// AddLiveness adds a liveness check, a failing liveness means the process
+// must be restarted
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.liveness[name] = check
+}
+
+// AddReadiness adds a readiness check, a failing readiness means the
+// process is alive but cannot serve yet
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readiness[name] = check
+}
+
+// SetInfo sets a static value reported by the endpoints, e.g.: the
+// configured network profile
+func (c *Checker) SetInfo(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.info[key] = value
+}
+
+// Started marks the daemon start up as finished
+func (c *Checker) Started() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started = true
+}
+
+// Go wraps a long running task (e.g.: a tracker) and adds a liveness check
+// failing if the task returns an error
+func (c *Checker) Go(name string, task func() error) func() error {
+	var (
+		mu      sync.RWMutex
+		exitErr error
+	)
+	c.AddLiveness(name, func() error {
+		mu.RLock()
+		defer mu.RUnlock()
+		return exitErr
+	})
+	return func() error {
+		err := task()
+		if err != nil {
+			mu.Lock()
+			exitErr = errors.E("task exited", err, errors.Params{"task": name})
+			mu.Unlock()
+		}
+		logger.Info("Task finished", logger.Params{"task": name, "error": err != nil})
+		return err
+	}
+}
+
+// Liveness runs the liveness checks
+func (c *Checker) Liveness() Report {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.run(c.liveness)
+}
+
+// Readiness runs the liveness and readiness checks
+func (c *Checker) Readiness() Report {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	checks := make(map[string]Check, len(c.liveness)+len(c.readiness)+1)
+	for name, check := range c.liveness {
+		checks[name] = check
+	}
+	for name, check := range c.readiness {
+		checks[name] = check
+	}
+	started := c.started
+	checks["startup"] = func() error {
+		if !started {
+			return errors.E("start up not finished")
+		}
+		return nil
+	}
+	return c.run(checks)
+}
+
+// run executes the checks, the caller must hold the lock
+func (c *Checker) run(checks map[string]Check) Report {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult), Info: c.info}
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			report.Status = StatusFail
+			report.Checks[name] = CheckResult{Status: StatusFail, Error: err.Error()}
+			continue
+		}
+		report.Checks[name] = CheckResult{Status: StatusOK}
+	}
+	return report
+}
+
+// Routes adds the /healthz and /readyz endpoints to the mux
+func (c *Checker) Routes(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Liveness())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeReport(w, c.Readiness())
+	})
+}
+
+// writeReport writes the report as JSON, failing reports return 503
+func writeReport(w http.ResponseWriter, report Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger.Error(errors.E("cannot write the health report", err))
+	}
+}
+
+// NodesCheck fails if no node is reachable
+func NodesCheck(c *client.Client) Check {
+	return func() error {
+		for _, n := range c.Nodes() {
+			if n.Healthy && !n.CircuitOpen {
+				return nil
+			}
+		}
+		return errors.E("no node reachable")
+	}
+}
+
+// BatchLagCheck fails if the scanned batch is more than maxLag batches
+// behind the last batch
+func BatchLagCheck(c client.BatchReader, scanned func() hezCommon.BatchNum, maxLag hezCommon.BatchNum) Check {
+	return func() error {
+		last, err := c.GetLastBatch()
+		if err != nil {
+			return err
+		}
+		if lag := last.BatchNum - scanned(); lag > maxLag {
+			return errors.E("tracker lagging behind",
+				errors.Params{"lag": lag, "max_lag": maxLag, "last_batch": last.BatchNum})
+		}
+		return nil
+	}
+}
+
+// StaleCheck fails if the last update is older than maxAge. A zero last
+// update passes, the component didn't run yet
+func StaleCheck(lastUpdate func() time.Time, maxAge time.Duration) Check {
+	return func() error {
+		last := lastUpdate()
+		if last.IsZero() {
+			return nil
+		}
+		if age := time.Since(last); age > maxAge {
+			return errors.E("component stale", errors.Params{"age": age.String(), "max_age": maxAge.String()})
+		}
+		return nil
+	}
+}
@@ -0,0 +1,191 @@
+package hermez
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/Pantani/errors"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+const (
+	// maxRqOffset is the maximum forward distance between linked txs
+	maxRqOffset = 3
+	// minRqOffset is the maximum backward distance between linked txs
+	minRqOffset = -4
+)
+
+type (
+	// AtomicTx represents a tx of an atomic group before being signed.
+	// The recipient is the ToIdx, the ToBJJ or the ToEthAddr, in this order
+	AtomicTx struct {
+		FromIdx   hezCommon.Idx
+		ToIdx     hezCommon.Idx
+		ToEthAddr string
+		ToBJJ     string
+		TokenID   hezCommon.TokenID
+		Amount    *big.Int
+		Fee       hezCommon.FeeSelector
+		Nonce     hezCommon.Nonce
+		// RqPosition is the position into the group of the linked tx
+		RqPosition int
+	}
+)
+
+// NewAtomicSwap create the unsigned linked txs for an atomic swap between
+// two counterparties. Each party must sign its own tx with SignTx before
+// send the group
+func NewAtomicSwap(a, b AtomicTx) ([]*hezCommon.PoolL2Tx, error) {
+	a.RqPosition = 1
+	b.RqPosition = 0
+	return NewAtomicGroup([]AtomicTx{a, b})
+}
+
+// NewAtomicGroup create the unsigned txs of an atomic group, setting the
+// request (Rq) fields of each tx with the tx from the RqPosition. The
+// coordinator must forge all txs in the same batch or none of them
+func NewAtomicGroup(atomicTxs []AtomicTx) ([]*hezCommon.PoolL2Tx, error) {
+	txs := make([]*hezCommon.PoolL2Tx, 0, len(atomicTxs))
+	for i, atomicTx := range atomicTxs {
+		tx, err := atomicTx.newTxObject()
+		if err != nil {
+			return nil, errors.E("invalid atomic tx", err, errors.Params{"position": i})
+		}
+		txs = append(txs, tx)
+	}
+	for i, atomicTx := range atomicTxs {
+		pos := atomicTx.RqPosition
+		if pos < 0 || pos >= len(txs) || pos == i {
+			return nil, errors.E("invalid atomic tx request position",
+				errors.Params{"position": i, "rq_position": pos})
+		}
+		linkTx(txs[i], txs[pos])
+	}
+	return txs, ValidateAtomicGroup(txs, false)
+}
+
+// ValidateAtomicGroup check if the atomic group is consistent: all txs must
+// request another tx of the group and be requested by one, the request
+// fields must match the requested tx and the distance between linked txs
+// must fit into the RqOffset. If signed is true, all txs must be signed
+func ValidateAtomicGroup(txs []*hezCommon.PoolL2Tx, signed bool) error {
+	if len(txs) < 2 {
+		return errors.E("atomic group must have at least two txs")
+	}
+	ids := make(map[hezCommon.TxID]int)
+	for i, tx := range txs {
+		if _, ok := ids[tx.TxID]; ok {
+			return errors.E("duplicated tx into the atomic group",
+				errors.Params{"tx_id": tx.TxID.String()})
+		}
+		ids[tx.TxID] = i
+	}
+
+	requested := make(map[int]bool)
+	for i, tx := range txs {
+		params := errors.Params{"position": i, "tx_id": tx.TxID.String()}
+		if signed && tx.Signature == (babyjub.SignatureComp{}) {
+			return errors.E("atomic tx not signed", params)
+		}
+		pos, err := requestedPosition(txs, tx)
+		if err != nil {
+			return errors.E(err, params)
+		}
+		if pos == i {
+			return errors.E("atomic tx requests itself", params)
+		}
+		if _, err := RqOffset(i, pos); err != nil {
+			return errors.E(err, params)
+		}
+		if !isRequestOf(tx, txs[pos]) {
+			return errors.E("atomic tx request fields mismatch", params,
+				errors.Params{"rq_position": pos})
+		}
+		requested[pos] = true
+	}
+	for i, tx := range txs {
+		if !requested[i] {
+			return errors.E("atomic tx not requested by the group",
+				errors.Params{"position": i, "tx_id": tx.TxID.String()})
+		}
+	}
+	return nil
+}
+
+// RqOffset returns the 3 bits RqOffset of a tx at the position linked to
+// the tx at the rqPosition, as defined by the Hermez protocol: values 1
+// to 3 are the next txs and 4 to 7 are the previous four txs
+func RqOffset(position, rqPosition int) (uint8, error) {
+	diff := rqPosition - position
+	if diff == 0 || diff > maxRqOffset || diff < minRqOffset {
+		return 0, errors.E("linked tx out of the RqOffset range",
+			errors.Params{"position": position, "rq_position": rqPosition})
+	}
+	if diff > 0 {
+		return uint8(diff), nil
+	}
+	return uint8(8 + diff), nil
+}
+
+// newTxObject create the tx object for the atomic tx recipient
+func (a AtomicTx) newTxObject() (*hezCommon.PoolL2Tx, error) {
+	switch {
+	case a.ToIdx > 0:
+		return newTxObject(hezCommon.EmptyBJJComp, hezCommon.FFAddr, a.Amount,
+			a.FromIdx, a.ToIdx, a.TokenID, a.Nonce, a.Fee, hezCommon.TxTypeTransfer)
+	case a.ToBJJ != "":
+		toBjj, err := HezStrToBJJ(a.ToBJJ)
+		if err != nil {
+			return nil, err
+		}
+		return newTxObject(toBjj, hezCommon.FFAddr, a.Amount, a.FromIdx,
+			hezCommon.Idx(0), a.TokenID, a.Nonce, a.Fee, hezCommon.TxTypeTransferToBJJ)
+	case a.ToEthAddr != "":
+		toEthAddr := ethCommon.HexToAddress(strings.TrimPrefix(a.ToEthAddr, "hez:"))
+		return newTxObject(hezCommon.EmptyBJJComp, toEthAddr, a.Amount, a.FromIdx,
+			hezCommon.Idx(0), a.TokenID, a.Nonce, a.Fee, hezCommon.TxTypeTransferToEthAddr)
+	default:
+		return nil, errors.E("atomic tx recipient not defined")
+	}
+}
+
+// linkTx set the request fields of the tx with the requested tx
+func linkTx(tx, rq *hezCommon.PoolL2Tx) {
+	tx.RqFromIdx = rq.FromIdx
+	tx.RqToIdx = rq.ToIdx
+	tx.RqToEthAddr = rq.ToEthAddr
+	tx.RqToBJJ = rq.ToBJJ
+	tx.RqTokenID = rq.TokenID
+	tx.RqAmount = new(big.Int).Set(rq.Amount)
+	tx.RqFee = rq.Fee
+	tx.RqNonce = rq.Nonce
+}
+
+// requestedPosition returns the position of the tx requested by the tx
+func requestedPosition(txs []*hezCommon.PoolL2Tx, tx *hezCommon.PoolL2Tx) (int, error) {
+	if tx.RqFromIdx == 0 {
+		return 0, errors.E("atomic tx without request")
+	}
+	for i, rq := range txs {
+		if rq.FromIdx == tx.RqFromIdx && rq.Nonce == tx.RqNonce {
+			return i, nil
+		}
+	}
+	return 0, errors.E("requested tx not found into the atomic group",
+		errors.Params{"rq_from_idx": tx.RqFromIdx, "rq_nonce": tx.RqNonce})
+}
+
+// isRequestOf check if all request fields of the tx match the rq tx
+func isRequestOf(tx, rq *hezCommon.PoolL2Tx) bool {
+	return tx.RqFromIdx == rq.FromIdx &&
+		tx.RqToIdx == rq.ToIdx &&
+		tx.RqToEthAddr == rq.ToEthAddr &&
+		tx.RqToBJJ == rq.ToBJJ &&
+		tx.RqTokenID == rq.TokenID &&
+		tx.RqAmount != nil && rq.Amount != nil &&
+		tx.RqAmount.Cmp(rq.Amount) == 0 &&
+		tx.RqFee == rq.Fee &&
+		tx.RqNonce == rq.Nonce
+}
@@ -0,0 +1,90 @@
+package hermez
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/Pantani/errors"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-integration/audit"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+var (
+	auditMu  sync.RWMutex
+	auditLog *audit.Log
+)
+
+// SetAuditLog sets the audit log recording every signature. Once set, a
+// signature is not returned if it cannot be recorded
+func SetAuditLog(l *audit.Log) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditLog = l
+}
+
+// auditRecord appends a record to the audit log, if set
+func auditRecord(r audit.Record) error {
+	auditMu.RLock()
+	defer auditMu.RUnlock()
+	if auditLog == nil {
+		return nil
+	}
+	if err := auditLog.Append(r); err != nil {
+		return errors.E("cannot audit the signature", err,
+			errors.Params{"operation": r.Operation, "tx_id": r.TxID})
+	}
+	return nil
+}
+
+// auditTx records a L2 tx signature
+func auditTx(chainID uint16, tx *hezCommon.PoolL2Tx, toSign *big.Int, privateKey babyjub.PrivateKey) error {
+	tokenID := uint32(tx.TokenID)
+	fee := uint8(tx.Fee)
+	nonce := uint64(tx.Nonce)
+	r := audit.Record{
+		Signer:     NewHezBJJ(privateKey.Public().Compress()),
+		Operation:  audit.OperationL2Tx,
+		ChainID:    chainID,
+		HashToSign: toSign.String(),
+		TxID:       tx.TxID.String(),
+		TxType:     string(tx.Type),
+		FromIdx:    tx.FromIdx.String(),
+		TokenID:    &tokenID,
+		Fee:        &fee,
+		Nonce:      &nonce,
+		Recipient:  txRecipient(tx),
+	}
+	if tx.Amount != nil {
+		r.Amount = tx.Amount.String()
+	}
+	return auditRecord(r)
+}
+
+// auditAccountAuth records an account creation authorization signature
+func auditAccountAuth(chainID uint16, auth *hezCommon.AccountCreationAuth, hash []byte) error {
+	return auditRecord(audit.Record{
+		Signer:     "hez:" + auth.EthAddr.String(),
+		Operation:  audit.OperationAccountAuth,
+		ChainID:    chainID,
+		HashToSign: ethCommon.Bytes2Hex(hash),
+		Recipient:  NewHezBJJ(auth.BJJ),
+	})
+}
+
+// txRecipient returns the recipient of a L2 tx: the exit tree, the idx,
+// the hez eth address or the hez BJJ address
+func txRecipient(tx *hezCommon.PoolL2Tx) string {
+	switch {
+	case tx.Type == hezCommon.TxTypeExit:
+		return "exit"
+	case tx.ToIdx != 0:
+		return tx.ToIdx.String()
+	case tx.ToEthAddr != hezCommon.EmptyAddr && tx.ToEthAddr != hezCommon.FFAddr:
+		return "hez:" + tx.ToEthAddr.String()
+	case tx.ToBJJ != hezCommon.EmptyBJJComp:
+		return NewHezBJJ(tx.ToBJJ)
+	}
+	return ""
+}
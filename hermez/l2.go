@@ -1,25 +1,29 @@
 package hermez
 
 import (
+	"context"
 	"math/big"
 
+	"github.com/Pantani/errors"
 	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-integration/tracing"
 	hezCommon "github.com/hermeznetwork/hermez-node/common"
 	"github.com/iden3/go-iden3-crypto/babyjub"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // CreateTransfer create a L2 transfer to baby jubjub transaction
-func CreateTransfer(chainID uint16, toIdx hezCommon.Idx, amount *big.Int, privateKey babyjub.PrivateKey,
+func CreateTransfer(ctx context.Context, chainID uint16, toIdx hezCommon.Idx, amount *big.Int, privateKey babyjub.PrivateKey,
 	fromIdx hezCommon.Idx, tokenID hezCommon.TokenID, nonce hezCommon.Nonce,
 	fee hezCommon.FeeSelector) (*hezCommon.PoolL2Tx, error) {
 
-	return createTxObject(chainID, hezCommon.EmptyBJJComp,
+	return createTxObject(ctx, chainID, hezCommon.EmptyBJJComp,
 		hezCommon.FFAddr, amount, privateKey, fromIdx, toIdx,
 		tokenID, nonce, fee, hezCommon.TxTypeTransfer)
 }
 
 // CreateTransferToBjj create a L2 transfer to baby jubjub transaction
-func CreateTransferToBjj(chainID uint16, to string, amount *big.Int, privateKey babyjub.PrivateKey,
+func CreateTransferToBjj(ctx context.Context, chainID uint16, to string, amount *big.Int, privateKey babyjub.PrivateKey,
 	fromIdx hezCommon.Idx, tokenID hezCommon.TokenID, nonce hezCommon.Nonce,
 	fee hezCommon.FeeSelector) (*hezCommon.PoolL2Tx, error) {
 
@@ -28,36 +32,58 @@ func CreateTransferToBjj(chainID uint16, to string, amount *big.Int, privateKey
 		return nil, err
 	}
 
-	return createTxObject(chainID, toBjj, hezCommon.FFAddr,
+	return createTxObject(ctx, chainID, toBjj, hezCommon.FFAddr,
 		amount, privateKey, fromIdx, hezCommon.Idx(0),
 		tokenID, nonce, fee, hezCommon.TxTypeTransferToBJJ)
 }
 
 // CreateTransferToEthAddress create a L2 transfer to eth address transaction
-func CreateTransferToEthAddress(chainID uint16, to string, amount *big.Int, privateKey babyjub.PrivateKey,
+func CreateTransferToEthAddress(ctx context.Context, chainID uint16, to string, amount *big.Int, privateKey babyjub.PrivateKey,
 	fromIdx hezCommon.Idx, tokenID hezCommon.TokenID, nonce hezCommon.Nonce,
 	fee hezCommon.FeeSelector) (*hezCommon.PoolL2Tx, error) {
 
 	toEthAddr := ethCommon.HexToAddress(to)
-	return createTxObject(chainID, hezCommon.EmptyBJJComp, toEthAddr,
+	return createTxObject(ctx, chainID, hezCommon.EmptyBJJComp, toEthAddr,
 		amount, privateKey, fromIdx, hezCommon.Idx(0),
 		tokenID, nonce, fee, hezCommon.TxTypeTransferToEthAddr)
 }
 
 // CreateExit create a L2 exit transaction
-func CreateExit(chainID uint16, amount *big.Int, privateKey babyjub.PrivateKey,
+func CreateExit(ctx context.Context, chainID uint16, amount *big.Int, privateKey babyjub.PrivateKey,
 	fromIdx hezCommon.Idx, tokenID hezCommon.TokenID, nonce hezCommon.Nonce,
 	fee hezCommon.FeeSelector) (*hezCommon.PoolL2Tx, error) {
 
-	return createTxObject(chainID, hezCommon.EmptyBJJComp, hezCommon.FFAddr,
+	return createTxObject(ctx, chainID, hezCommon.EmptyBJJComp, hezCommon.FFAddr,
 		amount, privateKey, fromIdx, hezCommon.Idx(1),
 		tokenID, nonce, fee, hezCommon.TxTypeExit)
 }
 
-// createTxObject create and validate the transaction object
-func createTxObject(chainID uint16, toBjj babyjub.PublicKeyComp, toEthAddr ethCommon.Address,
+// createTxObject create, validate and sign the transaction object
+func createTxObject(ctx context.Context, chainID uint16, toBjj babyjub.PublicKeyComp, toEthAddr ethCommon.Address,
 	amount *big.Int, privateKey babyjub.PrivateKey, fromIdx, toIdx hezCommon.Idx, tokenID hezCommon.TokenID,
-	nonce hezCommon.Nonce, fee hezCommon.FeeSelector, txType hezCommon.TxType) (*hezCommon.PoolL2Tx, error) {
+	nonce hezCommon.Nonce, fee hezCommon.FeeSelector, txType hezCommon.TxType) (tx *hezCommon.PoolL2Tx, err error) {
+	_, span := tracing.Start(ctx, "hermez.createTxObject",
+		attribute.String("hermez.tx_type", string(txType)),
+		attribute.Int64("hermez.from_idx", int64(fromIdx)),
+		attribute.Int64("hermez.nonce", int64(nonce)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	tx, err = newTxObject(toBjj, toEthAddr, amount, fromIdx, toIdx, tokenID, nonce, fee, txType)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.String("hermez.tx_id", tx.TxID.String()))
+	if err := SignTx(chainID, tx, privateKey); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// newTxObject create and validate the transaction object without sign
+func newTxObject(toBjj babyjub.PublicKeyComp, toEthAddr ethCommon.Address, amount *big.Int,
+	fromIdx, toIdx hezCommon.Idx, tokenID hezCommon.TokenID, nonce hezCommon.Nonce,
+	fee hezCommon.FeeSelector, txType hezCommon.TxType) (*hezCommon.PoolL2Tx, error) {
 
 	// Create the l2 tx object
 	tx := &hezCommon.PoolL2Tx{
@@ -78,17 +104,60 @@ func createTxObject(chainID uint16, toBjj babyjub.PublicKeyComp, toEthAddr ethCo
 	}
 
 	// Set tx type and id
-	tx, err := hezCommon.NewPoolL2Tx(tx)
+	return hezCommon.NewPoolL2Tx(tx)
+}
+
+// SignTx sign the transaction object with the baby jubjub private key.
+// The request (Rq) fields must be set before sign. The signature is
+// recorded into the audit log, if set
+func SignTx(chainID uint16, tx *hezCommon.PoolL2Tx, privateKey babyjub.PrivateKey) error {
+	toSign, err := tx.HashToSign(chainID)
+	if err != nil {
+		return err
+	}
+	sig := privateKey.SignPoseidon(toSign)
+	if err := auditTx(chainID, tx, toSign, privateKey); err != nil {
+		return err
+	}
+	tx.Signature = sig.Compress()
+	return nil
+}
+
+// MaxTransferAmount returns the biggest amount, representable as Float40,
+// that can be transferred from the balance paying the fee selector on top
+func MaxTransferAmount(balance *big.Int, fee hezCommon.FeeSelector) (*big.Int, error) {
+	const feeFactorShift = 60
+	if fee >= 192 {
+		return nil, errors.E("fee selector not supported for max amount",
+			errors.Params{"fee": fee})
+	}
+	if balance == nil || balance.Sign() <= 0 {
+		return big.NewInt(0), nil
+	}
+
+	// amount = balance / (1 + feeFactor)
+	one := new(big.Int).Lsh(big.NewInt(1), feeFactorShift)
+	divisor := new(big.Int).Add(one, hezCommon.FeeFactorLsh60[int(fee)])
+	amount := new(big.Int).Mul(balance, one)
+	amount.Div(amount, divisor)
+
+	// Round down to a valid Float40 value
+	f40, err := hezCommon.NewFloat40Floor(amount)
+	if err != nil {
+		return nil, err
+	}
+	amount, err = f40.BigInt()
 	if err != nil {
 		return nil, err
 	}
 
-	// Sign tx
-	toSign, err := tx.HashToSign(chainID)
+	feeAmount, err := hezCommon.CalcFeeAmount(amount, fee)
 	if err != nil {
 		return nil, err
 	}
-	sig := privateKey.SignPoseidon(toSign)
-	tx.Signature = sig.Compress()
-	return tx, nil
+	if new(big.Int).Add(amount, feeAmount).Cmp(balance) > 0 {
+		return nil, errors.E("not enough balance to pay the fee",
+			errors.Params{"balance": balance.String(), "fee": fee})
+	}
+	return amount, nil
 }
@@ -1,10 +1,12 @@
 package hermez
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"math/big"
+	"strconv"
 	"strings"
 
 	"github.com/Pantani/errors"
@@ -13,9 +15,11 @@ import (
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	ethCrypto "github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/hermeznetwork/hermez-integration/tracing"
 	hezCommon "github.com/hermeznetwork/hermez-node/common"
 	"github.com/iden3/go-iden3-crypto/babyjub"
 	hdwallet "github.com/miguelmota/go-ethereum-hdwallet"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
@@ -31,19 +35,49 @@ type (
 	// Wallet represents a wallet object with a private key,
 	// public key and a baby jubjub hez address
 	Wallet struct {
+		// Index is the wallet derivation index
+		Index         int
 		PrivateKey    babyjub.PrivateKey
 		PublicKey     babyjub.PublicKeyComp
 		HezBjjAddress string
 		HezEthAddress string
 		Signature     string
 	}
+
+	// Recipient represents a parsed L2 transfer recipient
+	Recipient struct {
+		Type hezCommon.TxType
+		// Idx is the account index for transfers
+		Idx hezCommon.Idx
+		// TokenSymbol is the symbol from the hez account index, if defined
+		TokenSymbol string
+		// EthAddr is the hez eth address for transfers to eth address
+		EthAddr string
+		// BJJ is the hez BJJ address for transfers to baby jubjub
+		BJJ string
+	}
 )
 
 // NewBJJ create a baby jubjub address from the mnemonic
 // and the derivation path. It returns a wallet object
 // with a private key, public key and a baby jubjub hez
 // address and a error if occurs.
-func NewBJJ(mnemonic string, index int, chainID uint16,
+func NewBJJ(ctx context.Context, mnemonic string, index int, chainID uint16,
+	rollupContract ethCommon.Address) (*Wallet, error) {
+	_, span := tracing.Start(ctx, "hermez.NewBJJ",
+		attribute.Int("hermez.wallet_index", index),
+		attribute.Int("hermez.chain_id", int(chainID)),
+	)
+	w, err := newBJJ(mnemonic, index, chainID, rollupContract)
+	if err == nil {
+		span.SetAttributes(attribute.String("hermez.eth_address", w.HezEthAddress))
+	}
+	tracing.End(span, err)
+	return w, err
+}
+
+// newBJJ derives the wallet from the mnemonic
+func newBJJ(mnemonic string, index int, chainID uint16,
 	rollupContract ethCommon.Address) (*Wallet, error) {
 	w, err := hdwallet.NewFromMnemonic(mnemonic)
 	if err != nil {
@@ -95,6 +129,7 @@ func NewBJJ(mnemonic string, index int, chainID uint16,
 	}
 
 	return &Wallet{
+		Index:         index,
 		PrivateKey:    sk,
 		PublicKey:     pk,
 		HezBjjAddress: hezBjjAddress,
@@ -133,6 +168,9 @@ func createSignature(wallet *hdwallet.Wallet, ethAccount accounts.Account,
 	if !auth.VerifySignature(chainID, rollupContract) {
 		return "", errors.E("invalid signature")
 	}
+	if err := auditAccountAuth(chainID, auth, hash); err != nil {
+		return "", err
+	}
 	return hexutil.Encode(signature), nil
 }
 
@@ -178,7 +216,9 @@ func HezStrToBJJ(s string) (babyjub.PublicKeyComp, error) {
 	return bjjComp, nil
 }
 
-// WeiToEther converts a wei value (*big.Int) to a ether value (*big.Float)
+// WeiToEther converts a wei value (*big.Int) to a ether value (*big.Float).
+// It assumes the 18 decimals of ETH, use tokens.FormatUnits with the token
+// decimals for the other tokens
 func WeiToEther(wei *big.Int) *big.Float {
 	f := new(big.Float)
 	f.SetPrec(236)
@@ -188,3 +228,53 @@ func WeiToEther(wei *big.Int) *big.Float {
 	fWei.SetMode(big.ToNearestEven)
 	return f.Quo(fWei.SetInt(wei), big.NewFloat(params.Ether))
 }
+
+// HezStrToIdx convert a hez account index (hez:ETH:1234) to the idx
+// and the token symbol
+func HezStrToIdx(s string) (hezCommon.Idx, string, error) {
+	const expectedLen = 3
+	splitted := strings.Split(s, ":")
+	if len(splitted) != expectedLen || splitted[0] != "hez" || splitted[1] == "" {
+		return 0, "", errors.E("invalid idx format. Must follow this regex: ^hez:[a-zA-Z0-9]{2,6}:[0-9]{0,9}$",
+			errors.Params{"idx": s})
+	}
+	idx, err := strconv.ParseUint(splitted[2], 10, 48)
+	if err != nil {
+		return 0, "", errors.E("invalid idx number", err, errors.Params{"idx": s})
+	}
+	return hezCommon.Idx(idx), splitted[1], nil
+}
+
+// ParseRecipient parse a recipient string, that can be a hez eth address
+// (hez:0x...), a hez BJJ address (hez:<bjj>) or an account index
+// (hez:ETH:256 or 256), and returns the L2 transfer type to reach it
+func ParseRecipient(s string) (Recipient, error) {
+	addr := strings.TrimPrefix(s, "hez:")
+	if ethCommon.IsHexAddress(addr) {
+		return Recipient{
+			Type:    hezCommon.TxTypeTransferToEthAddr,
+			EthAddr: "hez:" + ethCommon.HexToAddress(addr).String(),
+		}, nil
+	}
+
+	r := Recipient{Type: hezCommon.TxTypeTransfer}
+	if n, err := strconv.ParseUint(addr, 10, 48); err == nil {
+		r.Idx = hezCommon.Idx(n)
+	} else if strings.Count(s, ":") == 2 {
+		r.Idx, r.TokenSymbol, err = HezStrToIdx(s)
+		if err != nil {
+			return Recipient{}, err
+		}
+	} else {
+		if _, err := HezStrToBJJ(s); err != nil {
+			return Recipient{}, err
+		}
+		return Recipient{Type: hezCommon.TxTypeTransferToBJJ, BJJ: "hez:" + addr}, nil
+	}
+
+	if r.Idx < hezCommon.IdxUserThreshold {
+		return Recipient{}, errors.E("recipient idx is not an user account",
+			errors.Params{"idx": r.Idx})
+	}
+	return r, nil
+}
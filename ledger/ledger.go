@@ -0,0 +1,427 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/track"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// KindOpening represents an opening balance entry
+	KindOpening Kind = "opening"
+	// KindDeposit represents an incoming deposit entry
+	KindDeposit Kind = "deposit"
+	// KindWithdrawal represents an outgoing tx entry
+	KindWithdrawal Kind = "withdrawal"
+	// KindFee represents an outgoing tx fee entry
+	KindFee Kind = "fee"
+	// KindReversal represents the reversal of an entry of a tx rejected
+	// by the pool
+	KindReversal Kind = "reversal"
+
+	// AccountExternal is the counterpart of deposits and withdrawals
+	AccountExternal = "external"
+	// AccountFees is the account of the paid fees
+	AccountFees = "fees"
+	// AccountEquity is the counterpart of the opening balances
+	AccountEquity = "equity"
+	// idxAccountPrefix is the prefix of the rollup accounts
+	idxAccountPrefix = "idx:"
+	// reversalPrefix is the ref prefix of the reversal entries, followed
+	// by the reversed entry ref
+	reversalPrefix = "reversal:"
+)
+
+type (
+	// Ledger represents an internal double-entry ledger of the rollup
+	// accounts. Entries are appended to a JSON lines journal
+	Ledger struct {
+		mu       sync.RWMutex
+		journal  *os.File
+		refs     map[string]bool
+		balances map[string]map[hezCommon.TokenID]*big.Int
+		// outgoing keeps the outgoing txs not reversed by withdrawal
+		// entry ref
+		outgoing map[string]outgoingTx
+		// entries keeps the postings of the withdrawal and fee entries by
+		// ref, to reverse them
+		entries map[string]Entry
+		// incoming keeps the deposits forged and not final yet by deposit
+		// ref, they are into the on-chain balance but not into the ledger
+		incoming map[string]incomingDeposit
+	}
+
+	// incomingDeposit represents a forged deposit waiting to be final
+	incomingDeposit struct {
+		idx     hezCommon.Idx
+		tokenID hezCommon.TokenID
+		amount  *big.Int
+	}
+
+	// outgoingTx represents an outgoing tx recorded into the ledger
+	outgoingTx struct {
+		idx       hezCommon.Idx
+		nonce     hezCommon.Nonce
+		timestamp time.Time
+	}
+
+	// Entry represents a ledger entry, the postings amounts sum zero
+	Entry struct {
+		Ref       string            `json:"ref"`
+		Kind      Kind              `json:"kind"`
+		TokenID   hezCommon.TokenID `json:"tokenId"`
+		Postings  []Posting         `json:"postings"`
+		Nonce     *hezCommon.Nonce  `json:"nonce,omitempty"`
+		Timestamp time.Time         `json:"timestamp"`
+	}
+
+	// Posting represents a debit (positive) or credit (negative) amount
+	// into a ledger account
+	Posting struct {
+		Account string   `json:"account"`
+		Amount  *big.Int `json:"amount"`
+	}
+
+	// Kind represents the ledger entry kind
+	Kind string
+)
+
+// Open opens the ledger journal file and loads the balances. An empty
+// path keeps the ledger in memory
+func Open(path string) (*Ledger, error) {
+	l := &Ledger{
+		refs:     make(map[string]bool),
+		balances: make(map[string]map[hezCommon.TokenID]*big.Int),
+		outgoing: make(map[string]outgoingTx),
+		entries:  make(map[string]Entry),
+		incoming: make(map[string]incomingDeposit),
+	}
+	if path == "" {
+		return l, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.E("cannot open the ledger journal", err, errors.Params{"path": path})
+	}
+	if err := l.load(f, path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.journal = f
+	return l, nil
+}
+
+// load applies the journal entries. A crash during an append leaves a
+// partial last line, it is truncated so the next entries are appended to a
+// clean line. An invalid entry before the last line is a corrupted journal
+func (l *Ledger) load(f *os.File, path string) error {
+	reader := bufio.NewReader(f)
+	offset := int64(0)
+	for line := 1; ; line++ {
+		b, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return errors.E("cannot read the ledger journal", readErr, errors.Params{"path": path})
+		}
+		if len(b) == 0 {
+			return nil
+		}
+		var e Entry
+		if err := json.Unmarshal(b, &e); err != nil {
+			if _, peekErr := reader.Peek(1); peekErr != io.EOF {
+				return errors.E("invalid ledger journal entry", err,
+					errors.Params{"path": path, "line": line})
+			}
+			logger.Warn("Truncate the partial ledger journal entry", logger.Params{"path": path, "line": line})
+			return f.Truncate(offset)
+		}
+		l.apply(e)
+		offset += int64(len(b))
+		if readErr == io.EOF {
+			// the last entry was written without the line break
+			if _, err := f.WriteString("\n"); err != nil {
+				return errors.E("cannot write the ledger journal", err, errors.Params{"path": path})
+			}
+			return nil
+		}
+	}
+}
+
+// Close closes the ledger journal
+func (l *Ledger) Close() error {
+	if l.journal == nil {
+		return nil
+	}
+	return l.journal.Close()
+}
+
+// RecordOpening records the opening balance of a rollup account, it
+// must be called before tracking an account with previous balance
+func (l *Ledger) RecordOpening(idx hezCommon.Idx, tokenID hezCommon.TokenID, balance *big.Int) error {
+	return l.record(Entry{
+		Ref:     "opening:" + idx.String(),
+		Kind:    KindOpening,
+		TokenID: tokenID,
+		Postings: []Posting{
+			{Account: IdxAccount(idx), Amount: new(big.Int).Set(balance)},
+			{Account: AccountEquity, Amount: new(big.Int).Neg(balance)},
+		},
+	})
+}
+
+// RecordDeposit records a deposit found by the deposit tracker. It can be
+// used as a track.DepositHandler
+func (l *Ledger) RecordDeposit(d track.DepositTx) error {
+	return l.record(Entry{
+		Ref:     "deposit:" + d.Ref(),
+		Kind:    KindDeposit,
+		TokenID: d.Tx.Token.TokenID,
+		Postings: []Posting{
+			{Account: IdxAccount(d.Idx), Amount: new(big.Int).Set(d.Amount)},
+			{Account: AccountExternal, Amount: new(big.Int).Neg(d.Amount)},
+		},
+	})
+}
+
+// RecordTx records an outgoing tx and its fee. It can be used as a
+// transaction.SentHook
+func (l *Ledger) RecordTx(tx hezCommon.PoolL2Tx, token hezCommon.Token, txID string) {
+	if err := l.recordTx(tx, txID); err != nil {
+		logger.Error(errors.E("cannot record the tx into the ledger", err,
+			errors.Params{"tx_id": txID}))
+	}
+}
+
+// TrackDeposit keeps the forged deposits as incoming until final, when the
+// deposit is recorded. A rolled back deposit is dropped. It can be used as
+// a track.StatusHandler
+func (l *Ledger) TrackDeposit(d track.DepositTx, status track.DepositStatus) error {
+	ref := d.Ref()
+	switch status {
+	case track.DepositForged:
+		l.mu.Lock()
+		if !l.refs["deposit:"+ref] {
+			l.incoming[ref] = incomingDeposit{
+				idx:     d.Idx,
+				tokenID: d.Tx.Token.TokenID,
+				amount:  new(big.Int).Set(d.Amount),
+			}
+		}
+		l.mu.Unlock()
+	case track.DepositFinal:
+		l.mu.Lock()
+		delete(l.incoming, ref)
+		l.mu.Unlock()
+		return l.RecordDeposit(d)
+	case track.DepositRolledBack:
+		l.mu.Lock()
+		delete(l.incoming, ref)
+		l.mu.Unlock()
+	}
+	return nil
+}
+
+// OpenAccounts records the opening balances of the accounts of a hez eth
+// address or a hez BJJ address, so the accounts with previous balance can
+// be reconciled. An address without accounts has nothing to open
+func (l *Ledger) OpenAccounts(c client.AccountReader, address string) error {
+	var bjjAddress, hezEthAddress *string
+	if strings.HasPrefix(strings.ToLower(address), "hez:0x") {
+		hezEthAddress = &address
+	} else {
+		bjjAddress = &address
+	}
+	ac, err := c.GetAccounts(bjjAddress, hezEthAddress)
+	if client.IsNotRegistered(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.E("cannot get the accounts to open", err, errors.Params{"address": address})
+	}
+	for _, account := range ac.Accounts {
+		balance := big.NewInt(0)
+		if account.Balance != nil {
+			balance.Set(&account.Balance.Int)
+		}
+		if err := l.RecordOpening(hezCommon.Idx(account.Idx), account.Token.TokenID, balance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordTx records the withdrawal and the fee entries of the tx. A self
+// transfer, like the payout nonce fillers, only pays the fee and records
+// a zero withdrawal to track its nonce
+func (l *Ledger) recordTx(tx hezCommon.PoolL2Tx, txID string) error {
+	feeAmount, err := hezCommon.CalcFeeAmount(tx.Amount, tx.Fee)
+	if err != nil {
+		return err
+	}
+	fromAccount := IdxAccount(tx.FromIdx)
+	nonce := tx.Nonce
+	amount := new(big.Int).Set(tx.Amount)
+	if tx.Type == hezCommon.TxTypeTransfer && tx.ToIdx == tx.FromIdx {
+		amount.SetInt64(0)
+	}
+	err = l.record(Entry{
+		Ref:     "withdrawal:" + txID,
+		Kind:    KindWithdrawal,
+		TokenID: tx.TokenID,
+		Nonce:   &nonce,
+		Postings: []Posting{
+			{Account: AccountExternal, Amount: amount},
+			{Account: fromAccount, Amount: new(big.Int).Neg(amount)},
+		},
+	})
+	if err != nil || feeAmount.Sign() == 0 {
+		return err
+	}
+	return l.record(Entry{
+		Ref:     "fee:" + txID,
+		Kind:    KindFee,
+		TokenID: tx.TokenID,
+		Postings: []Posting{
+			{Account: AccountFees, Amount: feeAmount},
+			{Account: fromAccount, Amount: new(big.Int).Neg(feeAmount)},
+		},
+	})
+}
+
+// RollbackTx reverses the withdrawal and fee entries of a tx rejected as
+// invalid by the pool, the tx never moves the on-chain balance. It can be
+// used as a track.TxHandler
+func (l *Ledger) RollbackTx(txID string, state track.TxState, _ hezCommon.BatchNum) {
+	if state != track.TxInvalid {
+		return
+	}
+	for _, ref := range []string{"withdrawal:" + txID, "fee:" + txID} {
+		l.mu.RLock()
+		e, ok := l.entries[ref]
+		l.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		postings := make([]Posting, 0, len(e.Postings))
+		for _, p := range e.Postings {
+			postings = append(postings, Posting{Account: p.Account, Amount: new(big.Int).Neg(p.Amount)})
+		}
+		err := l.record(Entry{
+			Ref:      reversalPrefix + ref,
+			Kind:     KindReversal,
+			TokenID:  e.TokenID,
+			Postings: postings,
+		})
+		if err != nil {
+			logger.Error(errors.E("cannot reverse the tx into the ledger", err,
+				errors.Params{"tx_id": txID, "ref": ref}))
+		}
+	}
+}
+
+// Balance returns the ledger account balance for the token
+func (l *Ledger) Balance(account string, tokenID hezCommon.TokenID) *big.Int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if b, ok := l.balances[account][tokenID]; ok {
+		return new(big.Int).Set(b)
+	}
+	return big.NewInt(0)
+}
+
+// IdxAccount returns the ledger account name of a rollup account
+func IdxAccount(idx hezCommon.Idx) string {
+	return idxAccountPrefix + idx.String()
+}
+
+// record validates, appends to the journal and applies the entry. Entries
+// already recorded are ignored, so the same deposit can be recorded twice
+func (l *Ledger) record(e Entry) error {
+	sum := big.NewInt(0)
+	for _, p := range e.Postings {
+		sum.Add(sum, p.Amount)
+	}
+	if sum.Sign() != 0 {
+		return errors.E("unbalanced ledger entry", errors.Params{"ref": e.Ref})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.refs[e.Ref] {
+		return nil
+	}
+	e.Timestamp = time.Now()
+	if l.journal != nil {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := l.journal.Write(append(b, '\n')); err != nil {
+			return errors.E("cannot write the ledger journal", err)
+		}
+		if err := l.journal.Sync(); err != nil {
+			return err
+		}
+	}
+	l.apply(e)
+	logger.Debug("Ledger entry", logger.Params{"ref": e.Ref, "kind": e.Kind, "token_id": e.TokenID})
+	return nil
+}
+
+// apply updates the balances with the entry postings
+func (l *Ledger) apply(e Entry) {
+	l.refs[e.Ref] = true
+	for _, p := range e.Postings {
+		if _, ok := l.balances[p.Account]; !ok {
+			l.balances[p.Account] = make(map[hezCommon.TokenID]*big.Int)
+		}
+		b, ok := l.balances[p.Account][e.TokenID]
+		if !ok {
+			b = big.NewInt(0)
+			l.balances[p.Account][e.TokenID] = b
+		}
+		b.Add(b, p.Amount)
+	}
+	switch e.Kind {
+	case KindWithdrawal:
+		l.entries[e.Ref] = e
+		if e.Nonce == nil {
+			break
+		}
+		for _, p := range e.Postings {
+			if idx, ok := parseIdxAccount(p.Account); ok {
+				l.outgoing[e.Ref] = outgoingTx{idx: idx, nonce: *e.Nonce, timestamp: e.Timestamp}
+			}
+		}
+	case KindFee:
+		l.entries[e.Ref] = e
+	case KindReversal:
+		ref := strings.TrimPrefix(e.Ref, reversalPrefix)
+		delete(l.outgoing, ref)
+		delete(l.entries, ref)
+	}
+}
+
+// parseIdxAccount returns the idx of a rollup ledger account
+func parseIdxAccount(account string) (hezCommon.Idx, bool) {
+	if !strings.HasPrefix(account, idxAccountPrefix) {
+		return 0, false
+	}
+	idx, err := strconv.ParseUint(strings.TrimPrefix(account, idxAccountPrefix), 10, 48)
+	if err != nil {
+		return 0, false
+	}
+	return hezCommon.Idx(idx), true
+}
@@ -0,0 +1,216 @@
+package ledger
+
+import (
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/client"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// StatusMatch represents a ledger balance equal to the on-chain balance
+	StatusMatch Status = "match"
+	// StatusMismatch represents a discrepancy between the balances
+	StatusMismatch Status = "mismatch"
+	// StatusPending represents an account with outgoing txs not forged yet
+	StatusPending Status = "pending"
+
+	// pendingTimeout is the maximum time an outgoing tx keeps the account
+	// pending. A tx dropped from the pool without being reported invalid
+	// is never forged, so the discrepancy is flagged after the timeout
+	pendingTimeout = time.Hour
+)
+
+type (
+	// Reconciliation represents the comparison between the ledger balance
+	// and the on-chain balance of a rollup account
+	Reconciliation struct {
+		Idx     hezCommon.Idx     `json:"idx"`
+		TokenID hezCommon.TokenID `json:"tokenId"`
+		Ledger  *big.Int          `json:"ledger"`
+		// Incoming is the amount of the deposits forged and not final
+		// yet, already into the on-chain balance
+		Incoming *big.Int `json:"incoming"`
+		OnChain  *big.Int `json:"onChain"`
+		Diff     *big.Int `json:"diff"`
+		Status   Status   `json:"status"`
+	}
+
+	// Status represents a reconciliation status
+	Status string
+)
+
+// Reconcile compares the ledger balance of each rollup account with the
+// on-chain Account.Balance. Accounts with outgoing txs still into the
+// pool are reported as pending, because the on-chain balance was not
+// updated yet. The deposits forged and not final yet are added to the
+// ledger balance, they already credit the on-chain balance. The txs rejected by the pool must be rolled back with
+// RollbackTx, and an outgoing tx older than the pending timeout does not
+// keep the account pending
+func (l *Ledger) Reconcile(c *client.Client) ([]Reconciliation, error) {
+	tokens, err := c.GetTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Reconciliation, 0)
+	for _, account := range l.idxAccounts() {
+		for tokenID, balance := range account.balances {
+			token, err := tokens.Tokens.GetTokenByID(tokenID)
+			if err != nil {
+				return nil, err
+			}
+			ac, err := c.GetAccountByIdx(account.idx, token.Symbol)
+			if err != nil {
+				return nil, err
+			}
+			l.forget(account.idx, ac.Nonce)
+			onChain := big.NewInt(0)
+			if ac.Balance != nil {
+				onChain = new(big.Int).Set(&ac.Balance.Int)
+			}
+			incoming := big.NewInt(0)
+			if amount, ok := account.incoming[tokenID]; ok {
+				incoming.Set(amount)
+			}
+			expected := new(big.Int).Add(balance, incoming)
+			r := Reconciliation{
+				Idx:      account.idx,
+				TokenID:  tokenID,
+				Ledger:   balance,
+				Incoming: incoming,
+				OnChain:  onChain,
+				Diff:     expected.Sub(expected, onChain),
+				Status:   StatusMatch,
+			}
+			switch {
+			case account.pending(ac.Nonce):
+				r.Status = StatusPending
+			case r.Diff.Sign() != 0:
+				r.Status = StatusMismatch
+			}
+			result = append(result, r)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Idx < result[j].Idx
+	})
+	return result, nil
+}
+
+// RunReconciliation reconciles the ledger periodically and flags the
+// discrepancies
+func (l *Ledger) RunReconciliation(c *client.Client, interval time.Duration) func() error {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ticker.C:
+				result, err := l.Reconcile(c)
+				if err != nil {
+					logger.Error(errors.E("cannot reconcile the ledger", err))
+					continue
+				}
+				mismatches := 0
+				for _, r := range result {
+					if r.Status != StatusMismatch {
+						continue
+					}
+					mismatches++
+					logger.Error(errors.E("ledger discrepancy", errors.Params{
+						"idx":      r.Idx,
+						"token_id": r.TokenID,
+						"ledger":   r.Ledger.String(),
+						"incoming": r.Incoming.String(),
+						"on_chain": r.OnChain.String(),
+						"diff":     r.Diff.String(),
+					}))
+				}
+				logger.Info("Ledger reconciliation", logger.Params{
+					"accounts":   len(result),
+					"mismatches": mismatches,
+				})
+			}
+		}
+	}
+}
+
+// forget drops the outgoing txs of the idx forged before the nonce, they
+// cannot be rolled back anymore
+func (l *Ledger) forget(idx hezCommon.Idx, nonce hezCommon.Nonce) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ref, tx := range l.outgoing {
+		if tx.idx != idx || tx.nonce >= nonce {
+			continue
+		}
+		txID := strings.TrimPrefix(ref, "withdrawal:")
+		delete(l.outgoing, ref)
+		delete(l.entries, ref)
+		delete(l.entries, "fee:"+txID)
+	}
+}
+
+// idxAccount represents a snapshot of a rollup account ledger
+type idxAccount struct {
+	idx      hezCommon.Idx
+	outgoing []outgoingTx
+	balances map[hezCommon.TokenID]*big.Int
+	// incoming is the amount of the deposits not final yet by token
+	incoming map[hezCommon.TokenID]*big.Int
+}
+
+// pending returns true if an outgoing tx of the account was not forged
+// yet, the on-chain nonce is the nonce of the next tx to forge. The txs
+// older than the pending timeout are ignored
+func (a idxAccount) pending(nonce hezCommon.Nonce) bool {
+	for _, tx := range a.outgoing {
+		if tx.nonce >= nonce && time.Since(tx.timestamp) < pendingTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+// idxAccounts returns a snapshot of the rollup accounts balances
+func (l *Ledger) idxAccounts() []idxAccount {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	accounts := make([]idxAccount, 0)
+	for name, balances := range l.balances {
+		idx, ok := parseIdxAccount(name)
+		if !ok {
+			continue
+		}
+		account := idxAccount{
+			idx:      idx,
+			outgoing: make([]outgoingTx, 0),
+			balances: make(map[hezCommon.TokenID]*big.Int),
+			incoming: make(map[hezCommon.TokenID]*big.Int),
+		}
+		for _, tx := range l.outgoing {
+			if tx.idx == idx {
+				account.outgoing = append(account.outgoing, tx)
+			}
+		}
+		for _, d := range l.incoming {
+			if d.idx != idx {
+				continue
+			}
+			if _, ok := account.incoming[d.tokenID]; !ok {
+				account.incoming[d.tokenID] = big.NewInt(0)
+			}
+			account.incoming[d.tokenID].Add(account.incoming[d.tokenID], d.amount)
+		}
+		for tokenID, b := range balances {
+			account.balances[tokenID] = new(big.Int).Set(b)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"math/big"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,10 +16,25 @@ import (
 	"github.com/Pantani/logger"
 	ethCommon "github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/hermeznetwork/hermez-integration/addressbook"
+	"github.com/hermeznetwork/hermez-integration/api"
+	"github.com/hermeznetwork/hermez-integration/approval"
+	"github.com/hermeznetwork/hermez-integration/audit"
 	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/grpcapi"
+	"github.com/hermeznetwork/hermez-integration/health"
 	"github.com/hermeznetwork/hermez-integration/hermez"
+	"github.com/hermeznetwork/hermez-integration/ledger"
+	"github.com/hermeznetwork/hermez-integration/metrics"
+	"github.com/hermeznetwork/hermez-integration/policy"
+	"github.com/hermeznetwork/hermez-integration/sweep"
+	"github.com/hermeznetwork/hermez-integration/tokens"
+	"github.com/hermeznetwork/hermez-integration/tracing"
 	"github.com/hermeznetwork/hermez-integration/track"
 	"github.com/hermeznetwork/hermez-integration/transaction"
+	"github.com/hermeznetwork/hermez-integration/verify"
+	"github.com/hermeznetwork/hermez-integration/wdelayer"
 	hezCommon "github.com/hermeznetwork/hermez-node/common"
 	"golang.org/x/sync/errgroup"
 )
@@ -31,16 +49,58 @@ func main() {
 		rollupContract = "0x679b11E0229959C1D3D27C9d20529E4C5DF7997c"
 		// poolingInterval pooling interval to check the transactions state
 		poolingInterval = 10 * time.Second
+		// serverAddr represents the address of the metrics and health server
+		serverAddr = ":9090"
+		// grpcAddr represents the address of the gRPC wallet service
+		grpcAddr = ":9091"
+		// maxBatchLag represents the maximum batches the deposit tracker
+		// can lag behind the last batch before the daemon is not ready
+		maxBatchLag = hezCommon.BatchNum(10)
+		// confirmations represents the L1 blocks confirming a batch
+		// before its deposits are final
+		confirmations = int64(12)
+		// tracingExporter represents the tracing span exporter, use
+		// tracing.ExporterStdout or tracing.ExporterOTLP to enable it
+		tracingExporter = tracing.ExporterNone
+		// tracingEndpoint represents the OTLP collector address
+		tracingEndpoint = "localhost:4318"
+		// auditLogPath represents the audit log file of the signatures
+		auditLogPath = "audit.log"
 	)
 
 	logger.SetLogLevel(logger.DebugLevel)
-	err := run(nodeURL, rollupContract, chainID, poolingInterval)
+	shutdown, err := tracing.Init(tracing.Config{
+		Exporter: tracingExporter,
+		Endpoint: tracingEndpoint,
+		Insecure: true,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// record every signature into the hash-chained audit log, verify it
+	// with `go run ./cmd/auditverify -file audit.log`
+	auditLog, err := audit.Open(auditLogPath, "")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	hermez.SetAuditLog(auditLog)
+
+	err = run(nodeURL, rollupContract, serverAddr, grpcAddr, chainID, maxBatchLag, confirmations, poolingInterval)
+	if err := auditLog.Close(); err != nil {
+		logger.Error(err)
+	}
+	// flush the pending spans before exit
+	if err := shutdown(context.Background()); err != nil {
+		logger.Error(err)
+	}
 	if err != nil {
 		logger.Fatal(err)
 	}
 }
 
-func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Duration) error {
+func run(nodeURL, rollupContract, serverAddr, grpcAddr string, chainID uint16, maxBatchLag hezCommon.BatchNum,
+	confirmations int64, poolingInterval time.Duration) error {
 	rand.Seed(time.Now().Unix())
 
 	// init context
@@ -50,15 +110,37 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 
 	contract := ethCommon.HexToAddress(rollupContract)
 
-	// create a new Hermez node client
+	// serve the Prometheus metrics and the health endpoints. The
+	// readiness fails until the start up is finished
+	checker := health.New()
+	checker.SetInfo("network", map[string]interface{}{
+		"chain_id":        chainID,
+		"node_url":        nodeURL,
+		"rollup_contract": rollupContract,
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	checker.Routes(mux)
+	grp.Go(func() error {
+		return http.ListenAndServe(serverAddr, mux)
+	})
+
+	// create a new Hermez node client. Use client.NewPool to fail over
+	// between multiple nodes, read the balances from a quorum of nodes or
+	// send the txs to the current slot forger with SendToForger
 	c := client.New(nodeURL)
+	grp.Go(checker.Go("node_health_check", c.HealthCheck(time.Minute)))
+	checker.AddReadiness("nodes", health.NodesCheck(c))
 
-	// get supported tokens
-	tokens, err := c.GetTokens()
+	// load the supported tokens, the registry fetches the new token
+	// registrations periodically
+	tokenRegistry := tokens.NewRegistry(c)
+	registered, err := tokenRegistry.Refresh()
 	if err != nil {
 		return err
 	}
-	for _, t := range tokens.Tokens {
+	grp.Go(checker.Go("tokens", tokenRegistry.Run(time.Minute)))
+	for _, t := range registered {
 		logger.Info("Token "+t.Name, logger.Params{
 			"TokenID":     t.TokenID,
 			"Decimals":    t.Decimals,
@@ -67,11 +149,24 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 			"Symbol":      t.Symbol,
 		})
 	}
-	ethToken, err := tokens.Tokens.GetToken("ETH")
+	ethToken, err := tokenRegistry.BySymbol("ETH")
 	if err != nil {
 		return err
 	}
 
+	// get the coordinator forging into the current slot
+	forgers, err := c.GetForgers()
+	if err != nil {
+		logger.Error(errors.E("cannot get the current forger", err))
+	} else {
+		logger.Info("Current forger", logger.Params{
+			"slot":            forgers.CurrentSlot,
+			"forger":          forgers.Current.Coordinator.Forger.String(),
+			"coordinator_url": forgers.Current.Coordinator.URL,
+			"delay":           forgers.Delay,
+		})
+	}
+
 	// represents the mnemonic for the exchange user wallets
 	exchangeMnemonic := "lava dinosaur defy stone aim faint suspect harsh ranch sorry network wrestle"
 	// index of wallet to start to generate addresses to the users
@@ -79,13 +174,47 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 	// number of addresses to be generated
 	numberOfUsers := 6
 
-	ethUserWallets := make([]string, 0)
-	bjjUserWallets := make([]string, 0)
+	// record the deposits and the sent txs into the internal ledger
+	ledgerBook, err := ledger.Open("")
+	if err != nil {
+		return err
+	}
+	defer ledgerBook.Close()
+	transaction.RegisterSentHook(ledgerBook.RecordTx)
+
+	// the addresses watched by the deposit tracker, a journal path keeps
+	// the watch-list between restarts
+	watchList, err := track.OpenWatchList("")
+	if err != nil {
+		return err
+	}
+	defer watchList.Close()
+	userWallets := make([]*hermez.Wallet, 0)
+	// the account idxs of the user wallets, the deposit tracker matches
+	// the transfers carrying only the receiver idx with them
+	userAccounts := track.NewAccounts(c)
+	// fetch the accounts of the addresses added to the watch-list, by the
+	// user wallets below or later by the API, and open their balances into
+	// the ledger to reconcile them
+	watchList.OnAdd(func(address string) {
+		err := userAccounts.Refresh(address)
+		if client.IsNotRegistered(err) {
+			// wallet without accounts into the network
+			logger.Debug("User accounts not found", logger.Params{"address": address})
+			return
+		}
+		if err != nil {
+			logger.Error(err)
+		}
+		if err := ledgerBook.OpenAccounts(c, address); err != nil {
+			logger.Error(err)
+		}
+	})
 
 	// Increase the wallet index to generate a new wallet based
 	// in the bip39, starting from zero
 	for walletIndex := startUserIndex; walletIndex < startUserIndex+numberOfUsers; walletIndex++ {
-		bjj, err := hermez.NewBJJ(exchangeMnemonic, walletIndex, chainID, contract)
+		bjj, err := hermez.NewBJJ(ctx, exchangeMnemonic, walletIndex, chainID, contract)
 		if err != nil {
 			return err
 		}
@@ -96,8 +225,10 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 			"hez_bjj_address": bjj.HezBjjAddress,
 			"private_key":     hexutil.Encode(pkBuf[:]),
 		})
-		ethUserWallets = append(ethUserWallets, bjj.HezEthAddress)
-		bjjUserWallets = append(bjjUserWallets, bjj.HezBjjAddress)
+		if err := watchList.Add(bjj.HezEthAddress, bjj.HezBjjAddress); err != nil {
+			return err
+		}
+		userWallets = append(userWallets, bjj)
 
 		// Get the signature from the hez eth address
 		if _, err = c.AccountAuth(bjj.HezEthAddress); err != nil {
@@ -113,8 +244,24 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 		})
 	}
 
-	// track incoming track
-	grp.Go(track.Deposits(c, ethUserWallets, bjjUserWallets, poolingInterval))
+	// track incoming track, the feed keeps the deposits listed by the API.
+	// The ledger keeps the forged deposits as incoming and records them once
+	// final
+	depositFeed := track.NewFeed(0)
+	// The finality state file resumes the scan of the deposits not final
+	// yet after a restart
+	finality, err := track.NewFinality("finality.json", c, confirmations,
+		ledgerBook.TrackDeposit, depositFeed.RecordDeposit)
+	if err != nil {
+		return err
+	}
+	grp.Go(checker.Go("deposits", track.Deposits(c, watchList, userAccounts, poolingInterval,
+		finality.Forged)))
+	grp.Go(checker.Go("finality", finality.Run(poolingInterval)))
+	// the scan is stale while the nodes are down, the daemon must not be
+	// restarted for a node outage
+	checker.AddReadiness("deposits_scan", health.StaleCheck(track.LastScan, 5*poolingInterval))
+	checker.AddReadiness("batch_lag", health.BatchLagCheck(c, track.ScannedBatch, maxBatchLag))
 
 	// represents the mnemonic for outside wallet, it is assumed that
 	// the user has already Ether in Hermez Network
@@ -123,7 +270,7 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 	outWalletIndex := 0
 
 	// Create a baby jubjub wallet based in the mnemonic and index
-	bjj, err := hermez.NewBJJ(outWalletMnemonic, outWalletIndex, chainID, contract)
+	bjj, err := hermez.NewBJJ(ctx, outWalletMnemonic, outWalletIndex, chainID, contract)
 	if err != nil {
 		return err
 	}
@@ -134,6 +281,19 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 		"private_key":     hexutil.Encode(pkBuf[:]),
 	})
 
+	// the signing key must be loadable from the mnemonic, the daemon
+	// cannot send the txs without it
+	checker.AddReadiness("signing_key", func() error {
+		w, err := hermez.NewBJJ(ctx, outWalletMnemonic, outWalletIndex, chainID, contract)
+		if err != nil {
+			return errors.E("cannot load the signing key", err)
+		}
+		if w.HezBjjAddress != bjj.HezBjjAddress {
+			return errors.E("signing key changed", errors.Params{"hez_bjj_address": w.HezBjjAddress})
+		}
+		return nil
+	})
+
 	// Get the signature from the hez eth address
 	if _, err := c.AccountAuth(bjj.HezEthAddress); err != nil {
 		// If the signature not exist, create a new one
@@ -147,6 +307,26 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 		"signature":       bjj.Signature,
 	})
 
+	// Track the out wallet exits delayed into the WDelayer contract, the
+	// contract is read from the Ethereum node of HERMEZ_ETH_URL
+	if ethURL := os.Getenv("HERMEZ_ETH_URL"); ethURL != "" {
+		nodeConfig, err := c.GetConfig()
+		if err != nil {
+			return err
+		}
+		ethClient, err := ethclient.Dial(ethURL)
+		if err != nil {
+			return errors.E("cannot connect to the Ethereum node", err)
+		}
+		defer ethClient.Close()
+		delayer, err := wdelayer.New(ethClient, nodeConfig.Rollup.PublicConstants.WithdrawDelayerContract,
+			[]string{bjj.HezEthAddress}, []hezCommon.Token{ethToken})
+		if err != nil {
+			return err
+		}
+		grp.Go(checker.Go("wdelayer", delayer.Run(time.Minute)))
+	}
+
 	// A fee is a percentage value from the token amount, and the fee amount in USD must
 	// be greater than the minimum fee value the coordinator accepts. The fee value in the
 	// L2 transaction apply a factor encoded by an index from the transaction fee table:
@@ -161,11 +341,11 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 
 	logger.Info("Fee", logger.Params{
 		"amount_wei":     amount.String(),
-		"amount_eth":     hermez.WeiToEther(amount).String(),
+		"amount_eth":     tokens.FormatUnits(amount, ethToken.Decimals),
 		"fee_selector":   fee,
 		"fee_percentage": fee.Percentage(),
 		"fee_amount_wei": feeAmount.String(),
-		"fee_amount_eth": hermez.WeiToEther(feeAmount).String(),
+		"fee_amount_eth": tokens.FormatUnits(feeAmount, ethToken.Decimals),
 	})
 	// Get account idx, nonce and check the balance
 	fromIdx, nonce, err := transaction.GetAccountInfo(c, &bjj.HezBjjAddress, nil, ethToken.TokenID)
@@ -173,10 +353,131 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 		return err
 	}
 
+	// Open the out wallet account into the ledger with the current balance
+	// and reconcile the ledger with the on-chain balances
+	outAccount, err := c.GetAccountByIdx(fromIdx, ethToken.Symbol)
+	if err != nil {
+		return err
+	}
+	outBalance := big.NewInt(0)
+	if outAccount.Balance != nil {
+		outBalance = &outAccount.Balance.Int
+	}
+	if err := ledgerBook.RecordOpening(fromIdx, ethToken.TokenID, outBalance); err != nil {
+		return err
+	}
+	grp.Go(checker.Go("reconciliation", ledgerBook.RunReconciliation(c, poolingInterval)))
+
+	// Verify the out wallet account state between the pool nodes, flagging
+	// the nodes serving inconsistent data. A single node has nothing to be
+	// compared with
+	if nodes := len(c.Nodes()); nodes > 1 {
+		stateVerifier := verify.New(c)
+		grp.Go(checker.Go("state_verify", stateVerifier.Run([]verify.Account{
+			{Idx: fromIdx, TokenSymbol: ethToken.Symbol},
+		}, time.Minute)))
+	} else {
+		logger.Info("State verifier disabled for a single node", logger.Params{"nodes": nodes})
+	}
+
+	// Sweep the user accounts balances above the threshold to the out
+	// wallet account. The dry run mode only reports the transfers
+	sweeper, err := sweep.New(c, userWallets, sweep.Config{
+		ChainID: chainID,
+		DryRun:  true,
+		Tokens: map[hezCommon.TokenID]sweep.TokenConfig{
+			ethToken.TokenID: {
+				HotWalletIdx: fromIdx,
+				Threshold:    big.NewInt(10000000000000000),
+				Fee:          fee,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	grp.Go(checker.Go("sweeper", sweeper.Run(poolingInterval)))
+
+	// Check the outgoing txs against the withdrawal policy before signing.
+	// The txs exceeding the limits wait for a manual approval, the spends
+	// and the approval queue are kept into policy.json. The sweeps to the
+	// hot wallet account are exempt from the customer limits
+	withdrawalPolicy, err := policy.New("policy.json", policy.Config{
+		Tokens: map[hezCommon.TokenID]policy.TokenLimits{
+			ethToken.TokenID: {
+				PerTx: big.NewInt(100000000000000000),  // 0.1 ETH
+				Daily: big.NewInt(1000000000000000000), // 1 ETH
+			},
+		},
+		Velocity: policy.Velocity{MaxTxs: 20, Window: time.Hour},
+		Exempt:   []string{policy.IdxDestination(fromIdx)},
+	})
+	if err != nil {
+		return err
+	}
+	transaction.SetPolicy(withdrawalPolicy)
+
+	// Require M-of-N approvals of the approvers Ethereum keys before
+	// signing the txs above the approval limits, if the approvers are
+	// defined. The proposals are kept into proposals.json
+	var approvals *approval.Store
+	if approvers := os.Getenv("HERMEZ_APPROVERS"); approvers != "" {
+		cfg := approval.Config{
+			Threshold: 1,
+			Limits: map[hezCommon.TokenID]*big.Int{
+				ethToken.TokenID: big.NewInt(500000000000000000), // 0.5 ETH
+			},
+		}
+		for _, a := range strings.Split(approvers, ",") {
+			cfg.Approvers = append(cfg.Approvers, ethCommon.HexToAddress(strings.TrimSpace(a)))
+		}
+		if threshold := os.Getenv("HERMEZ_APPROVAL_THRESHOLD"); threshold != "" {
+			if cfg.Threshold, err = strconv.Atoi(threshold); err != nil {
+				return errors.E("invalid approval threshold", err, errors.Params{"threshold": threshold})
+			}
+		}
+		if approvals, err = approval.Open("proposals.json", cfg); err != nil {
+			return err
+		}
+		transaction.SetApprovals(approvals)
+	}
+
+	// Serve the wallet REST and gRPC APIs if an API key is defined. The
+	// spec is served on /v1/openapi.yaml. The operator key allows to
+	// approve or reject the withdrawals queued by the policy and to
+	// execute the proposals
+	if apiKey := os.Getenv("HERMEZ_API_KEY"); apiKey != "" {
+		apiCfg := api.Config{
+			ChainID:        chainID,
+			RollupContract: contract,
+			Mnemonic:       exchangeMnemonic,
+			HotWallet:      bjj,
+			Fee:            fee,
+			APIKeys:        []string{apiKey},
+			Watch:          watchList,
+			Tokens:         tokenRegistry,
+		}
+		if operatorKey := os.Getenv("HERMEZ_OPERATOR_KEY"); operatorKey != "" {
+			operator := os.Getenv("HERMEZ_OPERATOR_NAME")
+			if operator == "" {
+				operator = "operator"
+			}
+			apiCfg.Policy = withdrawalPolicy
+			apiCfg.Approvals = approvals
+			apiCfg.Operators = map[string]string{operator: operatorKey}
+		}
+		apiServer, err := api.New(c, depositFeed, apiCfg)
+		if err != nil {
+			return err
+		}
+		apiServer.Routes(mux)
+		grp.Go(grpcapi.New(apiServer, c, depositFeed).Serve(grpcAddr))
+	}
+
 	// Create a transfer to the first baby jubjub user address
-	bjjIndex := rand.Intn(len(bjjUserWallets))
-	toHezBjjAddr := bjjUserWallets[bjjIndex]
-	txID, err := transaction.TransferToBjj(bjj, c, chainID, fromIdx, toHezBjjAddr, amount, fee, ethToken, nonce)
+	bjjIndex := rand.Intn(len(userWallets))
+	toHezBjjAddr := userWallets[bjjIndex].HezBjjAddress
+	txID, err := transaction.TransferToBjj(ctx, bjj, c, chainID, fromIdx, toHezBjjAddr, amount, fee, ethToken, nonce)
 	if err != nil {
 		return err
 	}
@@ -185,9 +486,9 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 
 	// Create a transfer to the second user ethereum address
 	nonce++
-	ethIndex := rand.Intn(len(ethUserWallets))
-	toHezAddr := ethUserWallets[ethIndex]
-	txID, err = transaction.TransferToEthAddress(bjj, c, chainID, fromIdx, toHezAddr, amount, fee, ethToken, nonce)
+	ethIndex := rand.Intn(len(userWallets))
+	toHezAddr := userWallets[ethIndex].HezEthAddress
+	txID, err = transaction.TransferToEthAddress(ctx, bjj, c, chainID, fromIdx, toHezAddr, amount, fee, ethToken, nonce)
 	if err != nil {
 		return err
 	}
@@ -195,14 +496,16 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 	logger.Info("transferToEthAddress", logger.Params{"tx_id": txID})
 
 	// Create a transfer to an already existing account into the
-	// network using the idx (Merkle tree index).
+	// network. The resolver finds the account idx (Merkle tree index)
+	// from the address and selects the transfer type
 	nonce++
-	toHezAddr = "hez:0xbA00D84Ddbc8cAe67C5800a52496E47A8CaFcd27"
-	toIdx, _, err := transaction.GetAccountInfo(c, nil, &toHezAddr, ethToken.TokenID)
+	book, err := addressbook.Load("")
 	if err != nil {
 		return err
 	}
-	txID, err = transaction.Transfer(bjj, c, chainID, fromIdx, toIdx, amount, fee, ethToken, nonce)
+	resolver := addressbook.NewResolver(c, book, time.Hour)
+	toHezAddr = "hez:0xbA00D84Ddbc8cAe67C5800a52496E47A8CaFcd27"
+	txID, err = resolver.Transfer(ctx, bjj, chainID, fromIdx, toHezAddr, amount, fee, ethToken, nonce)
 	if err != nil {
 		return err
 	}
@@ -211,14 +514,15 @@ func run(nodeURL, rollupContract string, chainID uint16, poolingInterval time.Du
 
 	//Transfer tokens from an account to the exit tree, L2 --> L1
 	nonce++
-	txID, err = transaction.Exit(bjj, c, chainID, fromIdx, amount, fee, ethToken, nonce)
+	txID, err = transaction.Exit(ctx, bjj, c, chainID, fromIdx, amount, fee, ethToken, nonce)
 	if err != nil {
 		return err
 	}
 	logger.Info("exit", logger.Params{"tx_id": txID})
 
 	// track transactions
-	grp.Go(track.Txs(c, hashes, poolingInterval))
+	grp.Go(checker.Go("txs", track.Txs(c, hashes, poolingInterval, depositFeed.RecordTxStatus, ledgerBook.RollbackTx)))
+	checker.Started()
 
 	// wait for SIGINT/SIGTERM.
 	quit := make(chan os.Signal, 1)
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Pantani/logger"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "hermez_integration"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "request_duration_seconds",
+		Help:      "Node API request latency per endpoint",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"node", "method", "endpoint", "status"})
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "client",
+		Name:      "request_errors_total",
+		Help:      "Node API request errors per endpoint, including rate limits and server errors",
+	}, []string{"node", "method", "endpoint"})
+
+	lastScannedBatch = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "deposits",
+		Name:      "last_scanned_batch",
+		Help:      "Last batch scanned by the deposit tracker",
+	})
+	batchLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "deposits",
+		Name:      "batch_lag",
+		Help:      "Number of batches the deposit tracker is behind the last batch",
+	})
+	depositsFound = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "deposits",
+		Name:      "found_total",
+		Help:      "Deposits found per token and kind",
+	}, []string{"token", "kind"})
+
+	txsPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "txs",
+		Name:      "pending",
+		Help:      "Tracked txs still into the pool",
+	})
+	txsForged = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "txs",
+		Name:      "forged_total",
+		Help:      "Tracked txs forged",
+	})
+	txsInvalid = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "txs",
+		Name:      "invalid_total",
+		Help:      "Tracked txs rejected by the pool as invalid",
+	})
+
+	txsSigned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "transaction",
+		Name:      "signed_total",
+		Help:      "Txs signed per token and tx type",
+	}, []string{"token", "type"})
+	feesPaid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "transaction",
+		Name:      "fees_paid_total",
+		Help:      "Fees paid per token, in token units",
+	}, []string{"token"})
+
+	nodesInconsistent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "verify",
+		Name:      "inconsistent_total",
+		Help:      "Node responses failing the state verification per node and check",
+	}, []string{"node", "check"})
+)
+
+// Handler returns the Prometheus metrics HTTP handler
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Serve serves the metrics on the /metrics endpoint of the address
+func Serve(addr string) func() error {
+	return func() error {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", Handler())
+		logger.Info("Metrics server", logger.Params{"addr": addr})
+		return http.ListenAndServe(addr, mux)
+	}
+}
+
+// ObserveRequest records a node API request. A zero status represents a
+// request failed before the response
+func ObserveRequest(node, method, endpoint string, status int, duration time.Duration) {
+	statusLabel := "error"
+	if status > 0 {
+		statusLabel = strconv.Itoa(status)
+	}
+	requestDuration.WithLabelValues(node, method, endpoint, statusLabel).Observe(duration.Seconds())
+	if status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError {
+		requestErrors.WithLabelValues(node, method, endpoint).Inc()
+	}
+}
+
+// SetScannedBatch records the last batch scanned by the deposit tracker
+// and the lag behind the last batch
+func SetScannedBatch(scanned, last hezCommon.BatchNum) {
+	lastScannedBatch.Set(float64(scanned))
+	if last < scanned {
+		last = scanned
+	}
+	batchLag.Set(float64(last - scanned))
+}
+
+// DepositFound records a deposit found by the deposit tracker
+func DepositFound(token, kind string) {
+	depositsFound.WithLabelValues(token, kind).Inc()
+}
+
+// SetPendingTxs records the number of tracked txs into the pool
+func SetPendingTxs(pending int) {
+	txsPending.Set(float64(pending))
+}
+
+// TxForged records a tracked tx forged
+func TxForged() {
+	txsForged.Inc()
+}
+
+// TxInvalid records a tracked tx rejected as invalid
+func TxInvalid() {
+	txsInvalid.Inc()
+}
+
+// TxSigned records a signed tx
+func TxSigned(token hezCommon.Token, txType hezCommon.TxType) {
+	txsSigned.WithLabelValues(token.Symbol, string(txType)).Inc()
+}
+
+// FeePaid records the fee amount paid by a tx accepted by the pool
+func FeePaid(token hezCommon.Token, amount *big.Int) {
+	value, _ := new(big.Float).Quo(
+		new(big.Float).SetInt(amount),
+		new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(token.Decimals)), nil)),
+	).Float64()
+	feesPaid.WithLabelValues(token.Symbol).Add(value)
+}
+
+// NodeInconsistent records a node response failing the state verification
+func NodeInconsistent(node, check string) {
+	nodesInconsistent.WithLabelValues(node, check).Inc()
+}
@@ -0,0 +1,165 @@
+package payout
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+)
+
+// ReadFile reads the payouts from a CSV or JSON file, chosen by the file
+// extension. The CSV columns are recipient and amount, with an optional
+// header. The JSON file is an array of payout objects
+func ReadFile(path string) ([]Payout, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.E("cannot open the payout file", err, errors.Params{"path": path})
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return readCSV(f)
+	case ".json":
+		return readJSON(f)
+	default:
+		return nil, errors.E("payout file extension not supported", errors.Params{"path": path})
+	}
+}
+
+// readCSV reads the payouts from a CSV reader
+func readCSV(r io.Reader) ([]Payout, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, errors.E("invalid payout csv file", err)
+	}
+	payouts := make([]Payout, 0, len(records))
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], "recipient") {
+			continue
+		}
+		payouts = append(payouts, Payout{
+			Recipient: strings.TrimSpace(record[0]),
+			Amount:    strings.TrimSpace(record[1]),
+		})
+	}
+	return payouts, nil
+}
+
+// readJSON reads the payouts from a JSON reader
+func readJSON(r io.Reader) ([]Payout, error) {
+	payouts := make([]Payout, 0)
+	if err := json.NewDecoder(r).Decode(&payouts); err != nil {
+		return nil, errors.E("invalid payout json file", err)
+	}
+	return payouts, nil
+}
+
+// loadResults reads the result file written by a previous run. The
+// file is a JSON line per status change, so the last line of each
+// row wins. A missing file returns an empty result set
+func loadResults(path string) (map[int]Result, error) {
+	results := make(map[int]Result)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, errors.E("cannot open the result file", err, errors.Params{"path": path})
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var r Result
+		if err := json.Unmarshal(line, &r); err != nil {
+			// the line can be truncated by a crash while writing
+			continue
+		}
+		results[r.Row] = r
+	}
+	return results, scanner.Err()
+}
+
+// resultWriter appends the results to the result file, it can be used
+// by the concurrent sends
+type resultWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// newResultWriter opens the result file in append mode
+func newResultWriter(path string) (*resultWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.E("cannot open the result file", err, errors.Params{"path": path})
+	}
+	w := &resultWriter{f: f}
+	if err := w.terminateLine(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// terminateLine adds a line break if the file was truncated by a
+// crash, so the next result doesn't join the broken line
+func (w *resultWriter) terminateLine() error {
+	info, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return nil
+	}
+	last := make([]byte, 1)
+	if _, err := w.f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+	_, err = w.f.Write([]byte{'\n'})
+	return err
+}
+
+// record writes a result, logging the write errors
+func (w *resultWriter) record(r Result) {
+	if err := w.write(r); err != nil {
+		logger.Error(errors.E("cannot write the payout result", err,
+			errors.Params{"row": r.Row, "tx_id": r.TxID}))
+	}
+}
+
+// write appends a result line and flushes it to the disk
+func (w *resultWriter) write(r Result) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Close closes the result file
+func (w *resultWriter) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,426 @@
+package payout
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/hermez"
+	"github.com/hermeznetwork/hermez-integration/policy"
+	"github.com/hermeznetwork/hermez-integration/tracing"
+	"github.com/hermeznetwork/hermez-integration/transaction"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// StatusSigned represents a tx signed and not confirmed into the pool yet
+	StatusSigned Status = "signed"
+	// StatusSent represents a tx accepted by the coordinator pool
+	StatusSent Status = "sent"
+	// StatusFailed represents a tx rejected or not sent, its nonce is
+	// kept to send it again
+	StatusFailed Status = "failed"
+	// StatusRejected represents a tx not authorized by the withdrawal
+	// policy, no nonce is reserved for it
+	StatusRejected Status = "rejected"
+
+	// defaultConcurrency is the number of txs sent at the same time
+	defaultConcurrency = 4
+)
+
+type (
+	// Engine represents the batch payout engine. All payouts are sent
+	// from the wallet account of the configured token
+	Engine struct {
+		client *client.Client
+		wallet *hermez.Wallet
+		cfg    Config
+	}
+
+	// Config represents the payout engine configuration
+	Config struct {
+		ChainID uint16
+		Token   hezCommon.Token
+		Fee     hezCommon.FeeSelector
+		// Concurrency is the number of txs sent at the same time
+		Concurrency int
+		// ResultPath is the result file, used to resume a payout
+		ResultPath string
+	}
+
+	// Payout represents a payout file row
+	Payout struct {
+		// Recipient can be a hez eth address (hez:0x...),
+		// a hez BJJ address (hez:<bjj>) or an idx (hez:ETH:256 or 256)
+		Recipient string `json:"recipient"`
+		// Amount in the token base unit
+		Amount string `json:"amount"`
+	}
+
+	// Result represents the payout status of a file row
+	Result struct {
+		Row       int              `json:"row"`
+		Recipient string           `json:"recipient"`
+		Amount    string           `json:"amount"`
+		Type      hezCommon.TxType `json:"type"`
+		Nonce     hezCommon.Nonce  `json:"nonce"`
+		TxID      string           `json:"txId"`
+		Status    Status           `json:"status"`
+		Error     string           `json:"error,omitempty"`
+		// FillerTxID is the self transfer sent with the nonce of a failed
+		// row, so the txs with the next nonces are not stalled. The row
+		// gets a new nonce when sent again
+		FillerTxID string `json:"fillerTxId,omitempty"`
+	}
+
+	// Status represents a payout status
+	Status string
+
+	// job represents a payout ready to be signed and sent
+	job struct {
+		result Result
+		to     hermez.Recipient
+		amount *big.Int
+		intent policy.Intent
+	}
+)
+
+// New creates a new payout engine
+func New(c *client.Client, wallet *hermez.Wallet, cfg Config) *Engine {
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	return &Engine{client: c, wallet: wallet, cfg: cfg}
+}
+
+// Run validates and sends the payouts, writing each status change into
+// the result file. The rows are checked against the withdrawal policy
+// before reserving their nonces, the rows not authorized are rejected
+// without nonce. Running again with the same file and result file
+// resumes the payout: rows already sent are skipped, rows without
+// confirmation are checked into the node and rows failed are sent again
+// with the same nonce. The nonces of the rows failed below a sent nonce
+// are filled with a self transfer. It returns the final result of each row
+func (e *Engine) Run(payouts []Payout) (results []Result, err error) {
+	ctx, span := tracing.Start(context.Background(), "payout.Run",
+		attribute.String("hermez.token", e.cfg.Token.Symbol),
+		attribute.Int("payout.rows", len(payouts)),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	jobs, err := e.parse(payouts)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := loadResults(e.cfg.ResultPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fromIdx, nonce, err := transaction.GetAccountInfo(e.client, &e.wallet.HezBjjAddress, nil, e.cfg.Token.TokenID)
+	if err != nil {
+		return nil, err
+	}
+	accountNonce := nonce
+	for _, r := range previous {
+		if r.hasNonce() && r.Nonce >= nonce {
+			nonce = r.Nonce + 1
+		}
+	}
+
+	w, err := newResultWriter(e.cfg.ResultPath)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	// check the rows without confirmation into the node before any change,
+	// a lookup error stops the resume so a received tx is never sent again
+	for _, j := range jobs {
+		r, ok := previous[j.result.Row]
+		if !ok {
+			continue
+		}
+		if r.Recipient != j.result.Recipient || r.Amount != j.result.Amount {
+			return nil, errors.E("payout file changed since the last run",
+				errors.Params{"row": r.Row, "recipient": j.result.Recipient})
+		}
+		if r.Status == StatusSent {
+			continue
+		}
+		known, err := transaction.KnownTx(e.client, r.TxID)
+		if err != nil {
+			return nil, errors.E("cannot check the payout tx", err, errors.Params{"row": r.Row})
+		}
+		if known {
+			r.Status = StatusSent
+			previous[r.Row] = r
+		}
+	}
+
+	results = make([]Result, 0, len(jobs))
+	pending := make([]job, 0, len(jobs))
+	for _, j := range jobs {
+		r, ok := previous[j.result.Row]
+		if ok && r.Status == StatusSent {
+			r.Status = StatusSent
+			r.Error = ""
+			results = append(results, r)
+			continue
+		}
+
+		// check the withdrawal policy before reserving a nonce
+		j.intent = policy.Intent{
+			WalletIndex: e.wallet.Index,
+			FromIdx:     fromIdx,
+			Type:        j.to.Type,
+			Destination: policy.RecipientDestination(j.to),
+			TokenID:     e.cfg.Token.TokenID,
+			Amount:      j.amount,
+		}
+		authErr := transaction.Authorize(ctx, j.intent)
+		switch {
+		case ok && r.keepsNonce() && r.Nonce >= accountNonce:
+			// Keep the reserved nonce to not create a nonce gap, the
+			// nonce of a row not authorized anymore is filled
+			j.result.Nonce = r.Nonce
+			if authErr != nil {
+				j.result.Status = StatusFailed
+				j.result.Error = authErr.Error()
+				w.record(j.result)
+				results = append(results, j.result)
+				continue
+			}
+		case authErr != nil:
+			j.result.Status = StatusRejected
+			j.result.Error = authErr.Error()
+			w.record(j.result)
+			results = append(results, j.result)
+			continue
+		default:
+			j.result.Nonce = nonce
+			nonce++
+		}
+		pending = append(pending, j)
+	}
+
+	results = append(results, e.send(ctx, w, fromIdx, pending)...)
+	e.fillGaps(ctx, w, fromIdx, results)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Row < results[j].Row
+	})
+	for _, r := range results {
+		if r.Status != StatusSent {
+			logger.Warn("Payout not sent", logger.Params{"row": r.Row, "error": r.Error,
+				"filler_tx_id": r.FillerTxID})
+		}
+	}
+	return results, nil
+}
+
+// send signs and sends the jobs with bounded concurrency
+func (e *Engine) send(ctx context.Context, w *resultWriter, fromIdx hezCommon.Idx, jobs []job) []Result {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		results = make([]Result, 0, len(jobs))
+		sem     = make(chan struct{}, e.cfg.Concurrency)
+	)
+	for _, j := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(j job) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r := e.sendJob(ctx, fromIdx, j, w.record)
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}(j)
+	}
+	wg.Wait()
+	return results
+}
+
+// sendJob signs the job tx, records it as signed before send and
+// records the send result. The job intent must be authorized, it is
+// released if the tx is not signed or rejected by the pool
+func (e *Engine) sendJob(ctx context.Context, fromIdx hezCommon.Idx, j job, record func(Result)) Result {
+	r := j.result
+	ctx, span := tracing.Start(ctx, "payout.Row",
+		attribute.Int("payout.row", r.Row),
+		attribute.String("payout.recipient", r.Recipient),
+		attribute.Int64("hermez.nonce", int64(r.Nonce)),
+	)
+	var spanErr error
+	defer func() { tracing.End(span, spanErr) }()
+
+	tx, err := tracing.Sign(ctx, e.cfg.Token, func(ctx context.Context) (*hezCommon.PoolL2Tx, error) {
+		return e.createTx(ctx, fromIdx, j)
+	})
+	if err != nil {
+		transaction.Release(j.intent)
+		spanErr = err
+		r.Status = StatusFailed
+		r.Error = err.Error()
+		record(r)
+		return r
+	}
+	r.TxID = tx.TxID.String()
+	r.Status = StatusSigned
+	record(r)
+
+	if _, err := transaction.Send(ctx, e.client, *tx, e.cfg.Token); err != nil {
+		// the spend of a tx the pool could have received is kept
+		if !client.IsSentStateUnknown(err) {
+			transaction.Release(j.intent)
+		}
+		spanErr = err
+		r.Status = StatusFailed
+		r.Error = err.Error()
+		record(r)
+		return r
+	}
+	r.Status = StatusSent
+	record(r)
+	logger.Info("Payout sent", logger.Params{"row": r.Row, "tx_id": r.TxID, "nonce": r.Nonce})
+	return r
+}
+
+// fillGaps sends a self transfer with the nonce of each row failed below
+// the highest sent nonce, otherwise the pool never forges the txs with
+// the next nonces. The self transfer moves a zero amount to the wallet
+// account itself, so it pays no fee, and it is not checked by the
+// withdrawal policy. The results are updated in place
+func (e *Engine) fillGaps(ctx context.Context, w *resultWriter, fromIdx hezCommon.Idx, results []Result) {
+	var (
+		sent    bool
+		highest hezCommon.Nonce
+	)
+	for _, r := range results {
+		if (r.Status == StatusSent || r.FillerTxID != "") && (!sent || r.Nonce > highest) {
+			sent = true
+			highest = r.Nonce
+		}
+	}
+	for i := range results {
+		r := &results[i]
+		if !r.keepsNonce() || !sent || r.Nonce >= highest {
+			continue
+		}
+		// the send error can be a timeout of a tx accepted by the pool, the
+		// nonce is only filled if the node confirms the tx is absent
+		known, err := transaction.KnownTx(e.client, r.TxID)
+		if err != nil {
+			logger.Error(errors.E("cannot check the payout tx", err,
+				errors.Params{"row": r.Row, "nonce": r.Nonce}))
+			continue
+		}
+		if known {
+			r.Status = StatusSent
+			r.Error = ""
+			w.record(*r)
+			continue
+		}
+		nonce := r.Nonce
+		tx, err := tracing.Sign(ctx, e.cfg.Token, func(ctx context.Context) (*hezCommon.PoolL2Tx, error) {
+			return hermez.CreateTransfer(ctx, e.cfg.ChainID, fromIdx, big.NewInt(0), e.wallet.PrivateKey,
+				fromIdx, e.cfg.Token.TokenID, nonce, e.cfg.Fee)
+		})
+		if err == nil {
+			_, err = transaction.Send(ctx, e.client, *tx, e.cfg.Token)
+		}
+		if err != nil {
+			logger.Error(errors.E("cannot fill the payout nonce", err,
+				errors.Params{"row": r.Row, "nonce": r.Nonce}))
+			continue
+		}
+		r.FillerTxID = tx.TxID.String()
+		w.record(*r)
+		logger.Info("Payout nonce filled", logger.Params{"row": r.Row, "nonce": r.Nonce,
+			"filler_tx_id": r.FillerTxID})
+	}
+}
+
+// createTx creates and signs the payout tx by the recipient type
+func (e *Engine) createTx(ctx context.Context, fromIdx hezCommon.Idx, j job) (*hezCommon.PoolL2Tx, error) {
+	pk := e.wallet.PrivateKey
+	tokenID := e.cfg.Token.TokenID
+	switch j.to.Type {
+	case hezCommon.TxTypeTransfer:
+		return hermez.CreateTransfer(ctx, e.cfg.ChainID, j.to.Idx, j.amount, pk,
+			fromIdx, tokenID, j.result.Nonce, e.cfg.Fee)
+	case hezCommon.TxTypeTransferToEthAddr:
+		toEthAddr := strings.TrimPrefix(j.to.EthAddr, "hez:")
+		return hermez.CreateTransferToEthAddress(ctx, e.cfg.ChainID, toEthAddr, j.amount, pk,
+			fromIdx, tokenID, j.result.Nonce, e.cfg.Fee)
+	case hezCommon.TxTypeTransferToBJJ:
+		return hermez.CreateTransferToBjj(ctx, e.cfg.ChainID, j.to.BJJ, j.amount, pk,
+			fromIdx, tokenID, j.result.Nonce, e.cfg.Fee)
+	default:
+		return nil, errors.E("tx type not supported", errors.Params{"type": j.to.Type})
+	}
+}
+
+// hasNonce returns if the row nonce was reserved, sent or filled
+func (r Result) hasNonce() bool {
+	return r.Status == StatusSigned || r.Status == StatusSent || r.Status == StatusFailed || r.FillerTxID != ""
+}
+
+// keepsNonce returns if the row must be sent again with its nonce, a
+// filled nonce is already used by the filler tx
+func (r Result) keepsNonce() bool {
+	return (r.Status == StatusSigned || r.Status == StatusFailed) && r.FillerTxID == ""
+}
+
+// parse validates all payouts before send any tx
+func (e *Engine) parse(payouts []Payout) ([]job, error) {
+	jobs := make([]job, 0, len(payouts))
+	for i, p := range payouts {
+		params := errors.Params{"row": i, "recipient": p.Recipient, "amount": p.Amount}
+		to, err := parseRecipient(p.Recipient, e.cfg.Token.Symbol)
+		if err != nil {
+			return nil, errors.E("invalid payout recipient", err, params)
+		}
+		amount, ok := new(big.Int).SetString(p.Amount, 10)
+		if !ok || amount.Sign() <= 0 {
+			return nil, errors.E("invalid payout amount", params)
+		}
+		if _, err := hezCommon.NewFloat40(amount); err != nil {
+			return nil, errors.E("payout amount is not a valid float40", err, params)
+		}
+		jobs = append(jobs, job{
+			result: Result{
+				Row:       i,
+				Recipient: p.Recipient,
+				Amount:    p.Amount,
+				Type:      to.Type,
+			},
+			to:     to,
+			amount: amount,
+		})
+	}
+	return jobs, nil
+}
+
+// parseRecipient resolves the recipient string to the tx type
+func parseRecipient(s, tokenSymbol string) (hermez.Recipient, error) {
+	r, err := hermez.ParseRecipient(s)
+	if err != nil {
+		return hermez.Recipient{}, err
+	}
+	if r.TokenSymbol != "" && r.TokenSymbol != tokenSymbol {
+		return hermez.Recipient{}, errors.E("recipient token mismatch",
+			errors.Params{"symbol": r.TokenSymbol, "token": tokenSymbol})
+	}
+	return r, nil
+}
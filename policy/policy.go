@@ -0,0 +1,517 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-integration/hermez"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// ApprovalPending represents an intent waiting for a manual approval
+	ApprovalPending ApprovalStatus = "pending"
+	// ApprovalApproved represents an intent approved and not signed yet
+	ApprovalApproved ApprovalStatus = "approved"
+	// ApprovalRejected represents an intent rejected
+	ApprovalRejected ApprovalStatus = "rejected"
+	// ApprovalUsed represents an approved intent already authorized
+	ApprovalUsed ApprovalStatus = "used"
+
+	// DestinationExit is the destination of the exit txs
+	DestinationExit = "exit"
+
+	// dailyWindow is the window of the daily limits
+	dailyWindow = 24 * time.Hour
+)
+
+type (
+	// Engine represents the withdrawal policy engine consulted before
+	// signing an outgoing tx. The spends and the approval queue are
+	// persisted as a JSON file
+	Engine struct {
+		mu        sync.Mutex
+		path      string
+		cfg       Config
+		allow     map[string]bool
+		deny      map[string]bool
+		exempt    map[string]bool
+		spends    []Spend
+		approvals map[string]*Approval
+	}
+
+	// Config represents the policy rules
+	Config struct {
+		// Tokens are the amount limits by token, a token without limits
+		// is not limited
+		Tokens map[hezCommon.TokenID]TokenLimits
+		// Allow is the destinations allow list, if not empty only these
+		// destinations can receive txs. A destination can be a hez eth
+		// address, a hez BJJ address, an idx or "exit"
+		Allow []string
+		// Deny is the destinations deny list
+		Deny []string
+		// Exempt are the internal destinations, like the hot wallet of the
+		// sweeps, not checked by the limits and not counted by them. The
+		// deny list is still checked
+		Exempt []string
+		// Velocity limits the txs sent by each user wallet index
+		Velocity Velocity
+	}
+
+	// TokenLimits represents the amount limits of a token, in the token
+	// base unit. A nil limit is not checked
+	TokenLimits struct {
+		PerTx *big.Int
+		Daily *big.Int
+	}
+
+	// Velocity represents the maximum txs per wallet into a window
+	Velocity struct {
+		MaxTxs int
+		Window time.Duration
+	}
+
+	// Intent represents an outgoing tx to be authorized before signing
+	Intent struct {
+		WalletIndex int               `json:"walletIndex"`
+		FromIdx     hezCommon.Idx     `json:"fromIdx"`
+		Type        hezCommon.TxType  `json:"type"`
+		Destination string            `json:"destination"`
+		TokenID     hezCommon.TokenID `json:"tokenId"`
+		Amount      *big.Int          `json:"amount"`
+	}
+
+	// Spend represents an authorized intent counted by the limits
+	Spend struct {
+		IntentID    string            `json:"intentId"`
+		WalletIndex int               `json:"walletIndex"`
+		TokenID     hezCommon.TokenID `json:"tokenId"`
+		Amount      *big.Int          `json:"amount"`
+		Time        time.Time         `json:"time"`
+	}
+
+	// Approval represents an intent exceeding the limits queued for a
+	// manual approval
+	Approval struct {
+		ID        string         `json:"id"`
+		Intent    Intent         `json:"intent"`
+		Reasons   []string       `json:"reasons"`
+		Status    ApprovalStatus `json:"status"`
+		CreatedAt time.Time      `json:"createdAt"`
+		DecidedBy string         `json:"decidedBy,omitempty"`
+		DecidedAt *time.Time     `json:"decidedAt,omitempty"`
+	}
+
+	// ApprovalStatus represents the approval status
+	ApprovalStatus string
+
+	// state represents the persisted engine state
+	state struct {
+		Spends    []Spend     `json:"spends"`
+		Approvals []*Approval `json:"approvals"`
+	}
+)
+
+// New creates the policy engine and loads the state from the file path. A
+// missing file starts an empty state. An empty path keeps the state in
+// memory
+func New(path string, cfg Config) (*Engine, error) {
+	e := &Engine{
+		path:      path,
+		cfg:       cfg,
+		allow:     make(map[string]bool),
+		deny:      make(map[string]bool),
+		exempt:    make(map[string]bool),
+		approvals: make(map[string]*Approval),
+	}
+	for _, d := range cfg.Allow {
+		dest, err := ParseDestination(d)
+		if err != nil {
+			return nil, errors.E("invalid allow list destination", err, errors.Params{"destination": d})
+		}
+		e.allow[dest] = true
+	}
+	for _, d := range cfg.Deny {
+		dest, err := ParseDestination(d)
+		if err != nil {
+			return nil, errors.E("invalid deny list destination", err, errors.Params{"destination": d})
+		}
+		e.deny[dest] = true
+	}
+	for _, d := range cfg.Exempt {
+		dest, err := ParseDestination(d)
+		if err != nil {
+			return nil, errors.E("invalid exempt destination", err, errors.Params{"destination": d})
+		}
+		e.exempt[dest] = true
+	}
+	if path == "" {
+		return e, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, errors.E("cannot read the policy state", err, errors.Params{"path": path})
+	}
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.E("invalid policy state file", err, errors.Params{"path": path})
+	}
+	e.spends = s.Spends
+	for _, a := range s.Approvals {
+		e.approvals[a.ID] = a
+	}
+	return e, nil
+}
+
+// Authorize checks the intent against the policy before signing. A
+// denied destination or a rejected intent returns an error. An intent
+// exceeding the limits is queued for a manual approval and returns an
+// error with the approval id, once approved the same intent is authorized
+// one time. Authorized intents are counted by the limits until released
+func (e *Engine) Authorize(intent Intent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.checkDestination(intent); err != nil {
+		return err
+	}
+	if intent.Amount == nil || intent.Amount.Sign() < 0 {
+		return errors.E("invalid intent amount", errors.Params{"destination": intent.Destination})
+	}
+	if e.exempt[intent.Destination] {
+		logger.Debug("Exempt intent authorized", logger.Params{"destination": intent.Destination})
+		return nil
+	}
+
+	now := time.Now().UTC()
+	e.prune(now)
+	id := intent.ID()
+	if a, ok := e.approvals[id]; ok {
+		switch a.Status {
+		case ApprovalApproved:
+			a.Status = ApprovalUsed
+			e.spend(intent, now)
+			logger.Info("Approved intent authorized", logger.Params{"approval_id": id, "approved_by": a.DecidedBy})
+			return e.save()
+		case ApprovalRejected:
+			return errors.E("intent rejected", errors.Params{"approval_id": id, "rejected_by": a.DecidedBy})
+		}
+	}
+
+	reasons := e.violations(intent, now)
+	if len(reasons) == 0 {
+		e.spend(intent, now)
+		return e.save()
+	}
+
+	if a, ok := e.approvals[id]; !ok || a.Status != ApprovalPending {
+		e.approvals[id] = &Approval{
+			ID:        id,
+			Intent:    intent,
+			Reasons:   reasons,
+			Status:    ApprovalPending,
+			CreatedAt: now,
+		}
+		if err := e.save(); err != nil {
+			return err
+		}
+		logger.Info("Intent queued for approval", logger.Params{
+			"approval_id": id,
+			"destination": intent.Destination,
+			"amount":      intent.Amount.String(),
+			"reasons":     strings.Join(reasons, ", "),
+		})
+	}
+	return errors.E("manual approval required", errors.Params{
+		"approval_id": id,
+		"reasons":     strings.Join(reasons, ", "),
+	})
+}
+
+// AuthorizeApproved checks the intent of a tx already approved out of
+// the policy, by an M-of-N proposal, against the destination lists. The
+// limits are not checked but the intent is counted by them until released
+func (e *Engine) AuthorizeApproved(intent Intent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.checkDestination(intent); err != nil {
+		return err
+	}
+	if intent.Amount == nil || intent.Amount.Sign() < 0 {
+		return errors.E("invalid intent amount", errors.Params{"destination": intent.Destination})
+	}
+	if e.exempt[intent.Destination] {
+		return nil
+	}
+	now := time.Now().UTC()
+	e.prune(now)
+	e.spend(intent, now)
+	return e.save()
+}
+
+// Exempt returns if the destination is exempt from the limits
+func (e *Engine) Exempt(destination string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.exempt[destination]
+}
+
+// Release stops counting an authorized intent whose tx was not sent, the
+// tx was not signed or the pool did not accept it. An approved intent can
+// be authorized again
+func (e *Engine) Release(intent Intent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	id := intent.ID()
+	for i := len(e.spends) - 1; i >= 0; i-- {
+		if e.spends[i].IntentID != id {
+			continue
+		}
+		e.spends = append(e.spends[:i], e.spends[i+1:]...)
+		if a, ok := e.approvals[id]; ok && a.Status == ApprovalUsed {
+			a.Status = ApprovalApproved
+		}
+		logger.Info("Intent released", logger.Params{"intent_id": id, "destination": intent.Destination})
+		return e.save()
+	}
+	return nil
+}
+
+// Pending returns the intents waiting for a manual approval, the oldest
+// first
+func (e *Engine) Pending() []Approval {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pending := make([]Approval, 0)
+	for _, a := range e.approvals {
+		if a.Status == ApprovalPending {
+			pending = append(pending, *a)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+	return pending
+}
+
+// Approval returns an approval of the queue
+func (e *Engine) Approval(id string) (Approval, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	a, ok := e.approvals[id]
+	if !ok {
+		return Approval{}, false
+	}
+	return *a, true
+}
+
+// Approve approves a pending intent, the next authorization of the same
+// intent passes the limits
+func (e *Engine) Approve(id, operator string) error {
+	return e.decide(id, operator, ApprovalApproved)
+}
+
+// Reject rejects a pending intent, the same intent is denied from now on
+func (e *Engine) Reject(id, operator string) error {
+	return e.decide(id, operator, ApprovalRejected)
+}
+
+// decide sets the decision of a pending intent
+func (e *Engine) decide(id, operator string, status ApprovalStatus) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	a, ok := e.approvals[id]
+	if !ok {
+		return errors.E("approval not found", errors.Params{"approval_id": id})
+	}
+	if a.Status != ApprovalPending {
+		return errors.E("approval already decided", errors.Params{"approval_id": id, "status": a.Status})
+	}
+	if operator == "" {
+		return errors.E("approval operator not defined", errors.Params{"approval_id": id})
+	}
+	now := time.Now().UTC()
+	a.Status = status
+	a.DecidedBy = operator
+	a.DecidedAt = &now
+	logger.Info("Intent decided", logger.Params{"approval_id": id, "status": status, "operator": operator})
+	return e.save()
+}
+
+// checkDestination checks the destination allow and deny lists
+func (e *Engine) checkDestination(intent Intent) error {
+	if e.deny[intent.Destination] {
+		return errors.E("destination denied", errors.Params{"destination": intent.Destination})
+	}
+	if len(e.allow) > 0 && !e.allow[intent.Destination] && !e.exempt[intent.Destination] {
+		return errors.E("destination not allowed", errors.Params{"destination": intent.Destination})
+	}
+	return nil
+}
+
+// violations returns the limits exceeded by the intent
+func (e *Engine) violations(intent Intent, now time.Time) []string {
+	reasons := make([]string, 0)
+	if limits, ok := e.cfg.Tokens[intent.TokenID]; ok {
+		if limits.PerTx != nil && intent.Amount.Cmp(limits.PerTx) > 0 {
+			reasons = append(reasons, fmt.Sprintf("per tx limit %s exceeded", limits.PerTx))
+		}
+		if limits.Daily != nil {
+			total := new(big.Int).Set(intent.Amount)
+			for _, s := range e.spends {
+				if s.TokenID == intent.TokenID && now.Sub(s.Time) < dailyWindow {
+					total.Add(total, s.Amount)
+				}
+			}
+			if total.Cmp(limits.Daily) > 0 {
+				reasons = append(reasons, fmt.Sprintf("daily limit %s exceeded", limits.Daily))
+			}
+		}
+	}
+	if v := e.cfg.Velocity; v.MaxTxs > 0 && v.Window > 0 {
+		count := 1
+		for _, s := range e.spends {
+			if s.WalletIndex == intent.WalletIndex && now.Sub(s.Time) < v.Window {
+				count++
+			}
+		}
+		if count > v.MaxTxs {
+			reasons = append(reasons, fmt.Sprintf("velocity limit %d txs per %s exceeded", v.MaxTxs, v.Window))
+		}
+	}
+	return reasons
+}
+
+// spend records an authorized intent, the caller must hold the lock
+func (e *Engine) spend(intent Intent, now time.Time) {
+	e.spends = append(e.spends, Spend{
+		IntentID:    intent.ID(),
+		WalletIndex: intent.WalletIndex,
+		TokenID:     intent.TokenID,
+		Amount:      new(big.Int).Set(intent.Amount),
+		Time:        now,
+	})
+}
+
+// prune removes the spends out of the limits windows, the caller must
+// hold the lock
+func (e *Engine) prune(now time.Time) {
+	window := dailyWindow
+	if e.cfg.Velocity.Window > window {
+		window = e.cfg.Velocity.Window
+	}
+	spends := e.spends[:0]
+	for _, s := range e.spends {
+		if now.Sub(s.Time) < window {
+			spends = append(spends, s)
+		}
+	}
+	e.spends = spends
+}
+
+// save writes the state into a temporary file and renames it, so a crash
+// never leaves a partial file. The caller must hold the lock
+func (e *Engine) save() error {
+	if e.path == "" {
+		return nil
+	}
+	s := state{Spends: e.spends, Approvals: make([]*Approval, 0, len(e.approvals))}
+	for _, a := range e.approvals {
+		s.Approvals = append(s.Approvals, a)
+	}
+	sort.Slice(s.Approvals, func(i, j int) bool {
+		return s.Approvals[i].CreatedAt.Before(s.Approvals[j].CreatedAt)
+	})
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := e.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.E("cannot write the policy state", err, errors.Params{"path": tmp})
+	}
+	return os.Rename(tmp, e.path)
+}
+
+// ID returns the intent id, the same intent always has the same id
+func (i Intent) ID() string {
+	amount := "0"
+	if i.Amount != nil {
+		amount = i.Amount.String()
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%d|%s|%s|%d|%s",
+		i.WalletIndex, i.FromIdx, i.Type, i.Destination, i.TokenID, amount)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ParseDestination normalizes a destination: a hez eth address, a hez BJJ
+// address, an idx (hez:ETH:256 or 256) or "exit"
+func ParseDestination(s string) (string, error) {
+	if s == DestinationExit {
+		return DestinationExit, nil
+	}
+	r, err := hermez.ParseRecipient(s)
+	if err != nil {
+		return "", err
+	}
+	return RecipientDestination(r), nil
+}
+
+// RecipientDestination returns the destination of a parsed recipient
+func RecipientDestination(r hermez.Recipient) string {
+	switch r.Type {
+	case hezCommon.TxTypeTransferToEthAddr:
+		return EthDestination(r.EthAddr)
+	case hezCommon.TxTypeTransferToBJJ:
+		return BJJDestination(r.BJJ)
+	default:
+		return IdxDestination(r.Idx)
+	}
+}
+
+// EthDestination returns the destination of a hez eth address
+func EthDestination(hezEthAddr string) string {
+	return "hez:" + ethCommon.HexToAddress(strings.TrimPrefix(hezEthAddr, "hez:")).String()
+}
+
+// BJJDestination returns the destination of a hez BJJ address
+func BJJDestination(hezBjjAddr string) string {
+	return "hez:" + strings.TrimPrefix(hezBjjAddr, "hez:")
+}
+
+// IdxDestination returns the destination of an idx
+func IdxDestination(idx hezCommon.Idx) string {
+	return idx.String()
+}
+
+// TxDestination returns the destination of a tx object
+func TxDestination(tx *hezCommon.PoolL2Tx) string {
+	switch {
+	case tx.Type == hezCommon.TxTypeExit:
+		return DestinationExit
+	case tx.ToIdx != 0:
+		return IdxDestination(tx.ToIdx)
+	case tx.ToEthAddr != hezCommon.EmptyAddr && tx.ToEthAddr != hezCommon.FFAddr:
+		return EthDestination(tx.ToEthAddr.String())
+	default:
+		return BJJDestination(hermez.NewHezBJJ(tx.ToBJJ))
+	}
+}
@@ -0,0 +1,232 @@
+package sweep
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/hermez"
+	"github.com/hermeznetwork/hermez-integration/tracing"
+	"github.com/hermeznetwork/hermez-integration/transaction"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+type (
+	// Sweeper represents the service that consolidates the user
+	// accounts balances into the exchange hot wallet
+	Sweeper struct {
+		client  *client.Client
+		wallets []*hermez.Wallet
+		cfg     Config
+		// pending keeps the last sweep tx id per account idx
+		pending map[hezCommon.Idx]string
+	}
+
+	// Config represents the sweeper configuration
+	Config struct {
+		ChainID uint16
+		// DryRun only reports the transfers without sign and send
+		DryRun bool
+		// Tokens maps the token id to the sweep rules,
+		// tokens not listed are never swept
+		Tokens map[hezCommon.TokenID]TokenConfig
+	}
+
+	// TokenConfig represents the sweep rules for a token
+	TokenConfig struct {
+		// HotWalletIdx is the hot wallet account to receive the funds
+		HotWalletIdx hezCommon.Idx
+		// Threshold is the minimum balance to sweep an account
+		Threshold *big.Int
+		// Fee is the fee selector used by the sweep transfers
+		Fee hezCommon.FeeSelector
+	}
+
+	// Report represents the result of a sweep round
+	Report struct {
+		Timestamp time.Time `json:"timestamp"`
+		DryRun    bool      `json:"dryRun"`
+		Moves     []Move    `json:"moves"`
+		Skipped   int       `json:"skipped"`
+	}
+
+	// Move represents a transfer from an user account to the hot wallet
+	Move struct {
+		WalletIndex int                   `json:"walletIndex"`
+		FromIdx     hezCommon.Idx         `json:"fromIdx"`
+		ToIdx       hezCommon.Idx         `json:"toIdx"`
+		Token       string                `json:"token"`
+		Balance     *big.Int              `json:"balance"`
+		Amount      *big.Int              `json:"amount"`
+		FeeAmount   *big.Int              `json:"feeAmount"`
+		Fee         hezCommon.FeeSelector `json:"fee"`
+		Nonce       hezCommon.Nonce       `json:"nonce"`
+		TxID        string                `json:"txId,omitempty"`
+	}
+)
+
+// New creates a new sweeper for the user wallets. The wallet index
+// reported into the moves is the position into the wallets slice
+func New(c *client.Client, wallets []*hermez.Wallet, cfg Config) (*Sweeper, error) {
+	for tokenID, t := range cfg.Tokens {
+		params := errors.Params{"token_id": tokenID}
+		if t.HotWalletIdx <= hezCommon.Idx(1) {
+			return nil, errors.E("invalid hot wallet idx", params)
+		}
+		if t.Threshold == nil || t.Threshold.Sign() <= 0 {
+			return nil, errors.E("sweep threshold must be greater than zero", params)
+		}
+		if _, err := hermez.MaxTransferAmount(t.Threshold, t.Fee); err != nil {
+			return nil, errors.E("invalid sweep fee", err, params)
+		}
+	}
+	return &Sweeper{
+		client:  c,
+		wallets: wallets,
+		cfg:     cfg,
+		pending: make(map[hezCommon.Idx]string),
+	}, nil
+}
+
+// Run sweeps the user accounts periodically
+func (s *Sweeper) Run(interval time.Duration) func() error {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ticker.C:
+				// a failed round still reports the moves already sent
+				report, err := s.Sweep()
+				if err != nil {
+					logger.Error(errors.E("cannot sweep the accounts", err))
+				}
+				for _, m := range report.Moves {
+					logger.Info("Sweep", logger.Params{
+						"dry_run":      report.DryRun,
+						"wallet_index": m.WalletIndex,
+						"from_idx":     m.FromIdx,
+						"to_idx":       m.ToIdx,
+						"token":        m.Token,
+						"amount":       m.Amount.String(),
+						"fee_amount":   m.FeeAmount.String(),
+						"tx_id":        m.TxID,
+					})
+				}
+				logger.Info("Sweep report", logger.Params{
+					"dry_run": report.DryRun,
+					"moves":   len(report.Moves),
+					"skipped": report.Skipped,
+				})
+			}
+		}
+	}
+}
+
+// Sweep scans all user accounts and transfers the balances above the
+// token threshold to the hot wallet. It returns a report of the moves,
+// on error the report has the moves sent before the error
+func (s *Sweeper) Sweep() (report *Report, err error) {
+	ctx, span := tracing.Start(context.Background(), "sweep.Sweep")
+	defer func() { tracing.End(span, err) }()
+	report = &Report{
+		Timestamp: time.Now(),
+		DryRun:    s.cfg.DryRun,
+		Moves:     make([]Move, 0),
+	}
+	for i, w := range s.wallets {
+		ac, accountErr := s.client.GetAccounts(&w.HezBjjAddress, nil)
+		if client.IsNotRegistered(accountErr) {
+			// wallet without accounts into the network
+			logger.Debug("Sweep account not found", logger.Params{
+				"wallet_index": i,
+				"bjj_address":  w.HezBjjAddress,
+			})
+			continue
+		}
+		if accountErr != nil {
+			return report, errors.E("cannot get the sweep accounts", accountErr,
+				errors.Params{"wallet_index": i, "bjj_address": w.HezBjjAddress})
+		}
+		for _, account := range ac.Accounts {
+			move, ok, err := s.sweepAccount(ctx, i, w, account)
+			if err != nil {
+				return report, err
+			}
+			if !ok {
+				report.Skipped++
+				continue
+			}
+			report.Moves = append(report.Moves, move)
+		}
+	}
+	return report, nil
+}
+
+// sweepAccount transfers the account balance to the hot wallet if the
+// balance is above the threshold. It returns false if was skipped
+func (s *Sweeper) sweepAccount(ctx context.Context, index int, w *hermez.Wallet, account client.Account) (Move, bool, error) {
+	tokenCfg, ok := s.cfg.Tokens[account.Token.TokenID]
+	if !ok || account.Balance == nil {
+		return Move{}, false, nil
+	}
+	fromIdx := hezCommon.Idx(account.Idx)
+	balance := &account.Balance.Int
+	if fromIdx == tokenCfg.HotWalletIdx || balance.Cmp(tokenCfg.Threshold) < 0 {
+		return Move{}, false, nil
+	}
+	if s.isPending(fromIdx) {
+		return Move{}, false, nil
+	}
+
+	amount, err := hermez.MaxTransferAmount(balance, tokenCfg.Fee)
+	if err != nil {
+		return Move{}, false, err
+	}
+	feeAmount, err := hezCommon.CalcFeeAmount(amount, tokenCfg.Fee)
+	if err != nil {
+		return Move{}, false, err
+	}
+	move := Move{
+		WalletIndex: index,
+		FromIdx:     fromIdx,
+		ToIdx:       tokenCfg.HotWalletIdx,
+		Token:       account.Token.Symbol,
+		Balance:     new(big.Int).Set(balance),
+		Amount:      amount,
+		FeeAmount:   feeAmount,
+		Fee:         tokenCfg.Fee,
+		Nonce:       account.Nonce,
+	}
+	if s.cfg.DryRun {
+		return move, true, nil
+	}
+
+	txID, err := transaction.Transfer(ctx, w, s.client, s.cfg.ChainID, fromIdx,
+		tokenCfg.HotWalletIdx, amount, tokenCfg.Fee, account.Token, account.Nonce)
+	if err != nil {
+		return Move{}, false, errors.E("sweep transfer failure", err,
+			errors.Params{"from_idx": fromIdx, "wallet_index": index})
+	}
+	move.TxID = txID
+	s.pending[fromIdx] = txID
+	return move, true, nil
+}
+
+// isPending check if the last sweep tx from the account still into the pool
+func (s *Sweeper) isPending(idx hezCommon.Idx) bool {
+	txID, ok := s.pending[idx]
+	if !ok {
+		return false
+	}
+	poolTx, err := s.client.GetPoolTx(txID)
+	if err == nil && poolTx != nil && poolTx.TxID.String() == txID &&
+		poolTx.State != hezCommon.PoolL2TxStateForged &&
+		poolTx.State != hezCommon.PoolL2TxStateInvalid {
+		return true
+	}
+	delete(s.pending, idx)
+	return false
+}
@@ -0,0 +1,238 @@
+package syncdb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/track"
+	"github.com/hermeznetwork/hermez-node/api/apitypes"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"github.com/hermeznetwork/hermez-node/db"
+	"github.com/hermeznetwork/hermez-node/db/historydb"
+	"github.com/hermeznetwork/hermez-node/db/l2db"
+	"github.com/hermeznetwork/tracerr"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// pageSize is the number of rows fetched per query
+	pageSize = uint(1000)
+)
+
+// DB must be a tracker data source, an account reader and a block reader
+var (
+	_ track.Source         = (*DB)(nil)
+	_ client.AccountReader = (*DB)(nil)
+	_ client.BlockReader   = (*DB)(nil)
+)
+
+type (
+	// DB represents a read-only data source over the PostgreSQL database
+	// of a hermez-node running as synchronizer. It implements the same
+	// methods of the node API client used by the trackers, without the
+	// API rate limits
+	DB struct {
+		sql  *sqlx.DB
+		hdb  *historydb.HistoryDB
+		l2db *l2db.L2DB
+	}
+
+	// Config represents the synchronizer database configuration
+	Config struct {
+		Host     string
+		Port     int
+		User     string
+		Password string
+		Name     string
+		// MaxConnections is the maximum number of concurrent queries
+		MaxConnections int
+		// Timeout is the maximum time waiting for a free connection
+		Timeout time.Duration
+	}
+)
+
+// Open connects to the synchronizer database. The node database queries
+// are used, so the schema must match the hermez-node version
+func Open(cfg Config) (*DB, error) {
+	if cfg.MaxConnections <= 0 {
+		cfg.MaxConnections = 10
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	sqlDB, err := db.ConnectSQLDB(cfg.Port, cfg.Host, cfg.User, cfg.Password, cfg.Name)
+	if err != nil {
+		return nil, errors.E("cannot connect to the synchronizer database", err,
+			errors.Params{"host": cfg.Host, "port": cfg.Port, "name": cfg.Name})
+	}
+	apiConnCon := db.NewAPIConnectionController(cfg.MaxConnections, cfg.Timeout)
+	logger.Info("Synchronizer database connected", logger.Params{"host": cfg.Host, "name": cfg.Name})
+	return &DB{
+		sql:  sqlDB,
+		hdb:  historydb.NewHistoryDB(sqlDB, sqlDB, apiConnCon),
+		l2db: l2db.NewL2DB(sqlDB, sqlDB, 0, 0, 0, 0, 0, apiConnCon),
+	}, nil
+}
+
+// Close closes the database connection
+func (d *DB) Close() error {
+	return d.sql.Close()
+}
+
+// GetLastBatch get last Hermez rollup batch
+func (d *DB) GetLastBatch() (*client.Batch, error) {
+	limit := uint(1)
+	batches, _, err := d.hdb.GetBatchesAPI(nil, nil, nil, nil, nil, &limit, historydb.OrderDesc)
+	if err != nil {
+		return nil, errors.E("cannot get the last batch", tracerr.Unwrap(err))
+	}
+	if len(batches) == 0 {
+		return nil, errors.E("batch not found")
+	}
+	var result client.Batch
+	return &result, convert(batches[0], &result)
+}
+
+// GetBatch get a forged batch by number
+func (d *DB) GetBatch(batchNum hezCommon.BatchNum) (*client.Batch, error) {
+	batch, err := d.hdb.GetBatchAPI(batchNum)
+	if err != nil {
+		return nil, errors.E("cannot get the batch", tracerr.Unwrap(err), errors.Params{"batch": batchNum})
+	}
+	var result client.Batch
+	return &result, convert(batch, &result)
+}
+
+// GetLastEthBlock get the last Ethereum block synchronized into the
+// database
+func (d *DB) GetLastEthBlock() (int64, error) {
+	block, err := d.hdb.GetLastBlockAPI()
+	if err != nil {
+		return 0, errors.E("cannot get the last block", tracerr.Unwrap(err))
+	}
+	return block.Num, nil
+}
+
+// GetBatchTxs get all transactions history from a batch number
+func (d *DB) GetBatchTxs(batchNum hezCommon.BatchNum) (*client.TxAPI, error) {
+	var (
+		num      = uint(batchNum)
+		limit    = pageSize
+		fromItem *uint
+		txs      = make([]historydb.TxAPI, 0)
+	)
+	for {
+		page, _, err := d.hdb.GetTxsAPI(nil, nil, nil, nil, &num, nil,
+			fromItem, &limit, historydb.OrderAsc)
+		if err != nil {
+			return nil, errors.E("cannot get the batch txs", tracerr.Unwrap(err),
+				errors.Params{"batch": batchNum})
+		}
+		txs = append(txs, page...)
+		if uint(len(page)) < limit {
+			break
+		}
+		next := uint(page[len(page)-1].ItemID + 1)
+		fromItem = &next
+	}
+	result := &client.TxAPI{}
+	return result, convert(txs, &result.Txs)
+}
+
+// GetTx get a transaction by tx ID. It returns nil if the tx is not found
+func (d *DB) GetTx(txID string) (*client.TxHistory, error) {
+	id, err := hezCommon.NewTxIDFromString(txID)
+	if err != nil {
+		return nil, errors.E("invalid tx id", err, errors.Params{"tx_id": txID})
+	}
+	tx, err := d.hdb.GetTxAPI(id)
+	if tracerr.Unwrap(err) == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.E("cannot get the tx", tracerr.Unwrap(err), errors.Params{"tx_id": txID})
+	}
+	var result client.TxHistory
+	return &result, convert(tx, &result)
+}
+
+// GetPoolTx get a pool transaction by tx ID. It returns nil if the tx is
+// not found
+func (d *DB) GetPoolTx(txID string) (*client.TxHistory, error) {
+	id, err := hezCommon.NewTxIDFromString(txID)
+	if err != nil {
+		return nil, errors.E("invalid tx id", err, errors.Params{"tx_id": txID})
+	}
+	tx, err := d.l2db.GetTxAPI(id)
+	if tracerr.Unwrap(err) == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.E("cannot get the pool tx", tracerr.Unwrap(err), errors.Params{"tx_id": txID})
+	}
+	var result client.TxHistory
+	return &result, convert(tx, &result)
+}
+
+// GetAccount get the accounts of the hermez-integration address for the
+// token id
+func (d *DB) GetAccount(bjjAddress, hezEthAddress *string, tokenID hezCommon.TokenID) (*client.AccountAPI, error) {
+	return d.addressAccounts(bjjAddress, hezEthAddress, []hezCommon.TokenID{tokenID})
+}
+
+// GetAccounts get the accounts of all tokens of the hermez-integration
+// address
+func (d *DB) GetAccounts(bjjAddress, hezEthAddress *string) (*client.AccountAPI, error) {
+	return d.addressAccounts(bjjAddress, hezEthAddress, nil)
+}
+
+// addressAccounts get the accounts of the address filtered by the token
+// ids, all tokens without token ids
+func (d *DB) addressAccounts(bjjAddress, hezEthAddress *string, tokenIDs []hezCommon.TokenID) (*client.AccountAPI, error) {
+	if bjjAddress == nil && hezEthAddress == nil {
+		return nil, errors.E("bjjAddress or hezEthAddress must be defined")
+	}
+	limit := pageSize
+	var (
+		ethAddr *ethCommon.Address
+		bjj     *babyjub.PublicKeyComp
+	)
+	if hezEthAddress != nil {
+		addr, err := apitypes.HezEthAddr(*hezEthAddress).ToEthAddr()
+		if err != nil {
+			return nil, errors.E("invalid eth address", err, errors.Params{"eth_address": *hezEthAddress})
+		}
+		ethAddr = &addr
+	} else {
+		pk, err := apitypes.HezBJJ(*bjjAddress).ToBJJ()
+		if err != nil {
+			return nil, errors.E("invalid bjj address", err, errors.Params{"bjj_address": *bjjAddress})
+		}
+		bjj = &pk
+	}
+	accounts, _, err := d.hdb.GetAccountsAPI(tokenIDs, ethAddr, bjj, nil, &limit, historydb.OrderAsc)
+	if err != nil {
+		return nil, errors.E("cannot get the accounts", tracerr.Unwrap(err), errors.Params{"token_ids": tokenIDs})
+	}
+	if len(accounts) == 0 {
+		return nil, errors.E(client.AccountNotRegistered, errors.Params{"token_ids": tokenIDs})
+	}
+	result := &client.AccountAPI{}
+	return result, convert(accounts, &result.Accounts)
+}
+
+// convert converts the node database views into the API client models.
+// The views are marshaled as the node API responses
+func convert(from, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
@@ -0,0 +1,235 @@
+package syncdb
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-node/api/apitypes"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"github.com/hermeznetwork/hermez-node/db/historydb"
+	"github.com/hermeznetwork/hermez-node/db/l2db"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+var (
+	fixtureEthAddr = ethCommon.HexToAddress("0x0000000000000000000000000000000000000001")
+	fixtureBJJ     = fixturePublicKey()
+	fixtureTime    = time.Date(2021, 4, 20, 10, 30, 0, 0, time.UTC)
+)
+
+// fixturePublicKey returns the compressed public key of a fixed private key
+func fixturePublicKey() babyjub.PublicKeyComp {
+	var sk babyjub.PrivateKey
+	copy(sk[:], []byte("hermez-integration syncdb fixture"))
+	return sk.Public().Compress()
+}
+
+func TestConvertBatch(t *testing.T) {
+	forgeL1TxsNum := int64(7)
+	batch := historydb.BatchAPI{
+		ItemID:      3,
+		BatchNum:    42,
+		EthBlockNum: 1200,
+		Timestamp:   fixtureTime,
+		ForgerAddr:  fixtureEthAddr,
+		CollectedFeesAPI: apitypes.NewCollectedFeesAPI(map[hezCommon.TokenID]*big.Int{
+			0: big.NewInt(150),
+		}),
+		StateRoot:     "1234",
+		NumAccounts:   9,
+		ExitRoot:      "5678",
+		ForgeL1TxsNum: &forgeL1TxsNum,
+		SlotNum:       11,
+		ForgedTxs:     2,
+	}
+
+	var result client.Batch
+	if err := convert(batch, &result); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if result.BatchNum != 42 || result.EthBlockNum != 1200 || result.ItemID != 3 {
+		t.Errorf("unexpected batch numbers: %+v", result)
+	}
+	if !result.Timestamp.Equal(fixtureTime) || result.ForgerAddr != fixtureEthAddr {
+		t.Errorf("unexpected batch forge: %+v", result)
+	}
+	if result.StateRoot != "1234" || result.ExitRoot != "5678" {
+		t.Errorf("unexpected batch roots: %s %s", result.StateRoot, result.ExitRoot)
+	}
+	if result.ForgeL1TxsNum == nil || *result.ForgeL1TxsNum != 7 || result.ForgedTxs != 2 {
+		t.Errorf("unexpected batch txs: %+v", result)
+	}
+}
+
+func TestConvertDepositTx(t *testing.T) {
+	var (
+		fromIdx       = apitypes.HezIdx("hez:ETH:256")
+		fromEthAddr   = apitypes.NewHezEthAddr(fixtureEthAddr)
+		fromBJJ       = apitypes.NewHezBJJ(fixtureBJJ)
+		batchNum      = hezCommon.BatchNum(42)
+		toForge       = int64(7)
+		userOrigin    = true
+		depositAmount = apitypes.BigIntStr("1000000000000000000")
+	)
+	txs := []historydb.TxAPI{{
+		IsL1:                 true,
+		TxID:                 hezCommon.TxID{0x10, 0x01},
+		ItemID:               5,
+		Type:                 hezCommon.TxTypeDeposit,
+		FromIdx:              &fromIdx,
+		FromEthAddr:          &fromEthAddr,
+		FromBJJ:              &fromBJJ,
+		ToIdx:                "hez:ETH:0",
+		Amount:               "0",
+		BatchNum:             &batchNum,
+		EthBlockNum:          1150,
+		ToForgeL1TxsNum:      &toForge,
+		UserOrigin:           &userOrigin,
+		DepositAmount:        &depositAmount,
+		AmountSuccess:        true,
+		DepositAmountSuccess: true,
+		Timestamp:            fixtureTime,
+		TokenID:              0,
+		TokenSymbol:          "ETH",
+		TokenDecimals:        18,
+	}}
+
+	result := &client.TxAPI{}
+	if err := convert(txs, &result.Txs); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if len(result.Txs) != 1 {
+		t.Fatalf("unexpected txs: %d", len(result.Txs))
+	}
+	tx := result.Txs[0]
+	if tx.TxID != txs[0].TxID || tx.Type != hezCommon.TxTypeDeposit || tx.L1orL2 != "L1" {
+		t.Errorf("unexpected tx: %+v", tx)
+	}
+	if hezCommon.Idx(tx.FromIdx) != 256 || tx.FromEthAddr != fromEthAddr || tx.FromBJJ != fromBJJ {
+		t.Errorf("unexpected tx sender: %+v", tx)
+	}
+	if tx.BatchNum != batchNum || tx.Token.Symbol != "ETH" || tx.Token.Decimals != 18 {
+		t.Errorf("unexpected tx batch or token: %+v", tx)
+	}
+	if tx.L1Info == nil {
+		t.Fatal("L1 info not converted")
+	}
+	if tx.L1Info.DepositAmount != depositAmount || !tx.L1Info.DepositAmountSuccess || tx.L1Info.EthBlockNum != 1150 {
+		t.Errorf("unexpected L1 info: %+v", tx.L1Info)
+	}
+}
+
+func TestConvertPoolTx(t *testing.T) {
+	toIdx := apitypes.HezIdx("hez:ETH:257")
+	tx := l2db.PoolTxAPI{
+		TxID:          hezCommon.TxID{0x02, 0x01},
+		FromIdx:       "hez:ETH:256",
+		ToIdx:         &toIdx,
+		Amount:        "250",
+		Fee:           126,
+		Nonce:         3,
+		State:         hezCommon.PoolL2TxStatePending,
+		Type:          hezCommon.TxTypeTransfer,
+		Timestamp:     fixtureTime,
+		TokenID:       0,
+		TokenSymbol:   "ETH",
+		TokenDecimals: 18,
+	}
+
+	var result client.TxHistory
+	if err := convert(tx, &result); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if result.TxID != tx.TxID || result.State != hezCommon.PoolL2TxStatePending {
+		t.Errorf("unexpected pool tx: %+v", result)
+	}
+	if hezCommon.Idx(result.FromIdx) != 256 || hezCommon.Idx(result.ToIdx) != 257 {
+		t.Errorf("unexpected pool tx idxs: %d %d", result.FromIdx, result.ToIdx)
+	}
+	if result.Amount != "250" || result.Fee != 126 || result.Nonce != 3 {
+		t.Errorf("unexpected pool tx amount: %+v", result)
+	}
+}
+
+func TestConvertAccounts(t *testing.T) {
+	balance := apitypes.BigIntStr("2500000000000000000")
+	accounts := []historydb.AccountAPI{{
+		ItemID:        1,
+		Idx:           "hez:ETH:256",
+		BatchNum:      40,
+		PublicKey:     apitypes.NewHezBJJ(fixtureBJJ),
+		EthAddr:       apitypes.NewHezEthAddr(fixtureEthAddr),
+		Nonce:         4,
+		Balance:       &balance,
+		TokenID:       0,
+		TokenSymbol:   "ETH",
+		TokenDecimals: 18,
+	}}
+
+	result := &client.AccountAPI{}
+	if err := convert(accounts, &result.Accounts); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if len(result.Accounts) != 1 {
+		t.Fatalf("unexpected accounts: %d", len(result.Accounts))
+	}
+	account := result.Accounts[0]
+	if hezCommon.Idx(account.Idx) != 256 || account.Nonce != 4 {
+		t.Errorf("unexpected account: %+v", account)
+	}
+	if account.Balance == nil || account.Balance.String() != string(balance) {
+		t.Errorf("unexpected account balance: %v", account.Balance)
+	}
+	if account.PublicKey != accounts[0].PublicKey || account.EthAddr != accounts[0].EthAddr {
+		t.Errorf("unexpected account keys: %+v", account)
+	}
+	if account.Token.TokenID != 0 || account.Token.Symbol != "ETH" {
+		t.Errorf("unexpected account token: %+v", account.Token)
+	}
+}
+
+func TestConvertAtomicPoolTx(t *testing.T) {
+	var (
+		rqFromIdx = apitypes.HezIdx("hez:ETH:258")
+		rqToIdx   = apitypes.HezIdx("hez:ETH:256")
+		rqTokenID = hezCommon.TokenID(0)
+		rqAmount  = apitypes.BigIntStr("100")
+		rqNonce   = hezCommon.Nonce(9)
+	)
+	tx := l2db.PoolTxAPI{
+		TxID:        hezCommon.TxID{0x02, 0x02},
+		FromIdx:     "hez:ETH:256",
+		Amount:      "250",
+		State:       hezCommon.PoolL2TxStatePending,
+		Type:        hezCommon.TxTypeTransfer,
+		RqFromIdx:   &rqFromIdx,
+		RqToIdx:     &rqToIdx,
+		RqTokenID:   &rqTokenID,
+		RqAmount:    &rqAmount,
+		RqNonce:     &rqNonce,
+		TokenSymbol: "ETH",
+	}
+
+	var result client.TxHistory
+	if err := convert(tx, &result); err != nil {
+		t.Fatalf("convert: %v", err)
+	}
+	if result.RequestFromIdx == nil || hezCommon.Idx(*result.RequestFromIdx) != 258 {
+		t.Errorf("unexpected request from idx: %v", result.RequestFromIdx)
+	}
+	if result.RequestToIdx == nil || hezCommon.Idx(*result.RequestToIdx) != 256 {
+		t.Errorf("unexpected request to idx: %v", result.RequestToIdx)
+	}
+	if result.RequestAmount == nil || *result.RequestAmount != rqAmount {
+		t.Errorf("unexpected request amount: %v", result.RequestAmount)
+	}
+	if result.RequestNonce == nil || *result.RequestNonce != rqNonce {
+		t.Errorf("unexpected request nonce: %v", result.RequestNonce)
+	}
+	if result.RequestToBJJ != nil || result.RequestToEthAddr != nil {
+		t.Errorf("unexpected request recipient: %v %v", result.RequestToBJJ, result.RequestToEthAddr)
+	}
+}
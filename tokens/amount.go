@@ -0,0 +1,71 @@
+package tokens
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/Pantani/errors"
+)
+
+// ParseUnits parses a decimal amount ("12.5") to the token base units
+// using the token decimals. Amounts with more fractional digits than the
+// token decimals are rejected instead of rounded
+func ParseUnits(amount string, decimals uint64) (*big.Int, error) {
+	params := errors.Params{"amount": amount, "decimals": decimals}
+	intPart, fracPart := amount, ""
+	if i := strings.IndexByte(amount, '.'); i >= 0 {
+		intPart, fracPart = amount[:i], amount[i+1:]
+		if fracPart == "" {
+			return nil, errors.E("invalid amount", params)
+		}
+	}
+	if intPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return nil, errors.E("invalid amount", params)
+	}
+	fracPart = strings.TrimRight(fracPart, "0")
+	if uint64(len(fracPart)) > decimals {
+		return nil, errors.E("amount exceeds the token decimals", params)
+	}
+	fracPart += strings.Repeat("0", int(decimals)-len(fracPart))
+	units, ok := new(big.Int).SetString(intPart+fracPart, 10)
+	if !ok {
+		return nil, errors.E("invalid amount", params)
+	}
+	return units, nil
+}
+
+// FormatUnits formats the token base units to a decimal amount using the
+// token decimals, without the trailing fractional zeros
+func FormatUnits(units *big.Int, decimals uint64) string {
+	if units == nil {
+		return "0"
+	}
+	digits := new(big.Int).Abs(units).String()
+	sign := ""
+	if units.Sign() < 0 {
+		sign = "-"
+	}
+	if decimals == 0 {
+		return sign + digits
+	}
+	if uint64(len(digits)) <= decimals {
+		digits = strings.Repeat("0", int(decimals)-len(digits)+1) + digits
+	}
+	point := len(digits) - int(decimals)
+	intPart := digits[:point]
+	fracPart := strings.TrimRight(digits[point:], "0")
+	if fracPart == "" {
+		return sign + intPart
+	}
+	return sign + intPart + "." + fracPart
+}
+
+// isDigits returns true if the string has only decimal digits
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
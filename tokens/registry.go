@@ -0,0 +1,245 @@
+package tokens
+
+import (
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-integration/client"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// missRefreshInterval is the minimum interval between the refreshes
+	// triggered by a lookup of an unknown token
+	missRefreshInterval = 10 * time.Second
+)
+
+type (
+	// Registry keeps the tokens supported by the rollup, indexed by
+	// symbol, token id and ERC20 address. The new token registrations are
+	// fetched by Refresh, periodically by Run and when a lookup misses
+	Registry struct {
+		mu       sync.RWMutex
+		c        client.TokenReader
+		byID     map[hezCommon.TokenID]hezCommon.Token
+		bySymbol map[string]hezCommon.Token
+		byAddr   map[ethCommon.Address]hezCommon.Token
+		// nextItem is the item id of the next token registration
+		nextItem    uint64
+		lastRefresh time.Time
+		refreshMu   sync.Mutex
+	}
+)
+
+// NewRegistry creates a new empty token registry, call Refresh to load
+// the tokens
+func NewRegistry(c client.TokenReader) *Registry {
+	return &Registry{
+		c:        c,
+		byID:     make(map[hezCommon.TokenID]hezCommon.Token),
+		bySymbol: make(map[string]hezCommon.Token),
+		byAddr:   make(map[ethCommon.Address]hezCommon.Token),
+	}
+}
+
+// Refresh fetches the tokens registered since the last refresh and
+// returns them
+func (r *Registry) Refresh() ([]hezCommon.Token, error) {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	r.mu.RLock()
+	next := r.nextItem
+	r.mu.RUnlock()
+
+	added := make([]hezCommon.Token, 0)
+	for {
+		page, err := r.c.GetTokensFrom(next)
+		if err != nil {
+			return added, errors.E("cannot refresh the tokens", err, errors.Params{"from_item": next})
+		}
+		if page == nil || len(page.Tokens) == 0 {
+			break
+		}
+		r.mu.Lock()
+		for _, t := range page.Tokens {
+			token := hezCommon.Token{
+				TokenID:     t.TokenID,
+				EthBlockNum: t.EthBlockNum,
+				EthAddr:     t.EthAddr,
+				Name:        t.Name,
+				Symbol:      t.Symbol,
+				Decimals:    t.Decimals,
+			}
+			if r.add(token) {
+				added = append(added, token)
+			}
+			if t.ItemID >= next {
+				next = t.ItemID + 1
+			}
+		}
+		r.nextItem = next
+		r.mu.Unlock()
+		if page.PendingItems == 0 {
+			break
+		}
+	}
+	r.mu.Lock()
+	r.lastRefresh = time.Now()
+	r.mu.Unlock()
+
+	for _, t := range added {
+		logger.Info("Token registered", logger.Params{
+			"token_id": t.TokenID,
+			"symbol":   t.Symbol,
+			"decimals": t.Decimals,
+			"eth_addr": t.EthAddr.String(),
+		})
+	}
+	return added, nil
+}
+
+// Run refreshes the tokens every interval. The client errors are logged
+// and the tokens are fetched again in the next tick
+func (r *Registry) Run(interval time.Duration) func() error {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if _, err := r.Refresh(); err != nil {
+				logger.Error(err)
+			}
+		}
+		return nil
+	}
+}
+
+// BySymbol returns the token with the symbol, case insensitive
+func (r *Registry) BySymbol(symbol string) (hezCommon.Token, error) {
+	return r.lookup(func() (hezCommon.Token, bool) {
+		t, ok := r.bySymbol[strings.ToUpper(symbol)]
+		return t, ok
+	}, errors.Params{"symbol": symbol})
+}
+
+// ByID returns the token with the token id
+func (r *Registry) ByID(tokenID hezCommon.TokenID) (hezCommon.Token, error) {
+	return r.lookup(func() (hezCommon.Token, bool) {
+		t, ok := r.byID[tokenID]
+		return t, ok
+	}, errors.Params{"token_id": tokenID})
+}
+
+// ByAddress returns the token with the ERC20 contract address, the zero
+// address is ETH
+func (r *Registry) ByAddress(addr ethCommon.Address) (hezCommon.Token, error) {
+	return r.lookup(func() (hezCommon.Token, bool) {
+		t, ok := r.byAddr[addr]
+		return t, ok
+	}, errors.Params{"eth_addr": addr.String()})
+}
+
+// Lookup returns the token by ERC20 address ("0x..."), token id ("1") or
+// symbol ("USDT")
+func (r *Registry) Lookup(s string) (hezCommon.Token, error) {
+	if ethCommon.IsHexAddress(s) {
+		return r.ByAddress(ethCommon.HexToAddress(s))
+	}
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return r.ByID(hezCommon.TokenID(id))
+	}
+	return r.BySymbol(s)
+}
+
+// Tokens returns the registered tokens sorted by token id
+func (r *Registry) Tokens() []hezCommon.Token {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tokens := make([]hezCommon.Token, 0, len(r.byID))
+	for _, t := range r.byID {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].TokenID < tokens[j].TokenID })
+	return tokens
+}
+
+// ParseAmount parses an amount with the token ("12.5 USDT") to the token
+// base units. The token is looked up by symbol, token id or ERC20 address
+func (r *Registry) ParseAmount(s string) (*big.Int, hezCommon.Token, error) {
+	const expectedFields = 2
+	fields := strings.Fields(s)
+	if len(fields) != expectedFields {
+		return nil, hezCommon.Token{}, errors.E("invalid token amount", errors.Params{"amount": s})
+	}
+	token, err := r.Lookup(fields[1])
+	if err != nil {
+		return nil, hezCommon.Token{}, err
+	}
+	units, err := ParseUnits(fields[0], token.Decimals)
+	if err != nil {
+		return nil, hezCommon.Token{}, errors.E("invalid token amount", err,
+			errors.Params{"amount": s, "token": token.Symbol})
+	}
+	return units, token, nil
+}
+
+// Format formats the token base units to an amount with the token symbol
+// ("12.5 USDT")
+func (r *Registry) Format(units *big.Int, tokenID hezCommon.TokenID) (string, error) {
+	token, err := r.ByID(tokenID)
+	if err != nil {
+		return "", err
+	}
+	return FormatUnits(units, token.Decimals) + " " + token.Symbol, nil
+}
+
+// lookup finds a token, refreshing the registry once if the token is
+// unknown and the last refresh is older than the miss refresh interval
+func (r *Registry) lookup(find func() (hezCommon.Token, bool), params errors.Params) (hezCommon.Token, error) {
+	r.mu.RLock()
+	t, ok := find()
+	stale := time.Since(r.lastRefresh) > missRefreshInterval
+	r.mu.RUnlock()
+	if ok {
+		return t, nil
+	}
+	if stale {
+		if _, err := r.Refresh(); err != nil {
+			logger.Error(err)
+		}
+		r.mu.RLock()
+		t, ok = find()
+		r.mu.RUnlock()
+		if ok {
+			return t, nil
+		}
+	}
+	return hezCommon.Token{}, errors.E("token not supported", params)
+}
+
+// add indexes a token, the caller must hold the lock. A symbol already
+// used by a token with a lower id is kept, the token is still found by id
+// and address. It returns false if the token was already registered
+func (r *Registry) add(t hezCommon.Token) bool {
+	if _, ok := r.byID[t.TokenID]; ok {
+		return false
+	}
+	r.byID[t.TokenID] = t
+	r.byAddr[t.EthAddr] = t
+	symbol := strings.ToUpper(t.Symbol)
+	if prev, ok := r.bySymbol[symbol]; ok && prev.TokenID < t.TokenID {
+		logger.Warn("Token symbol already registered", logger.Params{
+			"symbol":   t.Symbol,
+			"token_id": t.TokenID,
+			"used_by":  prev.TokenID,
+		})
+		return true
+	}
+	r.bySymbol[symbol] = t
+	return true
+}
@@ -0,0 +1,171 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ExporterNone disables the tracing
+	ExporterNone = ""
+	// ExporterStdout exports the spans to the stdout
+	ExporterStdout = "stdout"
+	// ExporterOTLP exports the spans to an OTLP HTTP collector
+	ExporterOTLP = "otlp"
+
+	// tracerName is the instrumentation name of the spans
+	tracerName = "github.com/hermeznetwork/hermez-integration"
+	// maxTxContexts is the maximum number of tx span contexts kept to link
+	// the tx tracking to the tx submission
+	maxTxContexts = 10000
+)
+
+type (
+	// Config represents the tracing configuration
+	Config struct {
+		// Exporter is the span exporter (none, stdout or otlp)
+		Exporter string
+		// Endpoint is the OTLP collector host and port, e.g.: localhost:4318
+		Endpoint string
+		// Insecure disables the TLS for the OTLP collector
+		Insecure bool
+		// ServiceName is the service name of the spans
+		ServiceName string
+	}
+
+	// txContexts keeps the span context of the submitted txs by tx ID
+	txContexts struct {
+		mu    sync.Mutex
+		spans map[string]trace.SpanContext
+		order []string
+	}
+)
+
+var submitted = &txContexts{spans: make(map[string]trace.SpanContext)}
+
+// Init sets the global tracer provider with the configured exporter. It
+// returns the shutdown function flushing the pending spans. Without an
+// exporter the spans are not recorded
+func Init(cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch cfg.Exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, errors.E("invalid tracing exporter", errors.Params{"exporter": cfg.Exporter})
+	}
+	if err != nil {
+		return nil, errors.E("cannot create the tracing exporter", err, errors.Params{"exporter": cfg.Exporter})
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "hermez-integration"
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info("Tracing enabled", logger.Params{"exporter": cfg.Exporter, "endpoint": cfg.Endpoint})
+	return provider.Shutdown, nil
+}
+
+// Start starts a span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records the error into the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TxAttributes returns the span attributes of a L2 tx
+func TxAttributes(tx *hezCommon.PoolL2Tx, token hezCommon.Token) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("hermez.tx_id", tx.TxID.String()),
+		attribute.String("hermez.tx_type", string(tx.Type)),
+		attribute.Int64("hermez.from_idx", int64(tx.FromIdx)),
+		attribute.Int64("hermez.to_idx", int64(tx.ToIdx)),
+		attribute.String("hermez.token", token.Symbol),
+		attribute.Int64("hermez.nonce", int64(tx.Nonce)),
+	}
+}
+
+// Sign wraps the creation and signature of a L2 tx into a span, the sign
+// function receives the span context
+func Sign(ctx context.Context, token hezCommon.Token,
+	sign func(ctx context.Context) (*hezCommon.PoolL2Tx, error)) (*hezCommon.PoolL2Tx, error) {
+	ctx, span := Start(ctx, "hermez.Sign", attribute.String("hermez.token", token.Symbol))
+	tx, err := sign(ctx)
+	if err == nil {
+		span.SetAttributes(TxAttributes(tx, token)...)
+	}
+	End(span, err)
+	return tx, err
+}
+
+// RememberTx keeps the span context of a submitted tx, so the tx tracking
+// spans join the submission trace
+func RememberTx(ctx context.Context, txID string) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	submitted.mu.Lock()
+	defer submitted.mu.Unlock()
+	if _, ok := submitted.spans[txID]; !ok {
+		submitted.order = append(submitted.order, txID)
+	}
+	submitted.spans[txID] = sc
+	if len(submitted.order) > maxTxContexts {
+		delete(submitted.spans, submitted.order[0])
+		submitted.order = submitted.order[1:]
+	}
+}
+
+// TxContext returns a context with the span context of a submitted tx, or
+// the background context if the tx is unknown
+func TxContext(txID string) context.Context {
+	submitted.mu.Lock()
+	defer submitted.mu.Unlock()
+	sc, ok := submitted.spans[txID]
+	if !ok {
+		return context.Background()
+	}
+	return trace.ContextWithRemoteSpanContext(context.Background(), sc)
+}
@@ -0,0 +1,77 @@
+package track
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/Pantani/errors"
+	"github.com/hermeznetwork/hermez-integration/client"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// hezEthPrefix is the prefix of the hez eth addresses
+	hezEthPrefix = "hez:0x"
+)
+
+type (
+	// Accounts keeps the account idxs owned by the watched addresses, so
+	// the txs carrying only the account idx can be matched
+	Accounts struct {
+		mu   sync.RWMutex
+		c    client.AccountReader
+		idxs map[hezCommon.Idx]string
+	}
+)
+
+// NewAccounts creates a new empty account idx set
+func NewAccounts(c client.AccountReader) *Accounts {
+	return &Accounts{c: c, idxs: make(map[hezCommon.Idx]string)}
+}
+
+// Refresh fetches the accounts of all tokens of a hez eth address or a hez
+// BJJ address and adds their idxs to the set
+func (a *Accounts) Refresh(address string) error {
+	var bjjAddress, hezEthAddress *string
+	if strings.HasPrefix(strings.ToLower(address), hezEthPrefix) {
+		hezEthAddress = &address
+	} else {
+		bjjAddress = &address
+	}
+	result, err := a.c.GetAccounts(bjjAddress, hezEthAddress)
+	if err != nil {
+		return errors.E("cannot refresh the address accounts", err, errors.Params{"address": address})
+	}
+	for _, account := range result.Accounts {
+		a.Add(hezCommon.Idx(account.Idx), address)
+	}
+	return nil
+}
+
+// Add adds an account idx owned by the address
+func (a *Accounts) Add(idx hezCommon.Idx, address string) {
+	if idx == 0 {
+		return
+	}
+	a.mu.Lock()
+	a.idxs[idx] = address
+	a.mu.Unlock()
+}
+
+// Owner returns the address owning the account idx, or an empty string if
+// the idx is not owned by a watched address
+func (a *Accounts) Owner(idx hezCommon.Idx) string {
+	if a == nil {
+		return ""
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.idxs[idx]
+}
+
+// Len returns the number of account idxs
+func (a *Accounts) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.idxs)
+}
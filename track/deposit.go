@@ -1,66 +1,373 @@
 package track
 
 import (
+	"math/big"
+	"sync"
 	"time"
 
+	"github.com/Pantani/errors"
 	"github.com/Pantani/logger"
 	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/metrics"
+	"github.com/hermeznetwork/hermez-node/api/apitypes"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
 )
 
-// Deposits get last batch number and get the transactions
-func Deposits(c *client.Client, ethAddr, bjjAddr []string, interval time.Duration) func() error {
+const (
+	// KindL1Deposit represents an L1 deposit loaded into a user account
+	KindL1Deposit DepositKind = "l1_deposit"
+	// KindCreateAccount represents an L1 user account creation loaded
+	// with a deposit
+	KindCreateAccount DepositKind = "create_account"
+	// KindL1Transfer represents the transfer of an L1 tx to a user account
+	KindL1Transfer DepositKind = "l1_transfer"
+	// KindL2Transfer represents an L2 transfer to a user account
+	KindL2Transfer DepositKind = "l2_transfer"
+
+	// l1Tx is the L1orL2 value of the L1 txs
+	l1Tx = "L1"
+)
+
+type (
+	// DepositKind represents how a deposit credits a user account
+	DepositKind string
+
+	// DepositTx represents a tx crediting a user account. An L1 tx can
+	// credit two accounts: the loaded amount goes to the sender account
+	// and the amount is transferred to the receiver account
+	DepositTx struct {
+		Tx   client.TxHistory
+		Kind DepositKind
+		// Idx is the credited account
+		Idx hezCommon.Idx
+		// Address is the matched user address
+		Address string
+		// Amount is the amount credited to the account, the loaded
+		// amount for the L1 deposits and the account creations and the
+		// transferred amount for the transfers
+		Amount *big.Int
+		// LoadAmount is the amount loaded from L1 by the tx, nil for the
+		// L2 transfers
+		LoadAmount *big.Int
+	}
+
+	// DepositHandler is called for every deposit found
+	DepositHandler func(d DepositTx) error
+)
+
+// IsLoad returns true if the deposit credits the loaded amount of an L1 tx
+func (k DepositKind) IsLoad() bool {
+	return k == KindL1Deposit || k == KindCreateAccount
+}
+
+// Ref returns the unique reference of the deposit, the tx id for the
+// transfers and the tx id with the "load" suffix for the loaded amounts
+func (d DepositTx) Ref() string {
+	if d.Kind.IsLoad() {
+		return d.Tx.TxID.String() + ":load"
+	}
+	return d.Tx.TxID.String()
+}
+
+var (
+	progressMu   sync.RWMutex
+	scannedBatch hezCommon.BatchNum
+	lastScan     time.Time
+	// rescanFrom is the batch the deposit trackers must scan again from
+	rescanFrom hezCommon.BatchNum
+)
+
+// ScannedBatch returns the last batch scanned by the deposit trackers
+func ScannedBatch() hezCommon.BatchNum {
+	progressMu.RLock()
+	defer progressMu.RUnlock()
+	return scannedBatch
+}
+
+// LastScan returns the last time the deposit trackers checked the batches
+func LastScan() time.Time {
+	progressMu.RLock()
+	defer progressMu.RUnlock()
+	return lastScan
+}
+
+// Rescan requests the deposit trackers to scan the batches again from the
+// batch number, the batches after a reorg are scanned in the next tick
+func Rescan(batchNum hezCommon.BatchNum) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if rescanFrom == 0 || batchNum < rescanFrom {
+		rescanFrom = batchNum
+	}
+}
+
+// takeRescan returns and clears the requested rescan batch, zero if no
+// rescan was requested
+func takeRescan() hezCommon.BatchNum {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	batchNum := rescanFrom
+	rescanFrom = 0
+	return batchNum
+}
+
+// setProgress records the deposit tracker progress
+func setProgress(scanned, last hezCommon.BatchNum) {
+	progressMu.Lock()
+	scannedBatch = scanned
+	lastScan = time.Now()
+	progressMu.Unlock()
+	metrics.SetScannedBatch(scanned, last)
+}
+
+// Deposits get last batch number and scan the transactions of all batches
+// since the last scanned batch. The txs are matched by the watch-list
+// addresses and by the account idxs owned by them, the accounts created
+// for the watched addresses are added to the idx set. The watch-list can
+// change while running. The client errors are logged and the batch is
+// fetched again in the next tick
+func Deposits(c client.BatchReader, watch *WatchList, accounts *Accounts, interval time.Duration,
+	handlers ...DepositHandler) func() error {
 	return func() error {
 		ticker := time.NewTicker(interval)
+		scanned := hezCommon.BatchNum(0)
 		for {
 			select {
 			case <-ticker.C:
 				// Fetch the last batch for we can pulling the transactions
 				lastBatch, err := c.GetLastBatch()
 				if err != nil {
-					return err
+					logger.Error(errors.E("cannot get the last batch", err))
+					continue
 				}
 				logger.Info("Last Batch", logger.Params{"last_batch": lastBatch.BatchNum})
+				if scanned == 0 {
+					scanned = lastBatch.BatchNum - 1
+				}
+				if from := takeRescan(); from > 0 && from <= scanned {
+					logger.Warn("Rescan batches", logger.Params{"from": from, "scanned": scanned})
+					scanned = from - 1
+				}
 
-				// Get all transactions for a batch for tracking the track
-				batch, err := c.GetBatchTxs(lastBatch.BatchNum)
+				scanned, err = scanBatches(c, scanned, lastBatch.BatchNum, watch, accounts, handlers)
 				if err != nil {
 					return err
 				}
-				logger.Info("Batch", logger.Params{"batch": lastBatch.BatchNum, "txs": len(batch.Txs)})
-
-				for _, tx := range batch.Txs {
-					toEthAddr, err := tx.ToEthAddr.ToEthAddr()
-					if err != nil {
-						return err
-					}
-					if contains(ethAddr, toEthAddr.String()) {
-						logger.Info("New tx found",
-							logger.Params{"batch": lastBatch.BatchNum,
-								"tx": tx.TxID, "eth_addr": toEthAddr.String()})
-						continue
-					}
-					toBjjAddr, err := tx.ToBJJ.ToBJJ()
-					if err != nil {
-						return err
-					}
-					if contains(bjjAddr, toBjjAddr.String()) {
-						logger.Info("New tx found",
-							logger.Params{"batch": lastBatch.BatchNum,
-								"tx": tx.TxID, "bjjAddr": toBjjAddr.String()})
-						continue
-					}
-				}
+				setProgress(scanned, lastBatch.BatchNum)
 			}
 		}
 	}
 }
 
-// contains check if a string contains into a slice
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
+// scanBatches scans every batch after the scanned batch up to the last
+// batch, so the batches forged between two ticks are not skipped. A client
+// error stops the scan and the remaining batches are fetched again in the
+// next tick. It returns the last scanned batch
+func scanBatches(c client.BatchReader, scanned, last hezCommon.BatchNum, watch *WatchList,
+	accounts *Accounts, handlers []DepositHandler) (hezCommon.BatchNum, error) {
+	for batchNum := scanned + 1; batchNum <= last; batchNum++ {
+		// Get all transactions for a batch for tracking the track
+		batch, err := c.GetBatchTxs(batchNum)
+		if err != nil {
+			logger.Error(errors.E("cannot get the batch txs", err,
+				errors.Params{"batch": batchNum}))
+			break
+		}
+		logger.Info("Batch", logger.Params{"batch": batchNum, "txs": len(batch.Txs)})
+		if err := scanBatch(batchNum, batch.Txs, watch, accounts, handlers); err != nil {
+			return scanned, err
+		}
+		scanned = batchNum
+	}
+	return scanned, nil
+}
+
+// scanBatch find the deposits to the addresses into the batch transactions.
+// The malformed txs are logged and skipped, so they do not stop the tracker
+func scanBatch(batchNum hezCommon.BatchNum, txs []client.TxHistory, watch *WatchList,
+	accounts *Accounts, handlers []DepositHandler) error {
+	for _, tx := range txs {
+		if accounts != nil && tx.L1orL2 == l1Tx && isCreateAccount(tx.Type) {
+			addAccount(tx, watch, accounts)
+		}
+		deposits, err := classify(tx, watch, accounts)
+		if err != nil {
+			logger.Error(errors.E("cannot classify the tx", err,
+				errors.Params{"batch": batchNum, "tx_id": tx.TxID.String()}))
+			continue
 		}
+		for _, d := range deposits {
+			logger.Info("New deposit found", logger.Params{
+				"batch":   batchNum,
+				"tx":      tx.TxID,
+				"kind":    d.Kind,
+				"idx":     d.Idx,
+				"address": d.Address,
+				"amount":  d.Amount.String(),
+			})
+			if err := handleDeposit(d, handlers); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addAccount adds the account created by an L1 tx for a watched address
+// to the idx set. The address accounts are fetched again, so the account
+// is added even if the tx does not carry the new idx
+func addAccount(tx client.TxHistory, watch *WatchList, accounts *Accounts) {
+	addr := watch.Match(tx.FromEthAddr, tx.FromBJJ)
+	if addr == "" {
+		return
+	}
+	accounts.Add(hezCommon.Idx(tx.FromIdx), addr)
+	if err := accounts.Refresh(addr); err != nil {
+		logger.Error(err)
+	}
+}
+
+// classify returns the deposits of a tx into the user addresses. The L1
+// loaded amount credits the sender account and the transferred amount
+// credits the receiver account, the failed L1 amounts are ignored. The
+// accounts are matched by the address or by the idx owned by an address,
+// the loads are matched by the owner of the sender account first
+func classify(tx client.TxHistory, watch *WatchList, accounts *Accounts) ([]DepositTx, error) {
+	deposits := make([]DepositTx, 0)
+	amount, err := parseAmount(tx.TxID, tx.Amount)
+	if err != nil {
+		return nil, err
+	}
+	if tx.L1orL2 != l1Tx {
+		if !isTransfer(tx.Type) {
+			return deposits, nil
+		}
+		if addr := matchAccount(tx.ToIdx, tx.ToEthAddr, tx.ToBJJ, watch, accounts); addr != "" {
+			deposits = append(deposits, DepositTx{
+				Tx:      tx,
+				Kind:    KindL2Transfer,
+				Idx:     hezCommon.Idx(tx.ToIdx),
+				Address: addr,
+				Amount:  amount,
+			})
+		}
+		return deposits, nil
+	}
+
+	if tx.L1Info == nil {
+		return nil, errors.E("L1 tx without L1 info", errors.Params{"tx_id": tx.TxID.String()})
+	}
+	loadAmount, err := parseAmount(tx.TxID, tx.L1Info.DepositAmount)
+	if err != nil {
+		return nil, err
+	}
+	if isLoad(tx.Type) && tx.L1Info.DepositAmountSuccess && loadAmount.Sign() > 0 {
+		if addr := matchLoad(tx, watch, accounts); addr != "" {
+			kind := KindL1Deposit
+			if isCreateAccount(tx.Type) {
+				kind = KindCreateAccount
+			}
+			deposits = append(deposits, DepositTx{
+				Tx:         tx,
+				Kind:       kind,
+				Idx:        hezCommon.Idx(tx.FromIdx),
+				Address:    addr,
+				Amount:     loadAmount,
+				LoadAmount: loadAmount,
+			})
+		}
+	}
+	if isTransfer(tx.Type) && tx.L1Info.AmountSuccess && amount.Sign() > 0 {
+		if addr := matchAccount(tx.ToIdx, tx.ToEthAddr, tx.ToBJJ, watch, accounts); addr != "" {
+			deposits = append(deposits, DepositTx{
+				Tx:         tx,
+				Kind:       KindL1Transfer,
+				Idx:        hezCommon.Idx(tx.ToIdx),
+				Address:    addr,
+				Amount:     amount,
+				LoadAmount: loadAmount,
+			})
+		}
+	}
+	return deposits, nil
+}
+
+// isLoad returns true if the L1 tx type loads an amount into the sender
+// account
+func isLoad(txType hezCommon.TxType) bool {
+	switch txType {
+	case hezCommon.TxTypeDeposit, hezCommon.TxTypeDepositTransfer,
+		hezCommon.TxTypeCreateAccountDeposit, hezCommon.TxTypeCreateAccountDepositTransfer:
+		return true
+	}
+	return false
+}
+
+// isCreateAccount returns true if the L1 tx type creates the sender account
+func isCreateAccount(txType hezCommon.TxType) bool {
+	return txType == hezCommon.TxTypeCreateAccountDeposit ||
+		txType == hezCommon.TxTypeCreateAccountDepositTransfer
+}
+
+// isTransfer returns true if the tx type transfers an amount to a receiver
+// account
+func isTransfer(txType hezCommon.TxType) bool {
+	switch txType {
+	case hezCommon.TxTypeTransfer, hezCommon.TxTypeTransferToEthAddr, hezCommon.TxTypeTransferToBJJ,
+		hezCommon.TxTypeDepositTransfer, hezCommon.TxTypeCreateAccountDepositTransfer,
+		hezCommon.TxTypeForceTransfer:
+		return true
 	}
 	return false
 }
+
+// matchAccount returns the watched address matching the account address
+// or owning the account idx, or an empty string if none match. The idxs of
+// the addresses removed from the watch-list never match
+func matchAccount(idx client.StrHezIdx, ethAddr apitypes.HezEthAddr, bjjAddr apitypes.HezBJJ,
+	watch *WatchList, accounts *Accounts) string {
+	if addr := watch.Match(ethAddr, bjjAddr); addr != "" {
+		return addr
+	}
+	if owner := accounts.Owner(hezCommon.Idx(idx)); watch.Contains(owner) {
+		return owner
+	}
+	return ""
+}
+
+// matchLoad returns the watched address credited by the loaded amount of an
+// L1 tx. Anyone can deposit into an existing account, so the owner of the
+// sender idx is matched first and the L1 sender address is only matched if
+// the idx owner is unknown, as for the account creations
+func matchLoad(tx client.TxHistory, watch *WatchList, accounts *Accounts) string {
+	if owner := accounts.Owner(hezCommon.Idx(tx.FromIdx)); owner != "" {
+		if watch.Contains(owner) {
+			return owner
+		}
+		return ""
+	}
+	return watch.Match(tx.FromEthAddr, tx.FromBJJ)
+}
+
+// parseAmount parses a tx amount, an empty amount is zero
+func parseAmount(txID hezCommon.TxID, amount apitypes.BigIntStr) (*big.Int, error) {
+	if amount == "" {
+		return big.NewInt(0), nil
+	}
+	value, ok := new(big.Int).SetString(string(amount), 10)
+	if !ok {
+		return nil, errors.E("invalid tx amount", errors.Params{"tx_id": txID.String(), "amount": amount})
+	}
+	return value, nil
+}
+
+// handleDeposit call the handlers for a deposit
+func handleDeposit(d DepositTx, handlers []DepositHandler) error {
+	metrics.DepositFound(d.Tx.Token.Symbol, string(d.Kind))
+	for _, handler := range handlers {
+		if err := handler(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
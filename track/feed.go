@@ -0,0 +1,180 @@
+package track
+
+import (
+	"sync"
+	"time"
+
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// defaultFeedSize is the default number of events kept by the feed
+	defaultFeedSize = 10000
+)
+
+type (
+	// Feed keeps the last deposit and tx status changes found by the
+	// trackers, each one with an increasing cursor, so the consumers can
+	// fetch the events since their last cursor
+	Feed struct {
+		mu     sync.RWMutex
+		size   int
+		cursor uint64
+		events []Event
+		// notify is closed and replaced for every new event
+		notify chan struct{}
+	}
+
+	// Event represents a deposit or a tx status change, only one of them
+	// is set
+	Event struct {
+		Cursor   uint64    `json:"cursor"`
+		Deposit  *Deposit  `json:"deposit,omitempty"`
+		TxStatus *TxStatus `json:"txStatus,omitempty"`
+	}
+
+	// Deposit represents a deposit status change, a deposit is reported
+	// as forged, then as final or rolled back
+	Deposit struct {
+		Cursor      uint64             `json:"cursor"`
+		TxID        string             `json:"txId"`
+		Kind        DepositKind        `json:"kind"`
+		Status      DepositStatus      `json:"status"`
+		BatchNum    hezCommon.BatchNum `json:"batchNum"`
+		TokenID     hezCommon.TokenID  `json:"tokenId"`
+		TokenSymbol string             `json:"tokenSymbol"`
+		Amount      string             `json:"amount"`
+		LoadAmount  string             `json:"loadAmount,omitempty"`
+		ToIdx       hezCommon.Idx      `json:"toAccountIndex"`
+		ToEthAddr   string             `json:"toHezEthereumAddress,omitempty"`
+		ToBJJ       string             `json:"toBjj,omitempty"`
+		FromEthAddr string             `json:"fromHezEthereumAddress,omitempty"`
+		Timestamp   time.Time          `json:"timestamp"`
+	}
+
+	// TxStatus represents a tracked tx forged or rejected
+	TxStatus struct {
+		TxID      string             `json:"txId"`
+		State     TxState            `json:"state"`
+		BatchNum  hezCommon.BatchNum `json:"batchNum,omitempty"`
+		Timestamp time.Time          `json:"timestamp"`
+	}
+)
+
+// NewFeed creates a new feed keeping the last size events
+func NewFeed(size int) *Feed {
+	if size <= 0 {
+		size = defaultFeedSize
+	}
+	return &Feed{size: size, notify: make(chan struct{})}
+}
+
+// RecordDeposit adds a deposit status change to the feed. It can be used as
+// a StatusHandler
+func (f *Feed) RecordDeposit(d DepositTx, status DepositStatus) error {
+	deposit := &Deposit{
+		TxID:        d.Tx.TxID.String(),
+		Kind:        d.Kind,
+		Status:      status,
+		BatchNum:    d.Tx.BatchNum,
+		TokenID:     d.Tx.Token.TokenID,
+		TokenSymbol: d.Tx.Token.Symbol,
+		Amount:      d.Amount.String(),
+		ToIdx:       d.Idx,
+		FromEthAddr: string(d.Tx.FromEthAddr),
+		Timestamp:   d.Tx.Timestamp,
+	}
+	if d.LoadAmount != nil {
+		deposit.LoadAmount = d.LoadAmount.String()
+	}
+	// the loaded amounts credit the sender account
+	if d.Kind.IsLoad() {
+		deposit.ToEthAddr = string(d.Tx.FromEthAddr)
+		deposit.ToBJJ = string(d.Tx.FromBJJ)
+	} else {
+		deposit.ToEthAddr = string(d.Tx.ToEthAddr)
+		deposit.ToBJJ = string(d.Tx.ToBJJ)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cursor++
+	deposit.Cursor = f.cursor
+	f.add(Event{Cursor: f.cursor, Deposit: deposit})
+	return nil
+}
+
+// RecordTxStatus adds a tx status change to the feed. It can be used as a
+// TxHandler
+func (f *Feed) RecordTxStatus(txID string, state TxState, batchNum hezCommon.BatchNum) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cursor++
+	f.add(Event{Cursor: f.cursor, TxStatus: &TxStatus{
+		TxID:      txID,
+		State:     state,
+		BatchNum:  batchNum,
+		Timestamp: time.Now(),
+	}})
+}
+
+// add appends the event and wakes up the waiting consumers, the caller
+// must hold the lock
+func (f *Feed) add(e Event) {
+	f.events = append(f.events, e)
+	if len(f.events) > f.size {
+		f.events = f.events[len(f.events)-f.size:]
+	}
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// EventsSince returns up to limit events after the cursor, the oldest
+// first. A zero limit returns all events
+func (f *Feed) EventsSince(cursor uint64, limit int) []Event {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	events := make([]Event, 0)
+	for _, e := range f.events {
+		if e.Cursor <= cursor {
+			continue
+		}
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// DepositsSince returns up to limit deposits after the cursor, the oldest
+// first
+func (f *Feed) DepositsSince(cursor uint64, limit int) []Deposit {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	deposits := make([]Deposit, 0)
+	for _, e := range f.events {
+		if e.Deposit == nil || e.Cursor <= cursor {
+			continue
+		}
+		if limit > 0 && len(deposits) >= limit {
+			break
+		}
+		deposits = append(deposits, *e.Deposit)
+	}
+	return deposits
+}
+
+// Wait returns a channel closed when a new event is added
+func (f *Feed) Wait() <-chan struct{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.notify
+}
+
+// Cursor returns the cursor of the last event
+func (f *Feed) Cursor() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cursor
+}
@@ -0,0 +1,376 @@
+package track
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-integration/client"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// DepositForged represents a deposit found into a forged batch
+	DepositForged DepositStatus = "forged"
+	// DepositFinal represents a deposit with the L1 confirmations
+	DepositFinal DepositStatus = "final"
+	// DepositRolledBack represents a deposit of a batch removed by an L1
+	// reorg, the deposit is reported again if it is forged again
+	DepositRolledBack DepositStatus = "rolled_back"
+
+	// reorgChecks is the number of consecutive checks with a last batch
+	// lower than a watched batch to roll it back, so a node lagging behind
+	// after a pool failover doesn't roll back the batches
+	reorgChecks = 3
+)
+
+type (
+	// DepositStatus represents the finality status of a deposit
+	DepositStatus string
+
+	// StatusHandler is called for every deposit status change
+	StatusHandler func(d DepositTx, status DepositStatus) error
+
+	// FinalitySource represents the finality tracker data source
+	FinalitySource interface {
+		client.BatchReader
+		client.BlockReader
+	}
+
+	// Finality tracks the L1 confirmations of the forged batches. The
+	// deposits are reported as forged when found and as final after the
+	// batch L1 block has the confirmations. A batch with a different L1
+	// block hash, or removed for several checks, rolls back its deposits
+	// and the following batches deposits, and the deposit trackers scan
+	// them again. The watched batches and the scanned batch are saved to a
+	// state file, so the deposits not final yet are found again after a
+	// restart
+	Finality struct {
+		mu            sync.Mutex
+		path          string
+		c             FinalitySource
+		confirmations int64
+		handlers      []StatusHandler
+		// head is the last batch watched
+		head    hezCommon.BatchNum
+		batches map[hezCommon.BatchNum]*forgedBatch
+		// scanned is the last batch scanned saved to the state file
+		scanned hezCommon.BatchNum
+		// lower is the number of consecutive checks with a last batch
+		// lower than a watched batch
+		lower int
+		// unhandled are the status changes of a failed handler, handled
+		// again in the next check
+		unhandled []depositStatus
+	}
+
+	// finalityState represents the finality state file
+	finalityState struct {
+		// Scanned is the last batch scanned by the deposit trackers
+		Scanned hezCommon.BatchNum `json:"scanned"`
+		// Pending are the batches waiting for the L1 confirmations
+		Pending []hezCommon.BatchNum `json:"pending"`
+	}
+
+	// forgedBatch represents a batch waiting for the L1 confirmations
+	forgedBatch struct {
+		ethBlockNum  int64
+		ethBlockHash ethCommon.Hash
+		deposits     []DepositTx
+	}
+
+	// depositStatus represents a pending status change
+	depositStatus struct {
+		deposit DepositTx
+		status  DepositStatus
+	}
+)
+
+// NewFinality creates a new finality tracker and loads the state from the
+// file path. The deposits are final after the confirmations number of L1
+// blocks, including the batch block. The deposit trackers scan again from
+// the oldest pending batch of the state, or from the batch after the
+// scanned one, so the deposits are forged again and tracked until final. An
+// empty path keeps the state in memory
+func NewFinality(path string, c FinalitySource, confirmations int64, handlers ...StatusHandler) (*Finality, error) {
+	f := &Finality{
+		path:          path,
+		c:             c,
+		confirmations: confirmations,
+		handlers:      handlers,
+		batches:       make(map[hezCommon.BatchNum]*forgedBatch),
+	}
+	if path == "" {
+		return f, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, errors.E("cannot read the finality state", err, errors.Params{"path": path})
+	}
+	var s finalityState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.E("invalid finality state file", err, errors.Params{"path": path})
+	}
+	f.scanned = s.Scanned
+	resume := hezCommon.BatchNum(0)
+	if s.Scanned > 0 {
+		resume = s.Scanned + 1
+	}
+	for _, batchNum := range s.Pending {
+		if resume == 0 || batchNum < resume {
+			resume = batchNum
+		}
+	}
+	if resume > 0 {
+		logger.Info("Resume the deposit scan", logger.Params{"from": resume, "scanned": s.Scanned})
+		// the batches since the resumed one are watched again
+		f.head = resume - 1
+		Rescan(resume)
+	}
+	return f, nil
+}
+
+// OnStatus returns a status handler calling the deposit handler only for
+// the status
+func OnStatus(status DepositStatus, handler DepositHandler) StatusHandler {
+	return func(d DepositTx, s DepositStatus) error {
+		if s != status {
+			return nil
+		}
+		return handler(d)
+	}
+}
+
+// Forged adds a deposit found by the deposit tracker and reports it as
+// forged. It can be used as a DepositHandler
+func (f *Finality) Forged(d DepositTx) error {
+	f.mu.Lock()
+	b, ok := f.batches[d.Tx.BatchNum]
+	if !ok {
+		// the batch L1 block is fetched in the next check
+		b = &forgedBatch{}
+		f.batches[d.Tx.BatchNum] = b
+	}
+	b.deposits = append(b.deposits, d)
+	f.mu.Unlock()
+	_, err := f.handle([]depositStatus{{deposit: d, status: DepositForged}})
+	return err
+}
+
+// Run checks the batches confirmations and reorgs every interval. The
+// client, handler and state file errors are logged and the batches are
+// checked again in the next tick
+func (f *Finality) Run(interval time.Duration) func() error {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if err := f.check(); err != nil {
+				logger.Error(errors.E("cannot check the batches finality", err))
+			}
+		}
+		return nil
+	}
+}
+
+// check fetches the watched batches, finalizing the confirmed ones and
+// rolling back the reorged ones. The status changes of a failed handler
+// are kept and handled again first in the next check
+func (f *Finality) check() error {
+	lastBatch, err := f.c.GetLastBatch()
+	if err != nil {
+		logger.Error(errors.E("cannot get the last batch", err))
+		return nil
+	}
+	lastBlock, err := f.c.GetLastEthBlock()
+	if err != nil {
+		logger.Error(errors.E("cannot get the last L1 block", err))
+		return nil
+	}
+
+	// watch the new batches, a reorg of a batch without deposits can
+	// forge a deposit into it
+	f.mu.Lock()
+	if f.head == 0 {
+		f.head = lastBatch.BatchNum - 1
+	}
+	for batchNum := f.head + 1; batchNum <= lastBatch.BatchNum; batchNum++ {
+		if _, ok := f.batches[batchNum]; !ok {
+			f.batches[batchNum] = &forgedBatch{}
+		}
+	}
+	if lastBatch.BatchNum > f.head {
+		f.head = lastBatch.BatchNum
+	}
+	watched := f.watched()
+	f.mu.Unlock()
+
+	// fetch the batches without the lock, so the deposit tracker is not
+	// blocked by the requests
+	reorgFrom := hezCommon.BatchNum(0)
+	lowerFrom := hezCommon.BatchNum(0)
+	fetched := make(map[hezCommon.BatchNum]*client.Batch)
+	for _, batchNum := range watched {
+		if batchNum > lastBatch.BatchNum {
+			lowerFrom = batchNum
+			break
+		}
+		batch, err := f.c.GetBatch(batchNum)
+		if err != nil {
+			logger.Error(errors.E("cannot get the batch", err, errors.Params{"batch": batchNum}))
+			break
+		}
+		fetched[batchNum] = batch
+	}
+
+	f.mu.Lock()
+	changes := f.unhandled
+	f.unhandled = nil
+	if lowerFrom == 0 {
+		f.lower = 0
+	} else {
+		f.lower++
+		logger.Warn("Last batch lower than the watched batches", logger.Params{
+			"batch":      lowerFrom,
+			"last_batch": lastBatch.BatchNum,
+			"checks":     f.lower,
+		})
+	}
+	for _, batchNum := range watched {
+		if reorgFrom > 0 && batchNum >= reorgFrom {
+			break
+		}
+		batch, ok := fetched[batchNum]
+		if !ok {
+			break
+		}
+		b, ok := f.batches[batchNum]
+		if !ok {
+			continue
+		}
+		if b.ethBlockHash == (ethCommon.Hash{}) {
+			b.ethBlockNum = batch.EthBlockNum
+			b.ethBlockHash = batch.EthBlockHash
+		} else if b.ethBlockHash != batch.EthBlockHash {
+			logger.Warn("Batch L1 block changed", logger.Params{
+				"batch":         batchNum,
+				"eth_block":     b.ethBlockNum,
+				"eth_hash":      b.ethBlockHash.String(),
+				"new_eth_block": batch.EthBlockNum,
+				"new_eth_hash":  batch.EthBlockHash.String(),
+			})
+			reorgFrom = batchNum
+			break
+		}
+		if lastBlock-b.ethBlockNum+1 < f.confirmations {
+			// the next batches have less confirmations
+			break
+		}
+		for _, d := range b.deposits {
+			changes = append(changes, depositStatus{deposit: d, status: DepositFinal})
+		}
+		delete(f.batches, batchNum)
+	}
+	if reorgFrom == 0 && f.lower >= reorgChecks {
+		reorgFrom = lowerFrom
+	}
+	if reorgFrom > 0 {
+		f.lower = 0
+		logger.Warn("Batches reorged", logger.Params{"from": reorgFrom, "last_batch": lastBatch.BatchNum})
+		for _, batchNum := range watched {
+			b, ok := f.batches[batchNum]
+			if !ok || batchNum < reorgFrom {
+				continue
+			}
+			for _, d := range b.deposits {
+				changes = append(changes, depositStatus{deposit: d, status: DepositRolledBack})
+			}
+			delete(f.batches, batchNum)
+		}
+		f.head = reorgFrom - 1
+		Rescan(reorgFrom)
+	}
+	f.mu.Unlock()
+	unhandled, err := f.handle(changes)
+	if err != nil {
+		f.mu.Lock()
+		f.unhandled = append(unhandled, f.unhandled...)
+		f.mu.Unlock()
+		if saveErr := f.save(); saveErr != nil {
+			logger.Error(saveErr)
+		}
+		return err
+	}
+	return f.save()
+}
+
+// save writes the watched batches and the scanned batch to the state file
+// after the status changes are handled. The scanned batch is never after
+// the head, so the batches rolled back by a reorg are scanned again. The
+// batches of the unhandled status changes are saved as pending
+func (f *Finality) save() error {
+	if f.path == "" {
+		return nil
+	}
+	f.mu.Lock()
+	if scanned := ScannedBatch(); scanned > 0 {
+		f.scanned = scanned
+	}
+	if f.head > 0 && f.scanned > f.head {
+		f.scanned = f.head
+	}
+	s := finalityState{Scanned: f.scanned, Pending: f.watched()}
+	for _, c := range f.unhandled {
+		s.Pending = append(s.Pending, c.deposit.Tx.BatchNum)
+	}
+	f.mu.Unlock()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.E("cannot write the finality state", err, errors.Params{"path": tmp})
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// watched returns the watched batch numbers sorted, the caller must hold
+// the lock
+func (f *Finality) watched() []hezCommon.BatchNum {
+	watched := make([]hezCommon.BatchNum, 0, len(f.batches))
+	for batchNum := range f.batches {
+		watched = append(watched, batchNum)
+	}
+	sort.Slice(watched, func(i, j int) bool { return watched[i] < watched[j] })
+	return watched
+}
+
+// handle calls the handlers for the status changes, the changes from the
+// failed one are returned with the handler error
+func (f *Finality) handle(changes []depositStatus) ([]depositStatus, error) {
+	for i, c := range changes {
+		logger.Info("Deposit status", logger.Params{
+			"tx":     c.deposit.Tx.TxID,
+			"kind":   c.deposit.Kind,
+			"batch":  c.deposit.Tx.BatchNum,
+			"status": c.status,
+		})
+		for _, handler := range f.handlers {
+			if err := handler(c.deposit, c.status); err != nil {
+				return changes[i:], err
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,14 @@
+package track
+
+import (
+	"github.com/hermeznetwork/hermez-integration/client"
+)
+
+type (
+	// Source represents the trackers data source. It's implemented by the
+	// node API client and by the synchronizer database (syncdb package)
+	Source interface {
+		client.BatchReader
+		client.PoolReader
+	}
+)
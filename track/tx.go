@@ -4,30 +4,45 @@ import (
 	"time"
 
 	"github.com/Pantani/logger"
-	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/metrics"
+	"github.com/hermeznetwork/hermez-integration/tracing"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// Txs track if transaction was forged
-func Txs(c *client.Client, hashes []string, interval time.Duration) func() error {
+const (
+	// TxForged represents a tracked tx forged into a batch
+	TxForged TxState = "forged"
+	// TxInvalid represents a tracked tx rejected as invalid by the pool
+	TxInvalid TxState = "invalid"
+)
+
+type (
+	// TxState represents the final state of a tracked tx
+	TxState string
+
+	// TxHandler is called for every tracked tx forged or rejected
+	TxHandler func(txID string, state TxState, batchNum hezCommon.BatchNum)
+)
+
+// Txs track if transaction was forged. A tx is tracked while it stays into
+// the pool or is not found. The txs forged or rejected as invalid by the
+// pool stop being tracked, the handlers are called once for each one and
+// the tracker returns when no tx is left
+func Txs(c Source, hashes []string, interval time.Duration, handlers ...TxHandler) func() error {
 	return func() error {
 		ticker := time.NewTicker(interval)
 		for {
 			select {
 			case <-ticker.C:
-				for i, hash := range hashes {
-					poolTx, err := c.GetPoolTx(hash)
-					if err == nil && poolTx != nil && poolTx.TxID.String() == hash {
-						logger.Info("Tx stills on pool", logger.Params{"tx_id": poolTx.TxID})
-						continue
-					}
-
-					tx, err := c.GetTx(hash)
-					if err == nil && tx != nil && tx.TxID.String() == hash {
-						logger.Info("Tx was forged", logger.Params{"tx_id": tx.TxID.String()})
-						hashes = append(hashes[:i], hashes[i+1:]...)
-						continue
+				pending := make([]string, 0, len(hashes))
+				for _, hash := range hashes {
+					if checkTx(c, hash, handlers) {
+						pending = append(pending, hash)
 					}
 				}
+				hashes = pending
+				metrics.SetPendingTxs(len(hashes))
 				if len(hashes) == 0 {
 					return nil
 				}
@@ -35,3 +50,47 @@ func Txs(c *client.Client, hashes []string, interval time.Duration) func() error
 		}
 	}
 }
+
+// checkTx checks the tx state, it returns true if the tx is still pending.
+// The check span joins the trace of the tx submission
+func checkTx(c Source, hash string, handlers []TxHandler) bool {
+	_, span := tracing.Start(tracing.TxContext(hash), "track.Txs",
+		attribute.String("hermez.tx_id", hash))
+	defer span.End()
+
+	poolTx, err := c.GetPoolTx(hash)
+	if err == nil && poolTx != nil && poolTx.TxID.String() == hash {
+		span.SetAttributes(attribute.String("hermez.tx_state", string(poolTx.State)))
+		switch poolTx.State {
+		case hezCommon.PoolL2TxStateInvalid:
+			logger.Info("Tx invalid", logger.Params{"tx_id": hash})
+			metrics.TxInvalid()
+			handleTx(hash, TxInvalid, 0, handlers)
+			return false
+		case hezCommon.PoolL2TxStateForged:
+			logger.Info("Tx was forged", logger.Params{"tx_id": hash})
+			metrics.TxForged()
+			handleTx(hash, TxForged, poolTx.BatchNum, handlers)
+			return false
+		}
+		logger.Info("Tx stills on pool", logger.Params{"tx_id": poolTx.TxID})
+		return true
+	}
+
+	tx, err := c.GetTx(hash)
+	if err == nil && tx != nil && tx.TxID.String() == hash {
+		span.SetAttributes(attribute.Int64("hermez.batch_num", int64(tx.BatchNum)))
+		logger.Info("Tx was forged", logger.Params{"tx_id": tx.TxID.String()})
+		metrics.TxForged()
+		handleTx(hash, TxForged, tx.BatchNum, handlers)
+		return false
+	}
+	return true
+}
+
+// handleTx call the handlers for a tracked tx forged or rejected
+func handleTx(txID string, state TxState, batchNum hezCommon.BatchNum, handlers []TxHandler) {
+	for _, handler := range handlers {
+		handler(txID, state, batchNum)
+	}
+}
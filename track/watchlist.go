@@ -0,0 +1,311 @@
+package track
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Pantani/errors"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/hermeznetwork/hermez-node/api/apitypes"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+const (
+	// opAdd is the journal prefix of the added addresses
+	opAdd = '+'
+	// opRemove is the journal prefix of the removed addresses
+	opRemove = '-'
+)
+
+type (
+	// WatchList represents the addresses watched by the deposit tracker.
+	// The addresses are kept into hashed sets of the decoded eth
+	// addresses and BJJ keys, so the lookup does not depend on the list
+	// size or on the address case. The changes are appended to a journal
+	// file, one address per line
+	WatchList struct {
+		mu      sync.RWMutex
+		path    string
+		journal *os.File
+		eth     map[ethCommon.Address]struct{}
+		bjj     map[babyjub.PublicKeyComp]struct{}
+		onAdd   []AddHandler
+	}
+
+	// AddHandler is called for every address added to the watch-list
+	AddHandler func(address string)
+)
+
+// OpenWatchList loads the watch-list from the journal file and opens it to
+// append the changes. An empty path keeps the watch-list in memory
+func OpenWatchList(path string) (*WatchList, error) {
+	w := &WatchList{
+		path: path,
+		eth:  make(map[ethCommon.Address]struct{}),
+		bjj:  make(map[babyjub.PublicKeyComp]struct{}),
+	}
+	if path == "" {
+		return w, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.E("cannot open the watch-list journal", err, errors.Params{"path": path})
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if len(entry) < 2 || (entry[0] != opAdd && entry[0] != opRemove) {
+			f.Close()
+			return nil, errors.E("invalid watch-list journal entry",
+				errors.Params{"path": path, "line": line})
+		}
+		if _, err := w.apply(entry[0], entry[1:]); err != nil {
+			f.Close()
+			return nil, errors.E("invalid watch-list journal address", err,
+				errors.Params{"path": path, "line": line})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.journal = f
+	return w, nil
+}
+
+// Close closes the watch-list journal
+func (w *WatchList) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.journal == nil {
+		return nil
+	}
+	return w.journal.Close()
+}
+
+// Add adds hez eth addresses or hez BJJ addresses to the watch-list. The
+// addresses are validated before any change, so an invalid address does
+// not add any address
+func (w *WatchList) Add(addresses ...string) error {
+	return w.update(opAdd, addresses)
+}
+
+// OnAdd registers a handler called after the addresses not watched yet are
+// added, outside the watch-list lock. The addresses already watched and the
+// journal entries loaded on open do not call the handlers
+func (w *WatchList) OnAdd(handler AddHandler) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onAdd = append(w.onAdd, handler)
+}
+
+// Remove removes hez eth addresses or hez BJJ addresses from the
+// watch-list
+func (w *WatchList) Remove(addresses ...string) error {
+	return w.update(opRemove, addresses)
+}
+
+// Contains returns true if the hez eth address or the hez BJJ address is
+// watched
+func (w *WatchList) Contains(address string) bool {
+	if address == "" {
+		return false
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if isHezEthAddr(address) {
+		addr, err := apitypes.HezEthAddr(address).ToEthAddr()
+		if err != nil {
+			return false
+		}
+		_, ok := w.eth[addr]
+		return ok
+	}
+	pk, err := apitypes.HezBJJ(address).ToBJJ()
+	if err != nil {
+		return false
+	}
+	_, ok := w.bjj[pk]
+	return ok
+}
+
+// Match returns the watched address matching the hez eth address or the
+// hez BJJ address of a tx, or an empty string if none match. Empty and
+// invalid addresses never match
+func (w *WatchList) Match(ethAddr apitypes.HezEthAddr, bjjAddr apitypes.HezBJJ) string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if ethAddr != "" {
+		if addr, err := ethAddr.ToEthAddr(); err == nil {
+			if _, ok := w.eth[addr]; ok {
+				return string(apitypes.NewHezEthAddr(addr))
+			}
+		}
+	}
+	if bjjAddr != "" {
+		if pk, err := bjjAddr.ToBJJ(); err == nil {
+			if _, ok := w.bjj[pk]; ok {
+				return string(apitypes.NewHezBJJ(pk))
+			}
+		}
+	}
+	return ""
+}
+
+// Len returns the number of watched addresses
+func (w *WatchList) Len() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.eth) + len(w.bjj)
+}
+
+// Compact rewrites the journal with the watched addresses only, dropping
+// the removed ones. It writes a temporary file and renames it, so a crash
+// never leaves a partial journal
+func (w *WatchList) Compact() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.journal == nil {
+		return nil
+	}
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.E("cannot write the watch-list journal", err, errors.Params{"path": tmp})
+	}
+	buf := bufio.NewWriter(f)
+	for addr := range w.eth {
+		buf.WriteString(string(opAdd) + string(apitypes.NewHezEthAddr(addr)) + "\n")
+	}
+	for pk := range w.bjj {
+		buf.WriteString(string(opAdd) + string(apitypes.NewHezBJJ(pk)) + "\n")
+	}
+	if err := buf.Flush(); err != nil {
+		f.Close()
+		return errors.E("cannot write the watch-list journal", err, errors.Params{"path": tmp})
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+	journal, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.E("cannot open the watch-list journal", err, errors.Params{"path": w.path})
+	}
+	w.journal.Close()
+	w.journal = journal
+	return nil
+}
+
+// update validates the addresses, applies the operation and appends the
+// changes to the journal. The addresses not changing the sets are not
+// journaled, so adding a watched address again does not write the journal
+func (w *WatchList) update(op byte, addresses []string) error {
+	for _, address := range addresses {
+		if err := validAddress(address); err != nil {
+			return err
+		}
+	}
+	changed, handlers, err := w.updateSets(op, addresses)
+	if err != nil {
+		return err
+	}
+	if op == opAdd {
+		for _, address := range changed {
+			for _, handler := range handlers {
+				handler(address)
+			}
+		}
+	}
+	return nil
+}
+
+// updateSets applies the operation to the sets and appends the changes to
+// the journal under the lock. It returns the changed addresses and the add
+// handlers to call
+func (w *WatchList) updateSets(op byte, addresses []string) ([]string, []AddHandler, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var journal strings.Builder
+	changed := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		ok, err := w.apply(op, address)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		changed = append(changed, address)
+		journal.WriteByte(op)
+		journal.WriteString(address)
+		journal.WriteByte('\n')
+	}
+	if w.journal == nil || journal.Len() == 0 {
+		return changed, w.onAdd, nil
+	}
+	if _, err := w.journal.WriteString(journal.String()); err != nil {
+		return nil, nil, errors.E("cannot write the watch-list journal", err)
+	}
+	if err := w.journal.Sync(); err != nil {
+		return nil, nil, err
+	}
+	return changed, w.onAdd, nil
+}
+
+// apply adds or removes an address from the sets, the caller must hold
+// the lock. It returns true if the sets changed
+func (w *WatchList) apply(op byte, address string) (bool, error) {
+	if isHezEthAddr(address) {
+		addr, err := apitypes.HezEthAddr(address).ToEthAddr()
+		if err != nil {
+			return false, err
+		}
+		_, watched := w.eth[addr]
+		if op == opAdd {
+			w.eth[addr] = struct{}{}
+		} else {
+			delete(w.eth, addr)
+		}
+		return watched != (op == opAdd), nil
+	}
+	pk, err := apitypes.HezBJJ(address).ToBJJ()
+	if err != nil {
+		return false, err
+	}
+	_, watched := w.bjj[pk]
+	if op == opAdd {
+		w.bjj[pk] = struct{}{}
+	} else {
+		delete(w.bjj, pk)
+	}
+	return watched != (op == opAdd), nil
+}
+
+// validAddress checks a hez eth address or a hez BJJ address
+func validAddress(address string) error {
+	var err error
+	if isHezEthAddr(address) {
+		_, err = apitypes.HezEthAddr(address).ToEthAddr()
+	} else {
+		_, err = apitypes.HezBJJ(address).ToBJJ()
+	}
+	if err != nil {
+		return errors.E("invalid watch-list address", err, errors.Params{"address": address})
+	}
+	return nil
+}
+
+// isHezEthAddr returns true if the address has the hez eth address prefix
+func isHezEthAddr(address string) bool {
+	return strings.HasPrefix(strings.ToLower(address), hezEthPrefix)
+}
@@ -0,0 +1,57 @@
+package transaction
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/metrics"
+	"github.com/hermeznetwork/hermez-integration/tracing"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+type (
+	// SentHook is called after a transaction is accepted by the coordinator pool
+	SentHook func(tx hezCommon.PoolL2Tx, token hezCommon.Token, txID string)
+)
+
+var (
+	hooksMu   sync.RWMutex
+	sentHooks []SentHook
+)
+
+// RegisterSentHook register a hook to be called for every transaction
+// sent by this package
+func RegisterSentHook(hook SentHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	sentHooks = append(sentHooks, hook)
+}
+
+// Send send a signed transaction to the coordinator pool and call the
+// hooks. On error the tx id is returned, the pool could still receive the
+// tx after a timeout
+func Send(ctx context.Context, c client.TxSubmitter, tx hezCommon.PoolL2Tx, token hezCommon.Token) (string, error) {
+	metrics.TxSigned(token, tx.Type)
+	ctx, span := tracing.Start(ctx, "transaction.Send", tracing.TxAttributes(&tx, token)...)
+	hash, err := c.SendTransaction(ctx, tx, token)
+	tracing.End(span, err)
+	if err != nil {
+		return tx.TxID.String(), err
+	}
+	notifySent(ctx, tx, token, hash)
+	return hash, nil
+}
+
+// notifySent call the hooks for a transaction accepted by the pool
+func notifySent(ctx context.Context, tx hezCommon.PoolL2Tx, token hezCommon.Token, txID string) {
+	tracing.RememberTx(ctx, txID)
+	if feeAmount, err := hezCommon.CalcFeeAmount(tx.Amount, tx.Fee); err == nil {
+		metrics.FeePaid(token, feeAmount)
+	}
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+	for _, hook := range sentHooks {
+		hook(tx, token, txID)
+	}
+}
@@ -0,0 +1,120 @@
+package transaction
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/hermez"
+	"github.com/hermeznetwork/hermez-integration/policy"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+type (
+	// ApprovalGate represents the M-of-N approval required before signing
+	// the large outgoing txs
+	ApprovalGate interface {
+		// Required returns if the amount needs an approved proposal
+		Required(tokenID hezCommon.TokenID, amount *big.Int) bool
+		// Check checks the proposal being executed authorizes the intent
+		Check(proposalID string, intent policy.Intent) error
+	}
+
+	// proposalKey is the context key of the proposal id
+	proposalKey struct{}
+)
+
+var (
+	policyMu         sync.RWMutex
+	withdrawalPolicy *policy.Engine
+	approvals        ApprovalGate
+)
+
+// SetPolicy sets the withdrawal policy consulted before signing the
+// outgoing txs of this package. Without policy all txs are signed
+func SetPolicy(e *policy.Engine) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	withdrawalPolicy = e
+}
+
+// SetApprovals sets the M-of-N approval gate consulted before signing the
+// outgoing txs of this package. The txs above the gate threshold are
+// signed only with the id of the proposal being executed into the context
+func SetApprovals(gate ApprovalGate) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	approvals = gate
+}
+
+// WithProposal returns a context carrying the id of the proposal being
+// executed, authorizing its tx
+func WithProposal(ctx context.Context, proposalID string) context.Context {
+	return context.WithValue(ctx, proposalKey{}, proposalID)
+}
+
+// ProposalID returns the proposal id carried by the context
+func ProposalID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(proposalKey{}).(string)
+	return id, ok && id != ""
+}
+
+// Authorize checks an outgoing tx intent against the approval gate and
+// the withdrawal policy, if set. An intent above the gate threshold needs
+// the id of the proposal being executed into the context, then the
+// policy limits are not checked again. It must be called before signing
+// and the intent must be released if the tx is not sent
+func Authorize(ctx context.Context, intent policy.Intent) error {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	exempt := withdrawalPolicy != nil && withdrawalPolicy.Exempt(intent.Destination)
+	if approvals != nil && !exempt && approvals.Required(intent.TokenID, intent.Amount) {
+		id, ok := ProposalID(ctx)
+		if !ok {
+			return errors.E("approved proposal required", errors.Params{
+				"destination": intent.Destination,
+				"amount":      intent.Amount.String(),
+			})
+		}
+		if err := approvals.Check(id, intent); err != nil {
+			return err
+		}
+		if withdrawalPolicy == nil {
+			return nil
+		}
+		return withdrawalPolicy.AuthorizeApproved(intent)
+	}
+	if withdrawalPolicy == nil {
+		return nil
+	}
+	return withdrawalPolicy.Authorize(intent)
+}
+
+// Release stops counting an authorized intent whose tx was not sent. The
+// errors are logged, the intent stays counted until the limits window ends
+func Release(intent policy.Intent) {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	if withdrawalPolicy == nil {
+		return
+	}
+	if err := withdrawalPolicy.Release(intent); err != nil {
+		logger.Error(errors.E("cannot release the policy intent", err,
+			errors.Params{"intent_id": intent.ID()}))
+	}
+}
+
+// newIntent returns the policy intent of an outgoing tx from the wallet
+func newIntent(bjj *hermez.Wallet, fromIdx hezCommon.Idx, txType hezCommon.TxType, destination string,
+	token hezCommon.Token, amount *big.Int) policy.Intent {
+	return policy.Intent{
+		WalletIndex: bjj.Index,
+		FromIdx:     fromIdx,
+		Type:        txType,
+		Destination: destination,
+		TokenID:     token.TokenID,
+		Amount:      amount,
+	}
+}
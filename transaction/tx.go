@@ -1,18 +1,23 @@
 package transaction
 
 import (
+	"context"
 	"math/big"
 	"strings"
 
+	"github.com/Pantani/errors"
 	"github.com/Pantani/logger"
 	"github.com/hermeznetwork/hermez-integration/client"
 	"github.com/hermeznetwork/hermez-integration/hermez"
+	"github.com/hermeznetwork/hermez-integration/metrics"
+	"github.com/hermeznetwork/hermez-integration/policy"
+	"github.com/hermeznetwork/hermez-integration/tracing"
 	hezCommon "github.com/hermeznetwork/hermez-node/common"
 )
 
 // GetAccountInfo fetches account from network, check the balance and returns
 // the idx, nonce and an error if occurs
-func GetAccountInfo(c *client.Client, bjjAddress, hezEthAddress *string,
+func GetAccountInfo(c client.AccountReader, bjjAddress, hezEthAddress *string,
 	tokenID hezCommon.TokenID) (hezCommon.Idx, hezCommon.Nonce, error) {
 
 	idx := hezCommon.Idx(0)
@@ -35,110 +40,227 @@ func GetAccountInfo(c *client.Client, bjjAddress, hezEthAddress *string,
 	return idx, nonce, nil
 }
 
-// Transfer create and send a Transfer transaction
-func Transfer(bjj *hermez.Wallet, c *client.Client, chainID uint16,
-	fromIdx, toIdx hezCommon.Idx, amount *big.Int, fee hezCommon.FeeSelector,
-	token hezCommon.Token, nonce hezCommon.Nonce) (string, error) {
-
-	tx, err := hermez.CreateTransfer(
-		chainID,
-		toIdx,
-		amount,
-		bjj.PrivateKey,
-		fromIdx,
-		token.TokenID,
-		nonce,
-		fee,
-	)
+// KnownTx checks if the tx is into the pool, and not invalid, or forged.
+// A lookup error is returned, so the tx is only handled as absent if the
+// node confirms it is not into the pool and the history
+func KnownTx(c client.TxReader, txID string) (bool, error) {
+	if txID == "" {
+		return false, nil
+	}
+	poolTx, err := c.GetPoolTx(txID)
 	if err != nil {
-		return "", err
+		return false, errors.E("cannot get the pool tx", err, errors.Params{"tx_id": txID})
 	}
-
-	// Send the transaction
-	hash, err := c.SendTransaction(*tx, token)
+	if poolTx != nil && poolTx.TxID.String() == txID {
+		return poolTx.State != hezCommon.PoolL2TxStateInvalid, nil
+	}
+	tx, err := c.GetTx(txID)
 	if err != nil {
-		return "", err
+		return false, errors.E("cannot get the tx", err, errors.Params{"tx_id": txID})
 	}
-	return hash, nil
+	return tx != nil && tx.TxID.String() == txID, nil
+}
+
+// Transfer create and send a Transfer transaction
+func Transfer(ctx context.Context, bjj *hermez.Wallet, c client.TxSubmitter, chainID uint16,
+	fromIdx, toIdx hezCommon.Idx, amount *big.Int, fee hezCommon.FeeSelector,
+	token hezCommon.Token, nonce hezCommon.Nonce) (string, error) {
+
+	ctx, span := tracing.Start(ctx, "transaction.Transfer")
+	intent := newIntent(bjj, fromIdx, hezCommon.TxTypeTransfer, policy.IdxDestination(toIdx), token, amount)
+	hash, err := signAndSend(ctx, c, intent, token, func(ctx context.Context) (*hezCommon.PoolL2Tx, error) {
+		return hermez.CreateTransfer(
+			ctx,
+			chainID,
+			toIdx,
+			amount,
+			bjj.PrivateKey,
+			fromIdx,
+			token.TokenID,
+			nonce,
+			fee,
+		)
+	})
+	tracing.End(span, err)
+	return hash, err
 }
 
 // TransferToBjj create and send a Transfer to baby jubjub transaction
-func TransferToBjj(bjj *hermez.Wallet, c *client.Client, chainID uint16,
+func TransferToBjj(ctx context.Context, bjj *hermez.Wallet, c client.TxSubmitter, chainID uint16,
 	fromIdx hezCommon.Idx, toBjjAddr string, amount *big.Int, fee hezCommon.FeeSelector,
 	token hezCommon.Token, nonce hezCommon.Nonce) (string, error) {
 
-	tx, err := hermez.CreateTransferToBjj(
-		chainID,
-		toBjjAddr,
-		amount,
-		bjj.PrivateKey,
-		fromIdx,
-		token.TokenID,
-		nonce,
-		fee,
-	)
-	if err != nil {
-		return "", err
-	}
-
-	// Send the transaction
-	hash, err := c.SendTransaction(*tx, token)
-	if err != nil {
-		return "", err
-	}
-	return hash, nil
+	ctx, span := tracing.Start(ctx, "transaction.TransferToBjj")
+	intent := newIntent(bjj, fromIdx, hezCommon.TxTypeTransferToBJJ, policy.BJJDestination(toBjjAddr), token, amount)
+	hash, err := signAndSend(ctx, c, intent, token, func(ctx context.Context) (*hezCommon.PoolL2Tx, error) {
+		return hermez.CreateTransferToBjj(
+			ctx,
+			chainID,
+			toBjjAddr,
+			amount,
+			bjj.PrivateKey,
+			fromIdx,
+			token.TokenID,
+			nonce,
+			fee,
+		)
+	})
+	tracing.End(span, err)
+	return hash, err
 }
 
 // TransferToEthAddress create and send a Transfer to ethereum address transaction
-func TransferToEthAddress(bjj *hermez.Wallet, c *client.Client, chainID uint16,
+func TransferToEthAddress(ctx context.Context, bjj *hermez.Wallet, c client.TxSubmitter, chainID uint16,
 	fromIdx hezCommon.Idx, toHezEthAddr string, amount *big.Int, fee hezCommon.FeeSelector,
 	token hezCommon.Token, nonce hezCommon.Nonce) (string, error) {
 
 	toEthAddr := strings.Replace(toHezEthAddr, "hez:", "", -1)
-	tx, err := hermez.CreateTransferToEthAddress(
-		chainID,
-		toEthAddr,
-		amount,
-		bjj.PrivateKey,
-		fromIdx,
-		token.TokenID,
-		nonce,
-		fee,
-	)
-	if err != nil {
-		return "", err
-	}
-
-	// Send the transaction
-	hash, err := c.SendTransaction(*tx, token)
-	if err != nil {
-		return "", err
-	}
-	return hash, nil
+	ctx, span := tracing.Start(ctx, "transaction.TransferToEthAddress")
+	intent := newIntent(bjj, fromIdx, hezCommon.TxTypeTransferToEthAddr, policy.EthDestination(toHezEthAddr), token, amount)
+	hash, err := signAndSend(ctx, c, intent, token, func(ctx context.Context) (*hezCommon.PoolL2Tx, error) {
+		return hermez.CreateTransferToEthAddress(
+			ctx,
+			chainID,
+			toEthAddr,
+			amount,
+			bjj.PrivateKey,
+			fromIdx,
+			token.TokenID,
+			nonce,
+			fee,
+		)
+	})
+	tracing.End(span, err)
+	return hash, err
 }
 
 // Exit create and send a Transfer Exit transaction
-func Exit(bjj *hermez.Wallet, c *client.Client, chainID uint16, fromIdx hezCommon.Idx,
+func Exit(ctx context.Context, bjj *hermez.Wallet, c client.TxSubmitter, chainID uint16, fromIdx hezCommon.Idx,
 	amount *big.Int, fee hezCommon.FeeSelector, token hezCommon.Token,
 	nonce hezCommon.Nonce) (string, error) {
 
-	tx, err := hermez.CreateExit(
-		chainID,
-		amount,
-		bjj.PrivateKey,
-		fromIdx,
-		token.TokenID,
-		nonce,
-		fee,
-	)
+	ctx, span := tracing.Start(ctx, "transaction.Exit")
+	intent := newIntent(bjj, fromIdx, hezCommon.TxTypeExit, policy.DestinationExit, token, amount)
+	hash, err := signAndSend(ctx, c, intent, token, func(ctx context.Context) (*hezCommon.PoolL2Tx, error) {
+		return hermez.CreateExit(
+			ctx,
+			chainID,
+			amount,
+			bjj.PrivateKey,
+			fromIdx,
+			token.TokenID,
+			nonce,
+			fee,
+		)
+	})
+	tracing.End(span, err)
+	return hash, err
+}
+
+// signAndSend authorizes the intent, signs the tx and sends it to the pool.
+// The intent is released if the tx is rejected by the pool, it is kept if
+// the pool could have received the tx. Once signed, the tx id is returned
+// also on error
+func signAndSend(ctx context.Context, c client.TxSubmitter, intent policy.Intent, token hezCommon.Token,
+	sign func(ctx context.Context) (*hezCommon.PoolL2Tx, error)) (string, error) {
+	if err := Authorize(ctx, intent); err != nil {
+		return "", err
+	}
+	tx, err := tracing.Sign(ctx, token, sign)
 	if err != nil {
+		Release(intent)
 		return "", err
 	}
 
 	// Send the transaction
-	hash, err := c.SendTransaction(*tx, token)
-	if err != nil {
-		return "", err
+	hash, err := Send(ctx, c, *tx, token)
+	if err != nil && !client.IsSentStateUnknown(err) {
+		Release(intent)
+	}
+	return hash, err
+}
+
+// SendAtomicGroup signs, validate and send a group of linked transactions.
+// The txs with a signer are checked against the withdrawal policy and
+// signed by it, the others must be already signed by the counterparty.
+// It returns the tx hashes in the group order
+func SendAtomicGroup(ctx context.Context, c client.TxSubmitter, chainID uint16, txs []*hezCommon.PoolL2Tx,
+	signers []*hermez.Wallet, tokens client.Tokens) ([]string, error) {
+	if len(signers) != len(txs) {
+		return nil, errors.E("atomic group signers mismatch",
+			errors.Params{"txs": len(txs), "signers": len(signers)})
+	}
+	if err := hermez.ValidateAtomicGroup(txs, false); err != nil {
+		return nil, err
+	}
+
+	// check the withdrawal policy before signing, the intents of the txs
+	// rejected or not sent are released
+	intents := make([]*policy.Intent, len(txs))
+	release := func(from int) {
+		for _, intent := range intents[from:] {
+			if intent != nil {
+				Release(*intent)
+			}
+		}
+	}
+	for i, tx := range txs {
+		if signers[i] == nil {
+			continue
+		}
+		token, err := tokens.GetTokenByID(tx.TokenID)
+		if err != nil {
+			release(0)
+			return nil, err
+		}
+		intent := newIntent(signers[i], tx.FromIdx, tx.Type, policy.TxDestination(tx), token, tx.Amount)
+		if err := Authorize(ctx, intent); err != nil {
+			release(0)
+			return nil, err
+		}
+		intents[i] = &intent
+		signer := signers[i]
+		if _, err := tracing.Sign(ctx, token, func(ctx context.Context) (*hezCommon.PoolL2Tx, error) {
+			return tx, hermez.SignTx(chainID, tx, signer.PrivateKey)
+		}); err != nil {
+			release(0)
+			return nil, err
+		}
+	}
+	if err := hermez.ValidateAtomicGroup(txs, true); err != nil {
+		release(0)
+		return nil, err
+	}
+
+	hashes := make([]string, 0, len(txs))
+	for i, tx := range txs {
+		token, err := tokens.GetTokenByID(tx.TokenID)
+		if err != nil {
+			release(i)
+			return hashes, err
+		}
+		rqToken, err := tokens.GetTokenByID(tx.RqTokenID)
+		if err != nil {
+			release(i)
+			return hashes, err
+		}
+
+		// Send the transaction
+		metrics.TxSigned(token, tx.Type)
+		sendCtx, span := tracing.Start(ctx, "transaction.SendAtomic", tracing.TxAttributes(tx, token)...)
+		hash, err := c.SendAtomicTransaction(sendCtx, *tx, token, rqToken)
+		tracing.End(span, err)
+		if client.IsSentStateUnknown(err) {
+			// the pool could have received the tx, its spend is kept
+			release(i + 1)
+			return hashes, err
+		}
+		if err != nil {
+			release(i)
+			return hashes, err
+		}
+		notifySent(sendCtx, *tx, token, hash)
+		hashes = append(hashes, hash)
 	}
-	return hash, nil
+	return hashes, nil
 }
@@ -0,0 +1,141 @@
+package verify
+
+import (
+	"math/big"
+
+	"github.com/Pantani/errors"
+	"github.com/hermeznetwork/hermez-integration/client"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	"github.com/iden3/go-merkletree"
+)
+
+// CheckProof checks a circom inclusion merkle proof of the key and the
+// value against the root. The root is computed from the Poseidon hash of
+// the leaf and the siblings, so a proof forged by the node does not match
+func CheckProof(root, key, value *big.Int, proof *merkletree.CircomVerifierProof) error {
+	if proof == nil || proof.Root == nil || proof.Key == nil || proof.Value == nil {
+		return errors.E("missing merkle proof")
+	}
+	params := errors.Params{"key": key.String()}
+	if proof.Fnc != 0 {
+		return errors.E("not an inclusion proof", params)
+	}
+	if proof.Root.BigInt().Cmp(root) != 0 {
+		params["root"] = root.String()
+		params["proof_root"] = proof.Root.BigInt().String()
+		return errors.E("merkle proof root mismatch", params)
+	}
+	if proof.Key.BigInt().Cmp(key) != 0 {
+		params["proof_key"] = proof.Key.BigInt().String()
+		return errors.E("merkle proof key mismatch", params)
+	}
+	if proof.Value.BigInt().Cmp(value) != 0 {
+		params["value"] = value.String()
+		params["proof_value"] = proof.Value.BigInt().String()
+		return errors.E("merkle proof value mismatch", params)
+	}
+
+	node, err := merkletree.LeafKey(merkletree.NewHashFromBigInt(key), merkletree.NewHashFromBigInt(value))
+	if err != nil {
+		return err
+	}
+	// the circom siblings are padded with zeros up to the tree levels
+	siblings := proof.Siblings
+	for len(siblings) > 0 && (siblings[len(siblings)-1] == nil ||
+		*siblings[len(siblings)-1] == merkletree.HashZero) {
+		siblings = siblings[:len(siblings)-1]
+	}
+	path := merkletree.NewHashFromBigInt(key)
+	for lvl := len(siblings) - 1; lvl >= 0; lvl-- {
+		sibling := siblings[lvl]
+		if sibling == nil {
+			sibling = &merkletree.HashZero
+		}
+		if merkletree.TestBit(path[:], uint(lvl)) {
+			node, err = merkletree.HashElems(sibling.BigInt(), node.BigInt())
+		} else {
+			node, err = merkletree.HashElems(node.BigInt(), sibling.BigInt())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if node.BigInt().Cmp(root) != 0 {
+		params["computed_root"] = node.BigInt().String()
+		params["root"] = root.String()
+		return errors.E("invalid merkle proof", params)
+	}
+	return nil
+}
+
+// CheckExit checks the exit merkle proof against the batch exit root. The
+// proof value must be the hash of the exit account served by the node
+func CheckExit(batch *client.Batch, exit *client.Exit) error {
+	if exit.BJJ == nil || exit.EthAddr == nil {
+		return errors.E("exit without owner", errors.Params{"idx": exit.Idx})
+	}
+	bjj, err := exit.BJJ.ToBJJ()
+	if err != nil {
+		return errors.E("invalid exit BJJ", err, errors.Params{"idx": exit.Idx})
+	}
+	ethAddr, err := exit.EthAddr.ToEthAddr()
+	if err != nil {
+		return errors.E("invalid exit eth address", err, errors.Params{"idx": exit.Idx})
+	}
+	balance, ok := new(big.Int).SetString(string(exit.Balance), 10)
+	if !ok {
+		return errors.E("invalid exit balance", errors.Params{"idx": exit.Idx})
+	}
+	// the exit tree accounts have no nonce
+	value, err := leafValue(hezCommon.Account{
+		Idx:     hezCommon.Idx(exit.Idx),
+		TokenID: exit.Token.TokenID,
+		BJJ:     bjj,
+		EthAddr: ethAddr,
+		Balance: balance,
+	})
+	if err != nil {
+		return err
+	}
+	root, ok := new(big.Int).SetString(string(batch.ExitRoot), 10)
+	if !ok {
+		return errors.E("invalid batch exit root", errors.Params{"batch": batch.BatchNum})
+	}
+	if err := CheckProof(root, big.NewInt(int64(exit.Idx)), value, exit.MerkleProof); err != nil {
+		return errors.E("invalid exit proof", err, errors.Params{"batch": batch.BatchNum, "idx": exit.Idx})
+	}
+	return nil
+}
+
+// AccountValue returns the state tree leaf value of an account, the
+// Poseidon hash of the account fields
+func AccountValue(account *client.Account) (*big.Int, error) {
+	bjj, err := account.PublicKey.ToBJJ()
+	if err != nil {
+		return nil, errors.E("invalid account BJJ", err, errors.Params{"idx": account.Idx})
+	}
+	ethAddr, err := account.EthAddr.ToEthAddr()
+	if err != nil {
+		return nil, errors.E("invalid account eth address", err, errors.Params{"idx": account.Idx})
+	}
+	if account.Balance == nil {
+		return nil, errors.E("account without balance", errors.Params{"idx": account.Idx})
+	}
+	return leafValue(hezCommon.Account{
+		Idx:     hezCommon.Idx(account.Idx),
+		TokenID: account.Token.TokenID,
+		BJJ:     bjj,
+		EthAddr: ethAddr,
+		Nonce:   account.Nonce,
+		Balance: &account.Balance.Int,
+	})
+}
+
+// leafValue returns the merkle tree leaf value of an account
+func leafValue(account hezCommon.Account) (*big.Int, error) {
+	value, err := account.HashValue()
+	if err != nil {
+		return nil, errors.E("cannot hash the account", err, errors.Params{"idx": account.Idx})
+	}
+	return value, nil
+}
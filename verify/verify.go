@@ -0,0 +1,234 @@
+package verify
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/hermeznetwork/hermez-integration/client"
+	"github.com/hermeznetwork/hermez-integration/metrics"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+)
+
+const (
+	// checkExitProof is the check of the exit proofs against the exit root
+	checkExitProof = "exit_proof"
+	// checkExitRoot is the check of the batch exit root between the nodes
+	checkExitRoot = "exit_root"
+	// checkAccountState is the check of the batch state root and the
+	// account leaf between the nodes
+	checkAccountState = "account_state"
+)
+
+type (
+	// Verifier verifies the rollup state served by each node of the pool.
+	// The exits are verified against the batch exit root with the exit
+	// tree merkle proof. The node API does not serve the state tree
+	// proofs, so the accounts are verified comparing the batch state root
+	// and the account leaf hash between the nodes at the same batch. The
+	// nodes serving inconsistent data are flagged into the pool
+	Verifier struct {
+		c *client.Client
+	}
+
+	// Account represents an account to verify
+	Account struct {
+		Idx         hezCommon.Idx
+		TokenSymbol string
+	}
+
+	// nodeValue represents a value served by a node
+	nodeValue struct {
+		url   string
+		value string
+	}
+)
+
+// New creates a new state verifier for the client pool nodes
+func New(c *client.Client) *Verifier {
+	return &Verifier{c: c}
+}
+
+// VerifyExit verifies the exit of an account into a batch on every node.
+// Each node exit proof is checked against the node batch exit root and the
+// exit roots are compared between the nodes
+func (v *Verifier) VerifyExit(batchNum hezCommon.BatchNum, idx hezCommon.Idx, tokenSymbol string) error {
+	params := errors.Params{"batch": batchNum, "idx": idx, "token": tokenSymbol}
+	roots := make([]nodeValue, 0)
+	flagged := 0
+	for url, nc := range v.c.NodeClients() {
+		batch, err := nc.GetBatch(batchNum)
+		if err != nil {
+			logger.Error(errors.E("cannot get the node batch", err, errors.Params{"node": url, "batch": batchNum}))
+			continue
+		}
+		exit, err := nc.GetExit(batchNum, idx, tokenSymbol)
+		if err != nil {
+			logger.Error(errors.E("cannot get the node exit", err, errors.Params{"node": url, "batch": batchNum}))
+			continue
+		}
+		if err := CheckExit(batch, exit); err != nil {
+			v.flag(url, checkExitProof, err)
+			flagged++
+			continue
+		}
+		roots = append(roots, nodeValue{url: url, value: string(batch.ExitRoot)})
+	}
+	flagged += v.flagMinority(roots, checkExitRoot, params)
+	if len(roots) == 0 {
+		return errors.E("no node served a valid exit proof", params)
+	}
+	if flagged > 0 {
+		params["flagged"] = flagged
+		return errors.E("inconsistent exit", params)
+	}
+	logger.Info("Exit verified", logger.Params{
+		"batch":     batchNum,
+		"idx":       idx,
+		"exit_root": roots[0].value,
+		"nodes":     len(roots),
+	})
+	return nil
+}
+
+// VerifyAccount verifies an account on every node. The nodes are grouped
+// by their last batch and the batch state root and the account leaf hash
+// are compared between the nodes of each group. A node forging a batch
+// during the reads is skipped. Without two nodes at the same batch the
+// account is not verified and an error is returned
+func (v *Verifier) VerifyAccount(account Account) error {
+	params := errors.Params{"idx": account.Idx, "token": account.TokenSymbol}
+	states := make(map[hezCommon.BatchNum][]nodeValue)
+	flagged := 0
+	for url, nc := range v.c.NodeClients() {
+		before, err := nc.GetLastBatch()
+		if err != nil {
+			logger.Error(errors.E("cannot get the node last batch", err, errors.Params{"node": url}))
+			continue
+		}
+		acc, err := nc.GetAccountByIdx(account.Idx, account.TokenSymbol)
+		if err != nil {
+			logger.Error(errors.E("cannot get the node account", err, errors.Params{"node": url, "idx": account.Idx}))
+			continue
+		}
+		after, err := nc.GetLastBatch()
+		if err != nil {
+			logger.Error(errors.E("cannot get the node last batch", err, errors.Params{"node": url}))
+			continue
+		}
+		if before.BatchNum != after.BatchNum || before.StateRoot != after.StateRoot {
+			logger.Debug("Node batch changed during the account read", logger.Params{
+				"node": url, "before": before.BatchNum, "after": after.BatchNum,
+			})
+			continue
+		}
+		// a response the leaf can't be computed from is a node error, not
+		// an inconsistent state
+		value, err := AccountValue(acc)
+		if err != nil {
+			logger.Error(errors.E("cannot compute the node account leaf", err, errors.Params{"node": url}))
+			continue
+		}
+		states[after.BatchNum] = append(states[after.BatchNum], nodeValue{
+			url:   url,
+			value: string(after.StateRoot) + "/" + value.String(),
+		})
+	}
+	compared := 0
+	for batchNum, values := range states {
+		if len(values) < 2 {
+			continue
+		}
+		compared += len(values)
+		batchParams := errors.Params{"batch": batchNum}
+		for k, p := range params {
+			batchParams[k] = p
+		}
+		flagged += v.flagMinority(values, checkAccountState, batchParams)
+	}
+	if flagged > 0 {
+		params["flagged"] = flagged
+		return errors.E("inconsistent account", params)
+	}
+	if compared < 2 {
+		read := 0
+		for _, values := range states {
+			read += len(values)
+		}
+		params["nodes"] = read
+		return errors.E("no nodes to compare the account", params)
+	}
+	logger.Info("Account verified", logger.Params{"idx": account.Idx, "nodes": compared})
+	return nil
+}
+
+// Run verifies the accounts every interval. The inconsistencies are
+// logged and the nodes flagged, so the verification does not stop the
+// service
+func (v *Verifier) Run(accounts []Account, interval time.Duration) func() error {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			for _, account := range accounts {
+				if err := v.VerifyAccount(account); err != nil {
+					logger.Error(err)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// flagMinority compares the values served by the nodes and flags the
+// nodes not serving the majority value. Without a strict majority the
+// faulty nodes are unknown and no node is flagged. It returns the number
+// of flagged nodes
+func (v *Verifier) flagMinority(values []nodeValue, check string, params errors.Params) int {
+	if len(values) < 2 {
+		return 0
+	}
+	counts := make(map[string]int)
+	for _, nv := range values {
+		counts[nv.value]++
+	}
+	if len(counts) == 1 {
+		return 0
+	}
+	majority, votes := "", 0
+	for value, count := range counts {
+		if count > votes {
+			majority, votes = value, count
+		}
+	}
+	if votes*2 <= len(values) {
+		urls := make([]string, 0, len(values))
+		for _, nv := range values {
+			urls = append(urls, nv.url)
+		}
+		sort.Strings(urls)
+		params["nodes"] = urls
+		params["check"] = check
+		logger.Error(errors.E("nodes disagree without a majority", params))
+		return 0
+	}
+	flagged := 0
+	for _, nv := range values {
+		if nv.value == majority {
+			continue
+		}
+		reasonParams := errors.Params{"check": check, "value": nv.value, "majority": majority}
+		for k, p := range params {
+			reasonParams[k] = p
+		}
+		v.flag(nv.url, check, errors.E("node disagrees with the majority", reasonParams))
+		flagged++
+	}
+	return flagged
+}
+
+// flag flags a node serving inconsistent data
+func (v *Verifier) flag(url, check string, reason error) {
+	metrics.NodeInconsistent(url, check)
+	v.c.FlagNode(url, reason)
+}
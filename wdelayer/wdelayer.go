@@ -0,0 +1,207 @@
+package wdelayer
+
+import (
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/Pantani/errors"
+	"github.com/Pantani/logger"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	ethCommon "github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	hezCommon "github.com/hermeznetwork/hermez-node/common"
+	WithdrawalDelayer "github.com/hermeznetwork/hermez-node/eth/contracts/withdrawdelayer"
+)
+
+type (
+	// Tracker represents the withdrawal delayer tracker. The exits bigger
+	// than the rollup withdrawal limit are sent to the WDelayer contract
+	// and can be withdrawn only after the withdrawal delay
+	Tracker struct {
+		address  ethCommon.Address
+		contract *WithdrawalDelayer.WithdrawalDelayer
+		abi      abi.ABI
+		owners   []ethCommon.Address
+		tokens   []hezCommon.Token
+	}
+
+	// State represents the WDelayer contract state
+	State struct {
+		WithdrawalDelay    time.Duration `json:"withdrawalDelay"`
+		EmergencyMode      bool          `json:"emergencyMode"`
+		EmergencyStartedAt time.Time     `json:"emergencyStartedAt,omitempty"`
+	}
+
+	// Withdrawal represents a delayed withdrawal of an owner and a token
+	Withdrawal struct {
+		Owner         ethCommon.Address `json:"owner"`
+		Token         hezCommon.Token   `json:"token"`
+		Amount        *big.Int          `json:"amount"`
+		DepositedAt   time.Time         `json:"depositedAt"`
+		UnlockAt      time.Time         `json:"unlockAt"`
+		EmergencyMode bool              `json:"emergencyMode"`
+		Claimable     bool              `json:"claimable"`
+	}
+
+	// Call represents an unsigned contract call
+	Call struct {
+		To   ethCommon.Address `json:"to"`
+		Data []byte            `json:"data"`
+	}
+)
+
+// New creates a new WDelayer tracker for the owner addresses (hez eth
+// addresses or eth addresses) and the tokens
+func New(backend bind.ContractBackend, address ethCommon.Address, owners []string,
+	tokens []hezCommon.Token) (*Tracker, error) {
+	contract, err := WithdrawalDelayer.NewWithdrawalDelayer(address, backend)
+	if err != nil {
+		return nil, errors.E("cannot bind the WDelayer contract", err)
+	}
+	contractABI, err := abi.JSON(strings.NewReader(WithdrawalDelayer.WithdrawalDelayerABI))
+	if err != nil {
+		return nil, err
+	}
+	ethOwners := make([]ethCommon.Address, 0, len(owners))
+	for _, owner := range owners {
+		addr := strings.TrimPrefix(owner, "hez:")
+		if !ethCommon.IsHexAddress(addr) {
+			return nil, errors.E("invalid owner address", errors.Params{"owner": owner})
+		}
+		ethOwners = append(ethOwners, ethCommon.HexToAddress(addr))
+	}
+	return &Tracker{
+		address:  address,
+		contract: contract,
+		abi:      contractABI,
+		owners:   ethOwners,
+		tokens:   tokens,
+	}, nil
+}
+
+// State returns the withdrawal delay and the emergency mode status
+func (t *Tracker) State() (*State, error) {
+	delay, err := t.contract.GetWithdrawalDelay(nil)
+	if err != nil {
+		return nil, errors.E("cannot get the withdrawal delay", err)
+	}
+	emergency, err := t.contract.IsEmergencyMode(nil)
+	if err != nil {
+		return nil, errors.E("cannot get the emergency mode", err)
+	}
+	state := &State{
+		WithdrawalDelay: time.Duration(delay) * time.Second,
+		EmergencyMode:   emergency,
+	}
+	if emergency {
+		startingTime, err := t.contract.GetEmergencyModeStartingTime(nil)
+		if err != nil {
+			return nil, errors.E("cannot get the emergency mode starting time", err)
+		}
+		state.EmergencyStartedAt = time.Unix(int64(startingTime), 0)
+	}
+	return state, nil
+}
+
+// Withdrawals returns the delayed withdrawals of the owners, with the
+// unlock time. A withdrawal is claimable after the unlock time if the
+// contract is not in emergency mode
+func (t *Tracker) Withdrawals() ([]Withdrawal, error) {
+	state, err := t.State()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	withdrawals := make([]Withdrawal, 0)
+	for _, owner := range t.owners {
+		for _, token := range t.tokens {
+			amount, depositTimestamp, err := t.contract.DepositInfo(nil, owner, token.EthAddr)
+			if err != nil {
+				return nil, errors.E("cannot get the deposit info", err,
+					errors.Params{"owner": owner.String(), "token": token.Symbol})
+			}
+			if amount == nil || amount.Sign() == 0 {
+				continue
+			}
+			depositedAt := time.Unix(int64(depositTimestamp), 0)
+			unlockAt := depositedAt.Add(state.WithdrawalDelay)
+			withdrawals = append(withdrawals, Withdrawal{
+				Owner:         owner,
+				Token:         token,
+				Amount:        amount,
+				DepositedAt:   depositedAt,
+				UnlockAt:      unlockAt,
+				EmergencyMode: state.EmergencyMode,
+				Claimable:     !state.EmergencyMode && !now.Before(unlockAt),
+			})
+		}
+	}
+	return withdrawals, nil
+}
+
+// WithdrawalCall builds the unsigned withdrawal contract call of a
+// claimable withdrawal
+func (t *Tracker) WithdrawalCall(w Withdrawal) (*Call, error) {
+	if !w.Claimable {
+		return nil, errors.E("withdrawal not claimable", errors.Params{
+			"owner":     w.Owner.String(),
+			"token":     w.Token.Symbol,
+			"unlock_at": w.UnlockAt,
+		})
+	}
+	data, err := t.abi.Pack("withdrawal", w.Owner, w.Token.EthAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Call{To: t.address, Data: data}, nil
+}
+
+// Withdraw signs and sends the withdrawal of a claimable withdrawal
+func (t *Tracker) Withdraw(opts *bind.TransactOpts, w Withdrawal) (*types.Transaction, error) {
+	if _, err := t.WithdrawalCall(w); err != nil {
+		return nil, err
+	}
+	return t.contract.Withdrawal(opts, w.Owner, w.Token.EthAddr)
+}
+
+// Run tracks the delayed withdrawals periodically and reports the unlock
+// time and the withdrawal call once they are claimable. The node and L1
+// errors are logged and the withdrawals are read again in the next tick
+func (t *Tracker) Run(interval time.Duration) func() error {
+	return func() error {
+		ticker := time.NewTicker(interval)
+		for {
+			select {
+			case <-ticker.C:
+				withdrawals, err := t.Withdrawals()
+				if err != nil {
+					logger.Error(errors.E("cannot get the delayed withdrawals", err))
+					continue
+				}
+				for _, w := range withdrawals {
+					params := logger.Params{
+						"owner":          w.Owner.String(),
+						"token":          w.Token.Symbol,
+						"amount":         w.Amount.String(),
+						"unlock_at":      w.UnlockAt,
+						"emergency_mode": w.EmergencyMode,
+					}
+					if !w.Claimable {
+						logger.Info("Delayed withdrawal locked", params)
+						continue
+					}
+					call, err := t.WithdrawalCall(w)
+					if err != nil {
+						logger.Error(err)
+						continue
+					}
+					params["to"] = call.To.String()
+					params["data"] = ethCommon.Bytes2Hex(call.Data)
+					logger.Info("Delayed withdrawal claimable", params)
+				}
+			}
+		}
+	}
+}